@@ -0,0 +1,60 @@
+// Package collector samples the stats of the runtime environment on its own cadence,
+// independently of the arrival of the telemetry.
+package collector
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+	"github.com/sirupsen/logrus"
+)
+
+var Logger *logrus.Entry
+
+// Collector samples the metrics of a source. A collector may keep the previous sample to report rates.
+type Collector interface {
+	Name() string
+	// Collect returns the metrics at now. It returns no metrics if the source is not available, e.g. out of Lambda.
+	Collect(now time.Time) ([]*mackerel.MetricValue, error)
+	// GraphDefs returns the graph definitions of the metrics
+	GraphDefs() []*mackerel.GraphDefsParam
+}
+
+type Config struct {
+	// Interval is the interval of the samples while the environment is thawed
+	Interval time.Duration `env:"EXT_COLLECTOR_INTERVAL" envDefault:"1m"`
+}
+
+// Validate checks the interval
+func (c *Config) Validate() error {
+	if c.Interval < time.Second {
+		return fmt.Errorf("invalid EXT_COLLECTOR_INTERVAL: %s, must be 1s or longer", c.Interval)
+	}
+	return nil
+}
+
+// Default returns the collectors of the OS and the runtime process
+func Default() []Collector {
+	return []Collector{
+		&loadavgCollector{},
+		&cpuCollector{},
+		&memoryCollector{},
+		&networkCollector{},
+		&tmpCollector{},
+		&processCollector{},
+	}
+}
+
+// GraphDefs returns the graph definitions of the default collectors
+func GraphDefs() []*mackerel.GraphDefsParam {
+	defs := make([]*mackerel.GraphDefsParam, 0)
+	for _, c := range Default() {
+		defs = append(defs, c.GraphDefs()...)
+	}
+	return defs
+}
+
+func metric(name string, value float64, now time.Time) *mackerel.MetricValue {
+	return &mackerel.MetricValue{Name: name, Time: now.Unix(), Value: value}
+}
@@ -0,0 +1,24 @@
+package collector
+
+import (
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+func (c *cpuCollector) Name() string {
+	return "cpu"
+}
+
+func (c *cpuCollector) GraphDefs() []*mackerel.GraphDefsParam {
+	return []*mackerel.GraphDefsParam{
+		{
+			Name:        "custom.lambda.osstat.cpu",
+			DisplayName: "CPU",
+			Unit:        "percentage",
+			Metrics: []*mackerel.GraphDefsMetric{
+				{Name: "custom.lambda.osstat.cpu.user", DisplayName: "user", IsStacked: true},
+				{Name: "custom.lambda.osstat.cpu.system", DisplayName: "system", IsStacked: true},
+				{Name: "custom.lambda.osstat.cpu.steal", DisplayName: "steal", IsStacked: true},
+			},
+		},
+	}
+}
@@ -0,0 +1,41 @@
+package collector
+
+import (
+	"time"
+
+	"github.com/mackerelio/go-osstat/loadavg"
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+type loadavgCollector struct{}
+
+func (c *loadavgCollector) Name() string {
+	return "loadavg"
+}
+
+func (c *loadavgCollector) Collect(now time.Time) ([]*mackerel.MetricValue, error) {
+	loadavgStat, err := loadavg.Get()
+	if err != nil {
+		return nil, err
+	}
+	return []*mackerel.MetricValue{
+		metric("custom.lambda.osstat.loadavg.loadavg1", loadavgStat.Loadavg1, now),
+		metric("custom.lambda.osstat.loadavg.loadavg5", loadavgStat.Loadavg5, now),
+		metric("custom.lambda.osstat.loadavg.loadavg15", loadavgStat.Loadavg15, now),
+	}, nil
+}
+
+func (c *loadavgCollector) GraphDefs() []*mackerel.GraphDefsParam {
+	return []*mackerel.GraphDefsParam{
+		{
+			Name:        "custom.lambda.osstat.loadavg",
+			DisplayName: "loadavg",
+			Unit:        "float",
+			Metrics: []*mackerel.GraphDefsMetric{
+				{Name: "custom.lambda.osstat.loadavg.loadavg1", DisplayName: "loadavg1", IsStacked: false},
+				{Name: "custom.lambda.osstat.loadavg.loadavg5", DisplayName: "loadavg5", IsStacked: false},
+				{Name: "custom.lambda.osstat.loadavg.loadavg15", DisplayName: "loadavg15", IsStacked: false},
+			},
+		},
+	}
+}
@@ -0,0 +1,28 @@
+package collector
+
+import (
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+type memoryCollector struct{}
+
+func (c *memoryCollector) Name() string {
+	return "memory"
+}
+
+func (c *memoryCollector) GraphDefs() []*mackerel.GraphDefsParam {
+	return []*mackerel.GraphDefsParam{
+		{
+			Name:        "custom.lambda.osstat.memory",
+			DisplayName: "Memory",
+			Unit:        "bytes",
+			Metrics: []*mackerel.GraphDefsMetric{
+				{Name: "custom.lambda.osstat.memory.used", DisplayName: "used", IsStacked: true},
+				{Name: "custom.lambda.osstat.memory.buffers", DisplayName: "buffers", IsStacked: true},
+				{Name: "custom.lambda.osstat.memory.cached", DisplayName: "cached", IsStacked: true},
+				{Name: "custom.lambda.osstat.memory.free", DisplayName: "free", IsStacked: true},
+				{Name: "custom.lambda.osstat.memory.total", DisplayName: "total", IsStacked: false},
+			},
+		},
+	}
+}
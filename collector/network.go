@@ -0,0 +1,124 @@
+package collector
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/go-osstat/uptime"
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// networkStats is the sum of the counters of /proc/net/dev except the loopback
+type networkStats struct {
+	rxBytes, rxPackets, txBytes, txPackets uint64
+}
+
+// networkCollector reports the rates since the previous sample, or since the boot for the first one
+type networkCollector struct {
+	prev   *networkStats
+	prevAt time.Time
+}
+
+func (c *networkCollector) Name() string {
+	return "network"
+}
+
+func (c *networkCollector) Collect(now time.Time) ([]*mackerel.MetricValue, error) {
+	stats, err := readNetworkStats(filepath.Join(procDir, "net", "dev"))
+	if err != nil {
+		return nil, err
+	}
+	prev, prevAt := c.prev, c.prevAt
+	c.prev, c.prevAt = stats, now
+	if prev == nil {
+		up, err := uptime.Get()
+		if err != nil {
+			return nil, err
+		}
+		prev, prevAt = &networkStats{}, now.Add(-up)
+	}
+	elapsed := now.Sub(prevAt).Seconds()
+	if elapsed <= 0 {
+		return nil, nil
+	}
+
+	rate := func(current, previous uint64) float64 {
+		if current < previous {
+			// the counter has been reset
+			return 0
+		}
+		return float64(current-previous) / elapsed
+	}
+	return []*mackerel.MetricValue{
+		metric("custom.lambda.osstat.network.bytes.rx", rate(stats.rxBytes, prev.rxBytes), now),
+		metric("custom.lambda.osstat.network.bytes.tx", rate(stats.txBytes, prev.txBytes), now),
+		metric("custom.lambda.osstat.network.packets.rx", rate(stats.rxPackets, prev.rxPackets), now),
+		metric("custom.lambda.osstat.network.packets.tx", rate(stats.txPackets, prev.txPackets), now),
+	}, nil
+}
+
+func (c *networkCollector) GraphDefs() []*mackerel.GraphDefsParam {
+	return []*mackerel.GraphDefsParam{
+		{
+			Name:        "custom.lambda.osstat.network.bytes",
+			DisplayName: "Network Traffic",
+			Unit:        "bytes/sec",
+			Metrics: []*mackerel.GraphDefsMetric{
+				{Name: "custom.lambda.osstat.network.bytes.rx", DisplayName: "rx", IsStacked: false},
+				{Name: "custom.lambda.osstat.network.bytes.tx", DisplayName: "tx", IsStacked: false},
+			},
+		},
+		{
+			Name:        "custom.lambda.osstat.network.packets",
+			DisplayName: "Network Packets",
+			Unit:        "float",
+			Metrics: []*mackerel.GraphDefsMetric{
+				{Name: "custom.lambda.osstat.network.packets.rx", DisplayName: "rx", IsStacked: false},
+				{Name: "custom.lambda.osstat.network.packets.tx", DisplayName: "tx", IsStacked: false},
+			},
+		},
+	}
+}
+
+// readNetworkStats reads the bytes and the packets, which go-osstat doesn't provide
+func readNetworkStats(path string) (*networkStats, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stats := &networkStats{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		name, counters, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(name) == "lo" {
+			continue
+		}
+		fields := strings.Fields(counters)
+		if len(fields) < 16 {
+			continue
+		}
+		values := make([]uint64, 0, 4)
+		for _, i := range []int{0, 1, 8, 9} {
+			v, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s of %s", path, strings.TrimSpace(name))
+			}
+			values = append(values, v)
+		}
+		stats.rxBytes += values[0]
+		stats.rxPackets += values[1]
+		stats.txBytes += values[2]
+		stats.txPackets += values[3]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,78 @@
+package collector
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadNetworkStats(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		want    *networkStats
+		wantErr bool
+	}{
+		{
+			name: "sum except the loopback",
+			want: &networkStats{rxBytes: 120000, rxPackets: 230, txBytes: 60000, txPackets: 110},
+		},
+		{
+			name:    "only the headers",
+			content: "Inter-|   Receive\n face |bytes    packets\n",
+			want:    &networkStats{},
+		},
+		{
+			name:    "invalid counter",
+			content: "  eth0:  x 200 0 0 0 0 0 0 50000 100 0 0 0 0 0 0\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join("testdata", "proc", "net", "dev")
+			if tt.content != "" {
+				path = filepath.Join(dir, "dev")
+				if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stats, err := readNetworkStats(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(stats, tt.want) {
+				t.Errorf("stats = %+v, want %+v", stats, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetworkCollectorReportsRates(t *testing.T) {
+	useProcDir(t, filepath.Join("testdata", "proc"))
+	now := time.Unix(1700000060, 0)
+	c := &networkCollector{
+		prev:   &networkStats{rxBytes: 60000, rxPackets: 230, txBytes: 70000, txPackets: 50},
+		prevAt: now.Add(-time.Minute),
+	}
+	metrics, err := c.Collect(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{
+		"custom.lambda.osstat.network.bytes.rx":   1000,
+		"custom.lambda.osstat.network.bytes.tx":   0, // the counter has been reset
+		"custom.lambda.osstat.network.packets.rx": 0,
+		"custom.lambda.osstat.network.packets.tx": 1,
+	}
+	got := make(map[string]float64, len(metrics))
+	for _, m := range metrics {
+		got[m.Name] = m.Value.(float64)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("metrics = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,286 @@
+package collector
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/go-osstat/uptime"
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// procDir is the mount point of procfs
+var procDir = "/proc"
+
+const (
+	// clockTicks is USER_HZ, the unit of the CPU times in /proc, which is 100 on Linux
+	clockTicks = 100
+)
+
+// findRuntimeProcess returns the PID of the runtime process.
+// The runtime and the extensions are started by the init of the environment, which is the parent of the agent.
+// The other extensions are told apart by their paths under /opt/extensions.
+func findRuntimeProcess() (int, error) {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return 0, err
+	}
+	self, parent := os.Getpid(), os.Getppid()
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == self || pid == parent {
+			continue
+		}
+		stat, err := readProcStat(pid)
+		if err != nil || stat.ppid != parent {
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join(procDir, entry.Name(), "cmdline"))
+		if err != nil || bytes.Contains(cmdline, []byte("/opt/extensions/")) {
+			continue
+		}
+		return pid, nil
+	}
+	return 0, errors.New("the runtime process is not found")
+}
+
+// procStat is the fields of /proc/<pid>/stat used by the agent. The times are in clock ticks.
+type procStat struct {
+	ppid      int
+	utime     uint64
+	stime     uint64
+	starttime uint64
+}
+
+func readProcStat(pid int) (*procStat, error) {
+	content, err := os.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return nil, err
+	}
+	// the command name in parentheses may contain spaces.
+	// fields[0] is the 3rd field of proc(5), the state.
+	i := bytes.LastIndexByte(content, ')')
+	if i < 0 {
+		return nil, errors.New("unexpected format of stat")
+	}
+	fields := strings.Fields(string(content[i+1:]))
+	if len(fields) < 20 {
+		return nil, errors.New("unexpected format of stat")
+	}
+	stat := &procStat{}
+	if stat.ppid, err = strconv.Atoi(fields[1]); err != nil {
+		return nil, err
+	}
+	for _, f := range []struct {
+		index int
+		value *uint64
+	}{{11, &stat.utime}, {12, &stat.stime}, {19, &stat.starttime}} {
+		if *f.value, err = strconv.ParseUint(fields[f.index], 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return stat, nil
+}
+
+// readProcFields reads a file of "name: value" lines like /proc/<pid>/status and /proc/<pid>/io
+func readProcFields(pid int, name string) (map[string]string, error) {
+	content, err := os.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), name))
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string)
+	for _, line := range strings.Split(string(content), "\n") {
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			fields[k] = strings.TrimSpace(v)
+		}
+	}
+	return fields, nil
+}
+
+// parseProcUint parses a value like "42" or "1024 kB" into bytes for kB
+func parseProcUint(value string) (uint64, error) {
+	number, unit, _ := strings.Cut(value, " ")
+	n, err := strconv.ParseUint(number, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if unit == "kB" {
+		n *= 1024
+	}
+	return n, nil
+}
+
+// countOpenFiles returns the number of the file descriptors of the process
+func countOpenFiles(pid int) (int, error) {
+	entries, err := os.ReadDir(filepath.Join(procDir, strconv.Itoa(pid), "fd"))
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// processSample is the counters of the process at a time
+type processSample struct {
+	at                    time.Time
+	cpuUser, cpuSystem    float64
+	voluntarySwitches     uint64
+	involuntarySwitches   uint64
+	readBytes, writeBytes uint64
+}
+
+// processCollector samples the runtime process. The counters are reported as the rates since the previous sample,
+// or since the start of the process for the first one.
+type processCollector struct {
+	pid  int
+	prev *processSample
+}
+
+func (p *processCollector) Name() string {
+	return "process"
+}
+
+// Collect reports the stats of the runtime process.
+// The process is looked up again when it has gone, e.g. the runtime has been restarted after an error.
+func (p *processCollector) Collect(now time.Time) ([]*mackerel.MetricValue, error) {
+	if p.pid == 0 || !processExists(p.pid) {
+		pid, err := findRuntimeProcess()
+		if err != nil {
+			Logger.Info("Can't get the stats of the runtime process:", err)
+			return nil, nil
+		}
+		p.pid, p.prev = pid, nil
+	}
+
+	stat, err := readProcStat(p.pid)
+	if err != nil {
+		return nil, err
+	}
+	status, err := readProcFields(p.pid, "status")
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := make([]*mackerel.MetricValue, 0)
+	gauge := func(name string, value float64) {
+		metrics = append(metrics, metric(name, value, now))
+	}
+	if fds, err := countOpenFiles(p.pid); err != nil {
+		Logger.Warning("Failed to count the file descriptors of the runtime process:", err)
+	} else {
+		gauge("custom.lambda.process.fds.open", float64(fds))
+	}
+	if threads, err := parseProcUint(status["Threads"]); err == nil {
+		gauge("custom.lambda.process.threads.count", float64(threads))
+	}
+	if rss, err := parseProcUint(status["VmRSS"]); err == nil {
+		gauge("custom.lambda.process.memory.rss", float64(rss))
+	}
+
+	current := &processSample{
+		at:        now,
+		cpuUser:   float64(stat.utime) / clockTicks,
+		cpuSystem: float64(stat.stime) / clockTicks,
+	}
+	current.voluntarySwitches, _ = parseProcUint(status["voluntary_ctxt_switches"])
+	current.involuntarySwitches, _ = parseProcUint(status["nonvoluntary_ctxt_switches"])
+	// rchar and wchar count all the reads and writes including the sockets, unlike read_bytes and write_bytes of the block devices
+	if io, err := readProcFields(p.pid, "io"); err != nil {
+		Logger.Info("Can't get the I/O of the runtime process:", err)
+	} else {
+		current.readBytes, _ = parseProcUint(io["rchar"])
+		current.writeBytes, _ = parseProcUint(io["wchar"])
+	}
+
+	prev := p.prev
+	p.prev = current
+	if prev == nil {
+		up, err := uptime.Get()
+		if err != nil {
+			Logger.Warning("Failed to get uptime:", err)
+			return metrics, nil
+		}
+		prev = &processSample{at: now.Add(-up).Add(time.Duration(stat.starttime) * time.Second / clockTicks)}
+	}
+	elapsed := now.Sub(prev.at).Seconds()
+	if elapsed <= 0 {
+		return metrics, nil
+	}
+	rate := func(current, previous float64) float64 {
+		if current < previous {
+			return 0
+		}
+		return (current - previous) / elapsed
+	}
+	gauge("custom.lambda.process.cpu.user", rate(current.cpuUser, prev.cpuUser)*100)
+	gauge("custom.lambda.process.cpu.system", rate(current.cpuSystem, prev.cpuSystem)*100)
+	gauge("custom.lambda.process.contextSwitches.voluntary", rate(float64(current.voluntarySwitches), float64(prev.voluntarySwitches)))
+	gauge("custom.lambda.process.contextSwitches.involuntary", rate(float64(current.involuntarySwitches), float64(prev.involuntarySwitches)))
+	gauge("custom.lambda.process.io.read", rate(float64(current.readBytes), float64(prev.readBytes)))
+	gauge("custom.lambda.process.io.write", rate(float64(current.writeBytes), float64(prev.writeBytes)))
+	return metrics, nil
+}
+
+func (p *processCollector) GraphDefs() []*mackerel.GraphDefsParam {
+	return []*mackerel.GraphDefsParam{
+		{
+			Name:        "custom.lambda.process.fds",
+			DisplayName: "Runtime File Descriptors",
+			Unit:        "integer",
+			Metrics: []*mackerel.GraphDefsMetric{
+				{Name: "custom.lambda.process.fds.open", DisplayName: "open", IsStacked: false},
+			},
+		},
+		{
+			Name:        "custom.lambda.process.threads",
+			DisplayName: "Runtime Threads",
+			Unit:        "integer",
+			Metrics: []*mackerel.GraphDefsMetric{
+				{Name: "custom.lambda.process.threads.count", DisplayName: "count", IsStacked: false},
+			},
+		},
+		{
+			Name:        "custom.lambda.process.memory",
+			DisplayName: "Runtime Memory",
+			Unit:        "bytes",
+			Metrics: []*mackerel.GraphDefsMetric{
+				{Name: "custom.lambda.process.memory.rss", DisplayName: "rss", IsStacked: false},
+			},
+		},
+		{
+			Name:        "custom.lambda.process.cpu",
+			DisplayName: "Runtime CPU",
+			Unit:        "percentage",
+			Metrics: []*mackerel.GraphDefsMetric{
+				{Name: "custom.lambda.process.cpu.user", DisplayName: "user", IsStacked: true},
+				{Name: "custom.lambda.process.cpu.system", DisplayName: "system", IsStacked: true},
+			},
+		},
+		{
+			Name:        "custom.lambda.process.contextSwitches",
+			DisplayName: "Runtime Context Switches",
+			Unit:        "float",
+			Metrics: []*mackerel.GraphDefsMetric{
+				{Name: "custom.lambda.process.contextSwitches.voluntary", DisplayName: "voluntary", IsStacked: true},
+				{Name: "custom.lambda.process.contextSwitches.involuntary", DisplayName: "involuntary", IsStacked: true},
+			},
+		},
+		{
+			Name:        "custom.lambda.process.io",
+			DisplayName: "Runtime I/O",
+			Unit:        "bytes/sec",
+			Metrics: []*mackerel.GraphDefsMetric{
+				{Name: "custom.lambda.process.io.read", DisplayName: "read", IsStacked: false},
+				{Name: "custom.lambda.process.io.write", DisplayName: "write", IsStacked: false},
+			},
+		},
+	}
+}
+
+func processExists(pid int) bool {
+	_, err := os.Stat(filepath.Join(procDir, strconv.Itoa(pid)))
+	return err == nil
+}
@@ -0,0 +1,237 @@
+package collector
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	Logger = logrus.NewEntry(logrus.New())
+	Logger.Logger.SetOutput(io.Discard)
+}
+
+// useProcDir makes the collectors read the procfs at dir
+func useProcDir(t *testing.T, dir string) {
+	original := procDir
+	procDir = dir
+	t.Cleanup(func() { procDir = original })
+}
+
+// writeProcess writes the stat and the cmdline of a process to the procfs at dir
+func writeProcess(t *testing.T, dir string, pid int, ppid int, cmdline string) {
+	t.Helper()
+	processDir := filepath.Join(dir, strconv.Itoa(pid))
+	if err := os.MkdirAll(processDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	stat := fmt.Sprintf("%d (process) S %d 1 1 0 -1 4194560 2000 0 0 0 250 75 0 0 20 0 8 0 1500 1073741824\n", pid, ppid)
+	if err := os.WriteFile(filepath.Join(processDir, "stat"), []byte(stat), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(processDir, "cmdline"), []byte(cmdline), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadProcStat(t *testing.T) {
+	useProcDir(t, filepath.Join("testdata", "proc"))
+	tests := []struct {
+		name    string
+		pid     int
+		want    *procStat
+		wantErr bool
+	}{
+		{"command name with spaces", 1234, &procStat{ppid: 7, utime: 250, stime: 75, starttime: 1500}, false},
+		{"without the end of the command name", 99, nil, true},
+		{"short", 98, nil, true},
+		{"invalid utime", 97, nil, true},
+		{"not found", 1, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stat, err := readProcStat(tt.pid)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(stat, tt.want) {
+				t.Errorf("stat = %+v, want %+v", stat, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadProcFields(t *testing.T) {
+	useProcDir(t, filepath.Join("testdata", "proc"))
+	tests := []struct {
+		file  string
+		field string
+		want  uint64
+	}{
+		{"status", "Threads", 8},
+		{"status", "VmRSS", 81920 * 1024},
+		{"status", "voluntary_ctxt_switches", 1500},
+		{"status", "nonvoluntary_ctxt_switches", 42},
+		{"io", "rchar", 1048576},
+		{"io", "wchar", 524288},
+	}
+	for _, tt := range tests {
+		fields, err := readProcFields(1234, tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parseProcUint(fields[tt.field])
+		if err != nil || got != tt.want {
+			t.Errorf("%s of %s = %d, %v, want %d", tt.field, tt.file, got, err, tt.want)
+		}
+	}
+	if _, err := readProcFields(1, "status"); err == nil {
+		t.Error("err = nil, want an error for a process not found")
+	}
+}
+
+func TestParseProcUint(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    uint64
+		wantErr bool
+	}{
+		{"42", 42, false},
+		{"1024 kB", 1024 * 1024, false},
+		{"", 0, true},
+		{"S (sleeping)", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseProcUint(tt.value)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseProcUint(%q) = %d, %v, want %d", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestCountOpenFiles(t *testing.T) {
+	useProcDir(t, filepath.Join("testdata", "proc"))
+	if n, err := countOpenFiles(1234); err != nil || n != 5 {
+		t.Errorf("countOpenFiles = %d, %v, want 5", n, err)
+	}
+	if _, err := countOpenFiles(1); err == nil {
+		t.Error("err = nil, want an error for a process not found")
+	}
+}
+
+func TestFindRuntimeProcess(t *testing.T) {
+	dir := t.TempDir()
+	useProcDir(t, dir)
+	parent := os.Getppid()
+	if err := os.MkdirAll(filepath.Join(dir, "net"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeProcess(t, dir, os.Getpid(), parent, "/opt/agent\x00")
+	writeProcess(t, dir, 100, parent, "/opt/extensions/other-extension\x00")
+	writeProcess(t, dir, 200, 1, "/usr/sbin/unrelated\x00")
+
+	if _, err := findRuntimeProcess(); err == nil {
+		t.Error("err = nil, want an error without the runtime process")
+	}
+
+	writeProcess(t, dir, 300, parent, "/var/runtime/bootstrap\x00")
+	if pid, err := findRuntimeProcess(); err != nil || pid != 300 {
+		t.Errorf("findRuntimeProcess = %d, %v, want 300", pid, err)
+	}
+}
+
+func metricValues(t *testing.T, c Collector, now time.Time) map[string]float64 {
+	t.Helper()
+	metrics, err := c.Collect(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64, len(metrics))
+	for _, m := range metrics {
+		values[m.Name] = m.Value.(float64)
+	}
+	return values
+}
+
+func TestProcessCollectorReportsRatesSincePreviousSample(t *testing.T) {
+	useProcDir(t, filepath.Join("testdata", "proc"))
+	now := time.Unix(1700000010, 0)
+	p := &processCollector{
+		pid: 1234,
+		prev: &processSample{
+			at:                  now.Add(-10 * time.Second),
+			cpuUser:             1.5,
+			cpuSystem:           0.25,
+			voluntarySwitches:   1000,
+			involuntarySwitches: 42,
+			readBytes:           524288,
+			writeBytes:          1048576,
+		},
+	}
+
+	got := metricValues(t, p, now)
+	want := map[string]float64{
+		"custom.lambda.process.fds.open":                    5,
+		"custom.lambda.process.threads.count":               8,
+		"custom.lambda.process.memory.rss":                  81920 * 1024,
+		"custom.lambda.process.cpu.user":                    10,
+		"custom.lambda.process.cpu.system":                  5,
+		"custom.lambda.process.contextSwitches.voluntary":   50,
+		"custom.lambda.process.contextSwitches.involuntary": 0,
+		"custom.lambda.process.io.read":                     52428.8,
+		// the counter has decreased
+		"custom.lambda.process.io.write": 0,
+	}
+	if len(got) != len(want) {
+		t.Errorf("metrics = %v, want %v", got, want)
+	}
+	for name, v := range want {
+		if math.Abs(got[name]-v) > 1e-9 {
+			t.Errorf("%s = %v, want %v", name, got[name], v)
+		}
+	}
+	if p.prev.at != now || p.prev.cpuUser != 2.5 || p.prev.readBytes != 1048576 {
+		t.Errorf("prev = %+v, want the current sample", p.prev)
+	}
+}
+
+func TestProcessCollectorFindsRestartedRuntime(t *testing.T) {
+	dir := t.TempDir()
+	useProcDir(t, dir)
+	now := time.Now()
+	p := &processCollector{pid: 300, prev: &processSample{at: now.Add(-time.Minute), cpuUser: 100}}
+
+	// the runtime has gone and no other one has started yet
+	if metrics, err := p.Collect(now); err != nil || len(metrics) != 0 {
+		t.Errorf("Collect = %v, %v, want nothing without the runtime process", metrics, err)
+	}
+
+	writeProcess(t, dir, 400, os.Getppid(), "/var/runtime/bootstrap\x00")
+	status := "Threads:\t2\nVmRSS:\t1024 kB\nvoluntary_ctxt_switches:\t10\nnonvoluntary_ctxt_switches:\t1\n"
+	if err := os.WriteFile(filepath.Join(dir, "400", "status"), []byte(status), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got := metricValues(t, p, now)
+	if p.pid != 400 {
+		t.Fatalf("pid = %d, want the restarted runtime 400", p.pid)
+	}
+	// the file descriptors and the I/O aren't available
+	if _, ok := got["custom.lambda.process.fds.open"]; ok {
+		t.Errorf("metrics = %v, want no file descriptors", got)
+	}
+	if got["custom.lambda.process.threads.count"] != 2 || got["custom.lambda.process.memory.rss"] != 1024*1024 {
+		t.Errorf("metrics = %v", got)
+	}
+	// the sample of the old process is dropped
+	if !p.prev.at.Equal(now) || p.prev.cpuUser != 2.5 || p.prev.readBytes != 0 {
+		t.Errorf("prev = %+v, want the sample of the new process", p.prev)
+	}
+}
@@ -0,0 +1,83 @@
+package collector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// Sampler runs the collectors on the interval and keeps the metrics until they are drained
+type Sampler struct {
+	collectors []Collector
+	interval   time.Duration
+	mu         sync.Mutex
+	sampledAt  time.Time
+	metrics    []*mackerel.MetricValue
+}
+
+func NewSampler(collectors []Collector, interval time.Duration) *Sampler {
+	return &Sampler{
+		collectors: collectors,
+		interval:   interval,
+		metrics:    make([]*mackerel.MetricValue, 0),
+	}
+}
+
+// Run samples on the interval until ctx is done. The ticker doesn't run while the environment is frozen,
+// so call SampleIfDue on every invocation too.
+func (s *Sampler) Run(ctx context.Context) {
+	s.SampleIfDue(time.Now())
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.SampleIfDue(now)
+		}
+	}
+}
+
+// SampleIfDue samples if the interval has passed since the previous sample.
+// The interval is measured by the wall clock, which keeps running while the environment is frozen unlike the monotonic one.
+func (s *Sampler) SampleIfDue(now time.Time) {
+	now = now.Round(0)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// a tick may come slightly earlier than the interval after the previous sample
+	if !s.sampledAt.IsZero() && now.Sub(s.sampledAt) < s.interval-s.interval/10 {
+		return
+	}
+	s.sample(now)
+}
+
+// Sample runs all the collectors now
+func (s *Sampler) Sample(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sample(now.Round(0))
+}
+
+func (s *Sampler) sample(now time.Time) {
+	s.sampledAt = now
+	for _, c := range s.collectors {
+		metrics, err := c.Collect(now)
+		if err != nil {
+			Logger.Warning("Failed to collect", c.Name(), ":", err)
+			continue
+		}
+		s.metrics = append(s.metrics, metrics...)
+	}
+}
+
+// Drain returns the metrics sampled since the previous drain
+func (s *Sampler) Drain() []*mackerel.MetricValue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metrics := s.metrics
+	s.metrics = make([]*mackerel.MetricValue, 0)
+	return metrics
+}
@@ -0,0 +1,164 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// fakeCollector records the times it is called at and reports a metric of the count of the calls
+type fakeCollector struct {
+	name string
+	err  error
+	mu   sync.Mutex
+	at   []time.Time
+}
+
+func (c *fakeCollector) Name() string {
+	return c.name
+}
+
+func (c *fakeCollector) Collect(now time.Time) ([]*mackerel.MetricValue, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.at = append(c.at, now)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return []*mackerel.MetricValue{metric("custom.lambda."+c.name, float64(len(c.at)), now)}, nil
+}
+
+func (c *fakeCollector) GraphDefs() []*mackerel.GraphDefsParam {
+	return nil
+}
+
+func (c *fakeCollector) calls() []time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Time{}, c.at...)
+}
+
+func metricNames(metrics []*mackerel.MetricValue) string {
+	names := make([]string, 0, len(metrics))
+	for _, m := range metrics {
+		names = append(names, m.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestSamplerSampleAndDrain(t *testing.T) {
+	a, failing, b := &fakeCollector{name: "a"}, &fakeCollector{name: "failing", err: errors.New("unavailable")}, &fakeCollector{name: "b"}
+	s := NewSampler([]Collector{a, failing, b}, time.Minute)
+	now := time.Unix(1700000000, 0)
+
+	s.Sample(now)
+	s.Sample(now.Add(time.Second))
+	metrics := s.Drain()
+	// a failing collector doesn't stop the others
+	if got, want := metricNames(metrics), "custom.lambda.a,custom.lambda.b,custom.lambda.a,custom.lambda.b"; got != want {
+		t.Errorf("metrics = %s, want %s", got, want)
+	}
+	if len(failing.calls()) != 2 {
+		t.Errorf("calls of the failing collector = %d, want 2", len(failing.calls()))
+	}
+	if metrics[2].Time != now.Unix()+1 {
+		t.Errorf("time = %d, want %d", metrics[2].Time, now.Unix()+1)
+	}
+
+	if metrics := s.Drain(); len(metrics) != 0 {
+		t.Errorf("metrics = %s, want none after the drain", metricNames(metrics))
+	}
+}
+
+func TestSamplerSampleIfDue(t *testing.T) {
+	c := &fakeCollector{name: "a"}
+	s := NewSampler([]Collector{c}, time.Minute)
+	start := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name    string
+		after   time.Duration
+		sampled bool
+	}{
+		{"first", 0, true},
+		{"within the interval", 30 * time.Second, false},
+		// a tick may come slightly earlier
+		{"tick slightly early", 55 * time.Second, true},
+		{"too early after the previous sample", 80 * time.Second, false},
+		// the wall clock has run while the environment was frozen
+		{"after thawed", 10 * time.Minute, true},
+	}
+	for _, tt := range tests {
+		before := len(c.calls())
+		s.SampleIfDue(start.Add(tt.after))
+		if sampled := len(c.calls()) > before; sampled != tt.sampled {
+			t.Errorf("%s: sampled = %v, want %v", tt.name, sampled, tt.sampled)
+		}
+	}
+}
+
+func TestSamplerSampleIfDueStripsMonotonicClock(t *testing.T) {
+	c := &fakeCollector{name: "a"}
+	s := NewSampler([]Collector{c}, time.Minute)
+	s.SampleIfDue(time.Now())
+	if at := c.calls()[0]; at != at.Round(0) {
+		t.Errorf("sampled at %s, want the wall clock only", at)
+	}
+}
+
+func TestSamplerRun(t *testing.T) {
+	c := &fakeCollector{name: "a"}
+	s := NewSampler([]Collector{c}, 10*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(c.calls()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("calls = %d, want samples on the ticks", len(c.calls()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run doesn't return after ctx is done")
+	}
+
+	calls := len(c.calls())
+	time.Sleep(30 * time.Millisecond)
+	if n := len(c.calls()); n != calls {
+		t.Errorf("calls = %d after Run returned, want %d", n, calls)
+	}
+	if n := len(s.Drain()); n != calls {
+		t.Errorf("metrics = %d, want %d", n, calls)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		wantErr  bool
+	}{
+		{time.Minute, false},
+		{time.Second, false},
+		{500 * time.Millisecond, true},
+		{0, true},
+	}
+	for _, tt := range tests {
+		err := (&Config{Interval: tt.interval}).Validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Validate(%s) = %v, want error %v", tt.interval, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+//go:build linux
+
+package collector
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/mackerelio/go-osstat/cpu"
+	"github.com/mackerelio/go-osstat/memory"
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// cpuCollector reports the CPU usage since the previous sample. The zero value reports the first one since the boot.
+type cpuCollector struct {
+	prev cpu.Stats
+}
+
+func (c *cpuCollector) Collect(now time.Time) ([]*mackerel.MetricValue, error) {
+	stats, err := cpu.Get()
+	if err != nil {
+		return nil, err
+	}
+	prev := c.prev
+	c.prev = *stats
+	if stats.Total <= prev.Total {
+		return nil, nil
+	}
+
+	total := float64(stats.Total - prev.Total)
+	percentage := func(current, previous uint64) float64 {
+		if current < previous {
+			return 0
+		}
+		return float64(current-previous) / total * 100
+	}
+	return []*mackerel.MetricValue{
+		metric("custom.lambda.osstat.cpu.user", percentage(stats.User+stats.Nice, prev.User+prev.Nice), now),
+		metric("custom.lambda.osstat.cpu.system", percentage(stats.System, prev.System), now),
+		metric("custom.lambda.osstat.cpu.steal", percentage(stats.Steal, prev.Steal), now),
+	}, nil
+}
+
+func (c *memoryCollector) Collect(now time.Time) ([]*mackerel.MetricValue, error) {
+	stats, err := memory.Get()
+	if err != nil {
+		return nil, err
+	}
+	return []*mackerel.MetricValue{
+		metric("custom.lambda.osstat.memory.used", float64(stats.Used), now),
+		metric("custom.lambda.osstat.memory.buffers", float64(stats.Buffers), now),
+		metric("custom.lambda.osstat.memory.cached", float64(stats.Cached), now),
+		metric("custom.lambda.osstat.memory.free", float64(stats.Free), now),
+		metric("custom.lambda.osstat.memory.total", float64(stats.Total), now),
+	}, nil
+}
+
+// statfs is replaced in the tests
+var statfs = syscall.Statfs
+
+// GetDiskUsage returns the usage of the filesystem of path
+func GetDiskUsage(path string) (*DiskUsage, error) {
+	var stat syscall.Statfs_t
+	if err := statfs(path, &stat); err != nil {
+		return nil, err
+	}
+	blockSize := uint64(stat.Bsize)
+	return &DiskUsage{
+		Used:       (stat.Blocks - stat.Bfree) * blockSize,
+		Available:  stat.Bavail * blockSize,
+		InodesUsed: stat.Files - stat.Ffree,
+		InodesFree: stat.Ffree,
+	}, nil
+}
@@ -0,0 +1,74 @@
+//go:build linux
+
+package collector
+
+import (
+	"errors"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// useStatfs makes GetDiskUsage see stat for any path
+func useStatfs(t *testing.T, stat syscall.Statfs_t, err error) {
+	original := statfs
+	statfs = func(path string, buf *syscall.Statfs_t) error {
+		*buf = stat
+		return err
+	}
+	t.Cleanup(func() { statfs = original })
+}
+
+func TestGetDiskUsage(t *testing.T) {
+	// 512 MB of 4 KB blocks, 16 of which are reserved for root
+	useStatfs(t, syscall.Statfs_t{Bsize: 4096, Blocks: 131072, Bfree: 98320, Bavail: 98304, Files: 32768, Ffree: 32000}, nil)
+
+	usage, err := GetDiskUsage(TmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &DiskUsage{Used: 32752 * 4096, Available: 98304 * 4096, InodesUsed: 768, InodesFree: 32000}
+	if !reflect.DeepEqual(usage, want) {
+		t.Errorf("usage = %+v, want %+v", usage, want)
+	}
+	// the reserved blocks are excluded as df does
+	if got := usage.Utilization(); got != float64(32752)/float64(32752+98304)*100 {
+		t.Errorf("Utilization = %v", got)
+	}
+}
+
+func TestGetDiskUsageError(t *testing.T) {
+	useStatfs(t, syscall.Statfs_t{}, errors.New("no such file or directory"))
+	if _, err := GetDiskUsage(TmpDir); err == nil {
+		t.Error("err = nil, want the error of statfs")
+	}
+}
+
+func TestTmpCollector(t *testing.T) {
+	useStatfs(t, syscall.Statfs_t{Bsize: 1024, Blocks: 1000, Bfree: 600, Bavail: 600, Files: 200, Ffree: 150}, nil)
+	now := time.Unix(1700000000, 0)
+
+	metrics, err := (&tmpCollector{}).Collect(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{
+		"custom.lambda.osstat.tmp.bytes.used":         400 * 1024,
+		"custom.lambda.osstat.tmp.bytes.available":    600 * 1024,
+		"custom.lambda.osstat.tmp.inodes.used":        50,
+		"custom.lambda.osstat.tmp.inodes.free":        150,
+		"custom.lambda.osstat.tmp.utilization.bytes":  40,
+		"custom.lambda.osstat.tmp.utilization.inodes": 25,
+	}
+	got := make(map[string]float64, len(metrics))
+	for _, m := range metrics {
+		if m.Time != now.Unix() {
+			t.Errorf("%s at %d, want %d", m.Name, m.Time, now.Unix())
+		}
+		got[m.Name] = m.Value.(float64)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("metrics = %v, want %v", got, want)
+	}
+}
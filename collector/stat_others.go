@@ -0,0 +1,26 @@
+//go:build !linux
+
+package collector
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// cpuCollector reports nothing out of Lambda, where the stats of go-osstat differ
+type cpuCollector struct{}
+
+func (c *cpuCollector) Collect(now time.Time) ([]*mackerel.MetricValue, error) {
+	return nil, nil
+}
+
+func (c *memoryCollector) Collect(now time.Time) ([]*mackerel.MetricValue, error) {
+	return nil, nil
+}
+
+// GetDiskUsage returns the usage of the filesystem of path
+func GetDiskUsage(path string) (*DiskUsage, error) {
+	return nil, errors.New("statfs is not supported")
+}
@@ -0,0 +1,85 @@
+package collector
+
+import (
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// TmpDir is the ephemeral storage of the runtime environment
+const TmpDir = "/tmp"
+
+// DiskUsage is the usage of a filesystem by statfs
+type DiskUsage struct {
+	Used, Available        uint64
+	InodesUsed, InodesFree uint64
+}
+
+// Utilization returns the percentage of the used space to the space available to the function as df does,
+// which excludes the blocks reserved for root
+func (u *DiskUsage) Utilization() float64 {
+	if u.Used+u.Available == 0 {
+		return 0
+	}
+	return float64(u.Used) / float64(u.Used+u.Available) * 100
+}
+
+func (u *DiskUsage) InodesUtilization() float64 {
+	if u.InodesUsed+u.InodesFree == 0 {
+		return 0
+	}
+	return float64(u.InodesUsed) / float64(u.InodesUsed+u.InodesFree) * 100
+}
+
+type tmpCollector struct{}
+
+func (c *tmpCollector) Name() string {
+	return "tmp"
+}
+
+func (c *tmpCollector) Collect(now time.Time) ([]*mackerel.MetricValue, error) {
+	usage, err := GetDiskUsage(TmpDir)
+	if err != nil {
+		return nil, err
+	}
+	return []*mackerel.MetricValue{
+		metric("custom.lambda.osstat.tmp.bytes.used", float64(usage.Used), now),
+		metric("custom.lambda.osstat.tmp.bytes.available", float64(usage.Available), now),
+		metric("custom.lambda.osstat.tmp.inodes.used", float64(usage.InodesUsed), now),
+		metric("custom.lambda.osstat.tmp.inodes.free", float64(usage.InodesFree), now),
+		metric("custom.lambda.osstat.tmp.utilization.bytes", usage.Utilization(), now),
+		metric("custom.lambda.osstat.tmp.utilization.inodes", usage.InodesUtilization(), now),
+	}, nil
+}
+
+func (c *tmpCollector) GraphDefs() []*mackerel.GraphDefsParam {
+	return []*mackerel.GraphDefsParam{
+		{
+			Name:        "custom.lambda.osstat.tmp.bytes",
+			DisplayName: "Ephemeral Storage",
+			Unit:        "bytes",
+			Metrics: []*mackerel.GraphDefsMetric{
+				{Name: "custom.lambda.osstat.tmp.bytes.used", DisplayName: "used", IsStacked: true},
+				{Name: "custom.lambda.osstat.tmp.bytes.available", DisplayName: "available", IsStacked: true},
+			},
+		},
+		{
+			Name:        "custom.lambda.osstat.tmp.inodes",
+			DisplayName: "Ephemeral Storage Inodes",
+			Unit:        "integer",
+			Metrics: []*mackerel.GraphDefsMetric{
+				{Name: "custom.lambda.osstat.tmp.inodes.used", DisplayName: "used", IsStacked: true},
+				{Name: "custom.lambda.osstat.tmp.inodes.free", DisplayName: "free", IsStacked: true},
+			},
+		},
+		{
+			Name:        "custom.lambda.osstat.tmp.utilization",
+			DisplayName: "Ephemeral Storage Utilization",
+			Unit:        "percentage",
+			Metrics: []*mackerel.GraphDefsMetric{
+				{Name: "custom.lambda.osstat.tmp.utilization.bytes", DisplayName: "bytes", IsStacked: false},
+				{Name: "custom.lambda.osstat.tmp.utilization.inodes", DisplayName: "inodes", IsStacked: false},
+			},
+		},
+	}
+}
@@ -0,0 +1,26 @@
+package collector
+
+import (
+	"testing"
+)
+
+func TestDiskUsageUtilization(t *testing.T) {
+	tests := []struct {
+		name   string
+		usage  DiskUsage
+		bytes  float64
+		inodes float64
+	}{
+		{"empty", DiskUsage{}, 0, 0},
+		{"partially used", DiskUsage{Used: 250, Available: 750, InodesUsed: 10, InodesFree: 90}, 25, 10},
+		{"full", DiskUsage{Used: 1000, InodesUsed: 100}, 100, 100},
+	}
+	for _, tt := range tests {
+		if got := tt.usage.Utilization(); got != tt.bytes {
+			t.Errorf("%s: Utilization = %v, want %v", tt.name, got, tt.bytes)
+		}
+		if got := tt.usage.InodesUtilization(); got != tt.inodes {
+			t.Errorf("%s: InodesUtilization = %v, want %v", tt.name, got, tt.inodes)
+		}
+	}
+}
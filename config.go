@@ -1,22 +1,37 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/aws/aws-sdk-go/service/ssm"
-	"github.com/caarlos0/env/v6"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/collector"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/dispatcher"
 	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/host/mackerel"
 	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/lambda"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/lambda/telemetry"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink/logs"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink/otlp"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink/prometheus"
 )
 
 type Config struct {
-	MackerelConfig  mackerel.MackerelConfig
-	AWSLambdaConfig lambda.AWSLambdaConfig
+	MackerelConfig   mackerel.MackerelConfig
+	AWSLambdaConfig  lambda.AWSLambdaConfig
+	AWSConfig        lambda.AWSConfig
+	CheckConfig      dispatcher.CheckConfig
+	OTLPConfig       otlp.OTLPConfig
+	PrometheusConfig prometheus.PrometheusConfig
+	LogsConfig       logs.LogsConfig
+	CaptureConfig    telemetry.CaptureConfig
+	CollectorConfig  collector.Config
 }
 
 func GetConfig() (*Config, error) {
@@ -25,16 +40,16 @@ func GetConfig() (*Config, error) {
 		return nil, err
 	}
 
-	if conf.MackerelConfig.ApiKey != "" && conf.MackerelConfig.ApiKeySSMParamName != "" {
-		return nil, errors.New("either EXT_MACKEREL_API_KEY or EXT_MACKEREL_API_KEY_SSM can be specified")
+	if err := validateSections(conf); err != nil {
+		return nil, err
 	}
 
-	if conf.MackerelConfig.ApiKeySSMParamName != "" {
-		apiKey, err := fetchMackerelApiKeyFromSSM(conf.AWSLambdaConfig.Region, conf.MackerelConfig.ApiKeySSMParamName)
-		if err != nil {
-			return nil, err
-		}
-		conf.MackerelConfig.ApiKey = apiKey
+	if err := mackerel.UseAPIBase(conf.MackerelConfig.ApiBase); err != nil {
+		return nil, err
+	}
+
+	if err := resolveMackerelApiKey(&conf.MackerelConfig, &conf.AWSConfig); err != nil {
+		return nil, err
 	}
 
 	environmentID, err := getEnvironmentID()
@@ -45,21 +60,160 @@ func GetConfig() (*Config, error) {
 
 	conf.AWSLambdaConfig.ExtensionName = getExtensionName()
 
+	if conf.MackerelConfig.AutoCreateRoles && len(conf.MackerelConfig.RoleFullnames) == 0 {
+		conf.MackerelConfig.RoleFullnames = []string{mackerel.DefaultRoleFullname(conf.AWSLambdaConfig.FunctionName)}
+	}
+
 	return conf, nil
 }
 
+// sections returns the settings which don't depend on the Lambda runtime, which the validate subcommand checks too
+func (c *Config) sections() []interface{} {
+	return []interface{}{
+		&c.MackerelConfig,
+		&c.AWSConfig,
+		&c.CheckConfig,
+		&c.OTLPConfig,
+		&c.PrometheusConfig,
+		&c.LogsConfig,
+		&c.CaptureConfig,
+		&c.CollectorConfig,
+	}
+}
+
+// validateSections checks the settings returned by sections
+func validateSections(conf *Config) error {
+	if err := conf.MackerelConfig.ReaperConfig.Validate(); err != nil {
+		return err
+	}
+
+	for _, s := range []struct {
+		prefix string
+		conf   interface{ Validate(prefix string) error }
+	}{
+		{"EXT_MACKEREL_SINK_", &conf.MackerelConfig.SinkConfig},
+		{"EXT_OTLP_SINK_", &conf.OTLPConfig.SinkConfig},
+		{"EXT_PROMETHEUS_SINK_", &conf.PrometheusConfig.SinkConfig},
+		{"EXT_LOGS_SINK_", &conf.LogsConfig.SinkConfig},
+	} {
+		if err := s.conf.Validate(s.prefix); err != nil {
+			return err
+		}
+	}
+
+	for _, section := range []interface{ Validate() error }{
+		&conf.CheckConfig,
+		&conf.LogsConfig,
+		&conf.CaptureConfig,
+		&conf.CollectorConfig,
+	} {
+		if err := section.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getMackerelConfig reads the settings of Mackerel for the subcommands, and resolves the API key
+func getMackerelConfig() (*mackerel.MackerelConfig, error) {
+	var conf struct {
+		MackerelConfig mackerel.MackerelConfig
+		AWSConfig      lambda.AWSConfig
+	}
+	if err := parseSettings(&conf); err != nil {
+		return nil, err
+	}
+	if err := conf.MackerelConfig.SinkConfig.Validate("EXT_MACKEREL_SINK_"); err != nil {
+		return nil, err
+	}
+	if err := mackerel.UseAPIBase(conf.MackerelConfig.ApiBase); err != nil {
+		return nil, err
+	}
+	if err := resolveMackerelApiKey(&conf.MackerelConfig, &conf.AWSConfig); err != nil {
+		return nil, err
+	}
+	return &conf.MackerelConfig, nil
+}
+
 func parseEnv() (*Config, error) {
 	conf := &Config{}
-	if err := env.Parse(conf); err != nil {
+	if err := parseSettings(conf); err != nil {
 		return nil, err
 	}
 	return conf, nil
 }
 
-func fetchMackerelApiKeyFromSSM(region string, name string) (string, error) {
+// resolveMackerelApiKey fetches the API key from SSM or Secrets Manager if it's stored there.
+// The fetched key is refreshed on the interval and on the rejection by Mackerel.
+func resolveMackerelApiKey(conf *mackerel.MackerelConfig, awsConf *lambda.AWSConfig) error {
+	sources := 0
+	for _, v := range []string{conf.ApiKey, conf.ApiKeySSMParamName, conf.ApiKeySecretID} {
+		if v != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return errors.New("either EXT_MACKEREL_API_KEY, EXT_MACKEREL_API_KEY_SSM or EXT_MACKEREL_API_KEY_SECRET can be specified")
+	}
+	if conf.ApiKeySecretJSONKey != "" && conf.ApiKeySecretID == "" {
+		return errors.New("EXT_MACKEREL_API_KEY_SECRET_JSON_KEY requires EXT_MACKEREL_API_KEY_SECRET")
+	}
+
+	// The first fetch goes through the cache of the Parameters and Secrets extension if it's running,
+	// so that the cold starts of many functions don't throttle SSM. The refetches bypass the cache to get a rotated key.
+	cache := newParametersSecretsExtension(awsConf)
+	var fetch, fetchCached func() (string, error)
+	switch {
+	case conf.ApiKeySSMParamName != "":
+		fetch = func() (string, error) {
+			return fetchMackerelApiKeyFromSSM(awsConf, conf.ApiKeySSMParamName)
+		}
+		fetchCached = func() (string, error) {
+			return cache.getParameter(conf.ApiKeySSMParamName)
+		}
+	case conf.ApiKeySecretID != "":
+		fetch = func() (string, error) {
+			return fetchMackerelApiKeyFromSecretsManager(awsConf, conf.ApiKeySecretID, conf.ApiKeySecretJSONKey)
+		}
+		fetchCached = func() (string, error) {
+			secret, err := cache.getSecretString(conf.ApiKeySecretID)
+			if err != nil {
+				return "", err
+			}
+			return extractSecretValue(secret, conf.ApiKeySecretJSONKey)
+		}
+	default:
+		return nil
+	}
+
+	var apiKey string
+	var err error
+	if cache != nil {
+		if apiKey, err = fetchCached(); err != nil {
+			Logger.Info("Can't read the API key through the Parameters and Secrets extension, falling back to the SDK:", err)
+		}
+	}
+	if cache == nil || err != nil {
+		if apiKey, err = fetch(); err != nil {
+			return err
+		}
+	}
+	conf.ApiKey = apiKey
+	mackerel.UseAPIKeyRotator(mackerel.NewAPIKeyRotator(apiKey, fetch, conf.ApiKeyRefreshInterval))
+	return nil
+}
+
+func newAWSSession(awsConf *lambda.AWSConfig) *session.Session {
 	sess := session.Must(session.NewSession())
-	sess.Config.Region = aws.String(region)
-	client := ssm.New(sess)
+	sess.Config.Region = aws.String(awsConf.Region)
+	if awsConf.EndpointURL != "" {
+		sess.Config.Endpoint = aws.String(awsConf.EndpointURL)
+	}
+	return sess
+}
+
+func fetchMackerelApiKeyFromSSM(awsConf *lambda.AWSConfig, name string) (string, error) {
+	client := ssm.New(newAWSSession(awsConf))
 	res, err := client.GetParameter(&ssm.GetParameterInput{
 		Name:           aws.String(name),
 		WithDecryption: aws.Bool(true),
@@ -70,8 +224,47 @@ func fetchMackerelApiKeyFromSSM(region string, name string) (string, error) {
 	return aws.StringValue(res.Parameter.Value), nil
 }
 
+func fetchMackerelApiKeyFromSecretsManager(awsConf *lambda.AWSConfig, secretID string, jsonKey string) (string, error) {
+	client := secretsmanager.New(newAWSSession(awsConf))
+	res, err := client.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return "", err
+	}
+	return extractSecretValue(aws.StringValue(res.SecretString), jsonKey)
+}
+
+// extractSecretValue returns the string at the dot-separated jsonKey of the secret, or the secret itself if jsonKey is empty
+func extractSecretValue(secret string, jsonKey string) (string, error) {
+	if jsonKey == "" {
+		return secret, nil
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(secret), &value); err != nil {
+		return "", fmt.Errorf("the secret is not a JSON object: %w", err)
+	}
+	for _, key := range strings.Split(jsonKey, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("%s is not found in the secret", jsonKey)
+		}
+		if value, ok = object[key]; !ok {
+			return "", fmt.Errorf("%s is not found in the secret", jsonKey)
+		}
+	}
+	apiKey, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s of the secret is not a string", jsonKey)
+	}
+	return apiKey, nil
+}
+
+// bootIDPath identifies the runtime environment of the function. It's a variable to run the agent in tests.
+var bootIDPath = "/proc/sys/kernel/random/boot_id"
+
 func getEnvironmentID() (string, error) {
-	bytes, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	bytes, err := os.ReadFile(bootIDPath)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/caarlos0/env/v6"
+	"gopkg.in/yaml.v3"
+)
+
+// configFileSearchDirs are the directories a relative EXT_CONFIG_FILE is looked up in: the function package and the layers
+var configFileSearchDirs = []string{os.Getenv("LAMBDA_TASK_ROOT"), "/opt"}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// configSetting is a setting allowed in the config file
+type configSetting struct {
+	typ             reflect.Type
+	separator       string
+	keyValSeparator string
+}
+
+// parseSettings reads the environment variables and the config file into conf, which may be a part of Config,
+// e.g. the settings of Mackerel for the subcommands. The file is validated against the whole Config either way,
+// so that the config file of the agent is accepted by all the commands.
+func parseSettings(conf interface{}) error {
+	environment, err := loadEnvironment()
+	if err != nil {
+		return err
+	}
+	return env.Parse(conf, env.Options{Environment: environment})
+}
+
+// loadEnvironment returns the environment variables merged with the settings of EXT_CONFIG_FILE.
+// The environment variables take precedence over the config file.
+func loadEnvironment() (map[string]string, error) {
+	environment := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			environment[k] = v
+		}
+	}
+
+	path := os.Getenv("EXT_CONFIG_FILE")
+	if path == "" {
+		return environment, nil
+	}
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range settings {
+		if _, ok := environment[k]; !ok {
+			environment[k] = v
+		}
+	}
+	return environment, nil
+}
+
+// readConfigFile reads a YAML or TOML config file and returns its settings as environment variables
+func readConfigFile(path string) (map[string]string, error) {
+	path, err := findConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	document := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &document)
+	case ".toml":
+		err = toml.Unmarshal(content, &document)
+	default:
+		return nil, fmt.Errorf("%s: unsupported config file format, must be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	schema := make(map[string]*configSetting)
+	buildConfigSchema(reflect.TypeOf(Config{}), "", schema)
+
+	settings := make(map[string]string)
+	if err := flattenConfig(nil, document, schema, settings); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return settings, nil
+}
+
+func findConfigFile(path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return path, nil
+	}
+	for _, dir := range configFileSearchDirs {
+		if dir == "" {
+			continue
+		}
+		candidate := filepath.Join(dir, path)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("EXT_CONFIG_FILE %s is not found in %s", path, strings.Join(configFileSearchDirs, ", "))
+}
+
+// buildConfigSchema collects the EXT_ settings of the env tags of the config struct
+func buildConfigSchema(t reflect.Type, prefix string, schema map[string]*configSetting) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("env"), ",")
+		if name == "" {
+			buildConfigSchema(field.Type, prefix+field.Tag.Get("envPrefix"), schema)
+			continue
+		}
+		name = prefix + name
+		if !strings.HasPrefix(name, "EXT_") {
+			continue
+		}
+		setting := &configSetting{
+			typ:             field.Type,
+			separator:       field.Tag.Get("envSeparator"),
+			keyValSeparator: field.Tag.Get("envKeyValSeparator"),
+		}
+		if setting.separator == "" {
+			setting.separator = ","
+		}
+		if setting.keyValSeparator == "" {
+			// the format of sink.Headers
+			setting.keyValSeparator = "="
+		}
+		schema[name] = setting
+	}
+}
+
+// flattenConfig turns the nested keys into the names of the environment variables.
+// e.g. mackerel.annotation.enabled is EXT_MACKEREL_ANNOTATION_ENABLED.
+func flattenConfig(keys []string, value interface{}, schema map[string]*configSetting, settings map[string]string) error {
+	key := strings.Join(keys, ".")
+	name := "EXT_" + strings.ToUpper(strings.Join(keys, "_"))
+	if setting, ok := schema[name]; ok {
+		if _, ok := settings[name]; ok {
+			return fmt.Errorf("%s: %s is set more than once", key, name)
+		}
+		v, err := setting.format(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		settings[name] = v
+		return nil
+	}
+
+	table, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: unknown setting", key)
+	}
+	children := make([]string, 0, len(table))
+	for k := range table {
+		children = append(children, k)
+	}
+	sort.Strings(children)
+	for _, k := range children {
+		if err := flattenConfig(append(keys[:len(keys):len(keys)], k), table[k], schema, settings); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// format checks the type of the value and formats it as an environment variable
+func (s *configSetting) format(value interface{}) (string, error) {
+	t := s.typ
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == durationType:
+		str, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("must be a duration like \"5s\", got %s", describeValue(value))
+		}
+		if _, err := time.ParseDuration(str); err != nil {
+			return "", fmt.Errorf("must be a duration like \"5s\", got %q", str)
+		}
+		return str, nil
+	case t.Kind() == reflect.Slice:
+		items, ok := value.([]interface{})
+		if !ok {
+			return formatScalar(t.Elem(), value)
+		}
+		strs := make([]string, 0, len(items))
+		for i, item := range items {
+			str, err := formatScalar(t.Elem(), item)
+			if err != nil {
+				return "", fmt.Errorf("[%d]: %w", i, err)
+			}
+			strs = append(strs, str)
+		}
+		return strings.Join(strs, s.separator), nil
+	case t.Kind() == reflect.Map:
+		table, ok := value.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("must be a table, got %s", describeValue(value))
+		}
+		keys := make([]string, 0, len(table))
+		for k := range table {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, 0, len(keys))
+		for _, k := range keys {
+			str, err := formatScalar(t.Elem(), table[k])
+			if err != nil {
+				return "", fmt.Errorf("%s: %w", k, err)
+			}
+			pairs = append(pairs, k+s.keyValSeparator+str)
+		}
+		return strings.Join(pairs, s.separator), nil
+	default:
+		return formatScalar(t, value)
+	}
+}
+
+func formatScalar(t reflect.Type, value interface{}) (string, error) {
+	switch t.Kind() {
+	case reflect.Bool:
+		if b, ok := value.(bool); ok {
+			return fmt.Sprint(b), nil
+		}
+		return "", fmt.Errorf("must be a boolean, got %s", describeValue(value))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch n := value.(type) {
+		case int:
+			return fmt.Sprint(n), nil
+		case int64:
+			return fmt.Sprint(n), nil
+		case float64:
+			if n == math.Trunc(n) {
+				return fmt.Sprint(int64(n)), nil
+			}
+		}
+		return "", fmt.Errorf("must be an integer, got %s", describeValue(value))
+	case reflect.Float32, reflect.Float64:
+		switch n := value.(type) {
+		case int, int64, float64:
+			return fmt.Sprint(n), nil
+		}
+		return "", fmt.Errorf("must be a number, got %s", describeValue(value))
+	case reflect.String:
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case int, int64, float64, bool:
+			return fmt.Sprint(v), nil
+		}
+		return "", fmt.Errorf("must be a string, got %s", describeValue(value))
+	default:
+		return "", fmt.Errorf("unsupported setting of %s", t)
+	}
+}
+
+func describeValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return fmt.Sprintf("string %q", v)
+	case bool:
+		return fmt.Sprintf("boolean %v", v)
+	case int, int64:
+		return fmt.Sprintf("integer %v", v)
+	case float64:
+		return fmt.Sprintf("number %v", v)
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "a table"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/host/mackerel"
+)
+
+// fullConfigFile has a setting of every section of Config, as the config file shared by the agent and the subcommands
+const fullConfigFile = `
+mackerel:
+  api_key: dummy
+  role_full_names:
+    - lambda:fn
+  api_key_refresh_interval: 1h
+  monitor:
+    error_rate_warning: 5
+  annotation:
+    enabled: true
+  reaper:
+    enabled: true
+    ttl: 6h
+  sink:
+    batch_size: 500
+  check:
+    enabled: true
+    log_pattern: ERROR
+aws:
+  endpoint_url: http://localhost:4566
+otlp:
+  endpoint: http://localhost:4318
+  headers:
+    Authorization: Bearer xxx
+  sink:
+    flush_interval: 30s
+prometheus:
+  remote_write_url: http://localhost:9090/api/v1/write
+logs:
+  endpoint: http://localhost:3100/loki/api/v1/push
+  format: loki
+  sink:
+    max_buffered_records: 500
+telemetry:
+  capture: true
+  capture_path: /tmp/capture.jsonl
+collector:
+  interval: 30s
+`
+
+// useConfigFile writes the content to a config file of the name and sets EXT_CONFIG_FILE to it
+func useConfigFile(t *testing.T, name string, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("EXT_CONFIG_FILE", path)
+}
+
+// setLambdaEnv sets the variables given by the Lambda runtime, which are required by parseEnv
+func setLambdaEnv(t *testing.T) {
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "fn")
+	t.Setenv("AWS_LAMBDA_RUNTIME_API", "127.0.0.1:9001")
+}
+
+func TestFullConfigFileThroughEachEntryPoint(t *testing.T) {
+	useConfigFile(t, "config.yaml", fullConfigFile)
+	setLambdaEnv(t)
+
+	t.Run("parseEnv", func(t *testing.T) {
+		conf, err := parseEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := validateSections(conf); err != nil {
+			t.Fatal(err)
+		}
+		if conf.MackerelConfig.ApiKey != "dummy" || conf.MackerelConfig.ReaperConfig.TTL != 6*time.Hour || conf.MackerelConfig.SinkConfig.BatchSize != 500 {
+			t.Errorf("mackerel = %+v", conf.MackerelConfig)
+		}
+		if !conf.CheckConfig.Enabled || conf.CheckConfig.LogPattern != "ERROR" {
+			t.Errorf("check = %+v", conf.CheckConfig)
+		}
+		if conf.AWSConfig.EndpointURL != "http://localhost:4566" {
+			t.Errorf("aws = %+v", conf.AWSConfig)
+		}
+		if conf.OTLPConfig.Endpoint != "http://localhost:4318" || conf.OTLPConfig.Headers["Authorization"] != "Bearer xxx" || conf.OTLPConfig.SinkConfig.FlushInterval != 30*time.Second {
+			t.Errorf("otlp = %+v", conf.OTLPConfig)
+		}
+		if conf.PrometheusConfig.RemoteWriteURL != "http://localhost:9090/api/v1/write" {
+			t.Errorf("prometheus = %+v", conf.PrometheusConfig)
+		}
+		if conf.LogsConfig.Format != "loki" || conf.LogsConfig.MaxBufferedRecords != 500 {
+			t.Errorf("logs = %+v", conf.LogsConfig)
+		}
+		if !conf.CaptureConfig.Enabled || conf.CaptureConfig.Path != "/tmp/capture.jsonl" {
+			t.Errorf("capture = %+v", conf.CaptureConfig)
+		}
+		if conf.CollectorConfig.Interval != 30*time.Second {
+			t.Errorf("collector = %+v", conf.CollectorConfig)
+		}
+	})
+
+	t.Run("partial struct", func(t *testing.T) {
+		var partial struct {
+			MackerelConfig mackerel.MackerelConfig
+		}
+		if err := parseSettings(&partial); err != nil {
+			t.Fatal(err)
+		}
+		if partial.MackerelConfig.ApiKey != "dummy" || len(partial.MackerelConfig.RoleFullnames) != 1 {
+			t.Errorf("mackerel = %+v", partial.MackerelConfig)
+		}
+	})
+
+	t.Run("getMackerelConfig", func(t *testing.T) {
+		conf, err := getMackerelConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conf.ApiKey != "dummy" || conf.SinkConfig.BatchSize != 500 {
+			t.Errorf("mackerel = %+v", conf)
+		}
+	})
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"config.yaml", "otlp:\n  endpoint_url: http://localhost:4318\n", "otlp.endpoint_url: unknown setting"},
+		{"config.yaml", "mackerel:\n  annotation:\n    enabled: \"yes\"\n", `mackerel.annotation.enabled: must be a boolean, got string "yes"`},
+		{"config.toml", "[collector]\ninterval = 30\n", "collector.interval: must be a duration"},
+		{"config.yaml", "logs:\n  sink:\n    max_buffered_metrics: 100\n", "logs.sink.max_buffered_metrics: unknown setting"},
+		{"config.json", "{}", "unsupported config file format"},
+	}
+	for _, tt := range tests {
+		useConfigFile(t, tt.name, tt.content)
+		_, err := loadEnvironment()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want %s", tt.content, err, tt.want)
+		}
+	}
+}
+
+func TestEnvironmentTakesPrecedenceOverConfigFile(t *testing.T) {
+	useConfigFile(t, "config.toml", "[mackerel]\napi_key = \"from-file\"\nrole_full_names = [\"lambda:fn\"]\n")
+	t.Setenv("EXT_MACKEREL_API_KEY", "from-env")
+
+	var conf struct {
+		MackerelConfig mackerel.MackerelConfig
+	}
+	if err := parseSettings(&conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.MackerelConfig.ApiKey != "from-env" || conf.MackerelConfig.RoleFullnames[0] != "lambda:fn" {
+		t.Errorf("mackerel = %+v, want the key of the environment and the roles of the file", conf.MackerelConfig)
+	}
+}
+
+func TestValidateConfigReadsFullConfigFileWithoutLambdaRuntime(t *testing.T) {
+	useConfigFile(t, "config.yaml", fullConfigFile)
+
+	conf, err := getValidateConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.MackerelConfig.ApiKey != "dummy" || conf.LogsConfig.Format != "loki" || conf.CollectorConfig.Interval != 30*time.Second {
+		t.Errorf("conf = %+v", conf)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/host/mackerel"
+)
+
+// runDashboard builds or updates the custom dashboard of each role in EXT_MACKEREL_ROLE_FULL_NAMES.
+func runDashboard(args []string) error {
+	flags := flag.NewFlagSet("dashboard", flag.ContinueOnError)
+	functionName := flags.String("function-name", os.Getenv("AWS_LAMBDA_FUNCTION_NAME"), "name of the Lambda function noted in the dashboard memo")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	conf, err := getMackerelConfig()
+	if err != nil {
+		return err
+	}
+	if len(conf.RoleFullnames) == 0 {
+		return errors.New("EXT_MACKEREL_ROLE_FULL_NAMES is required to build dashboards")
+	}
+
+	for _, roleFullname := range conf.RoleFullnames {
+		dashboard, err := mackerel.CreateOrUpdateDashboard(&mackerel.CreateOrUpdateDashboardParam{
+			MackerelApiKey: conf.ApiKey,
+			RoleFullname:   roleFullname,
+			FunctionName:   *functionName,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s\n", dashboard.Title, mackerel.DashboardURL(dashboard.URLPath))
+	}
+	return nil
+}
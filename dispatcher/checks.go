@@ -0,0 +1,178 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/collector"
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+const (
+	CheckInvocationError = "lambda-invocation-error"
+	CheckTimeout         = "lambda-timeout"
+	CheckInitFailure     = "lambda-init-failure"
+	CheckLogPattern      = "lambda-log-pattern"
+	CheckTmpUsage        = "lambda-tmp-usage"
+)
+
+// maxCheckMessageSamples is the number of occurrences quoted in a check report message
+const maxCheckMessageSamples = 3
+
+// Checks returns the check monitoring items to be declared on host registration.
+func (c *CheckConfig) Checks() []mackerel.CheckConfig {
+	if !c.Enabled {
+		return []mackerel.CheckConfig{}
+	}
+	checks := []mackerel.CheckConfig{
+		{Name: CheckInvocationError, Memo: "Invocations which ended with an error"},
+		{Name: CheckTimeout, Memo: "Invocations which timed out"},
+		{Name: CheckInitFailure, Memo: "Failures of the runtime initialization"},
+	}
+	if c.LogPattern != "" {
+		checks = append(checks, mackerel.CheckConfig{Name: CheckLogPattern, Memo: "Function logs matching " + c.LogPattern})
+	}
+	if c.checksTmpUsage() {
+		checks = append(checks, mackerel.CheckConfig{Name: CheckTmpUsage, Memo: "Utilization of the ephemeral storage /tmp"})
+	}
+	return checks
+}
+
+type platformRuntimeDoneStatusRecord struct {
+	RequestID string `json:"requestId"`
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+}
+type platformRuntimeDoneStatus struct {
+	Record platformRuntimeDoneStatusRecord `json:"record"`
+}
+
+type platformInitRuntimeDoneRecord struct {
+	InitializationType string `json:"initializationType"`
+	Phase              string `json:"phase"`
+	Status             string `json:"status"`
+	ErrorType          string `json:"errorType"`
+}
+type platformInitRuntimeDone struct {
+	Record platformInitRuntimeDoneRecord `json:"record"`
+}
+
+// checkOccurrences counts the occurrences of a check condition and keeps a few samples for the message
+type checkOccurrences struct {
+	count   int
+	samples []string
+}
+
+func (o *checkOccurrences) add(sample string) {
+	o.count++
+	if len(o.samples) < maxCheckMessageSamples {
+		o.samples = append(o.samples, sample)
+	}
+}
+
+func gatherChecks(logEntries []interface{}, conf *CheckConfig, now time.Time) []*mackerel.CheckReport {
+	var invocationErrors, timeouts, initFailures, logMatches checkOccurrences
+	for _, logEntry := range logEntries {
+		switch logEntry.(map[string]interface{})["type"] {
+		case "platform.runtimeDone":
+			s, _ := json.Marshal(logEntry)
+			entry := &platformRuntimeDoneStatus{}
+			if err := json.Unmarshal(s, &entry); err != nil {
+				Logger.Warning("Can't unmarshal platform.runtimeDone:", err)
+				continue
+			}
+			switch entry.Record.Status {
+			case "success":
+			case "timeout":
+				timeouts.add("requestId=" + entry.Record.RequestID)
+			default:
+				invocationErrors.add(fmt.Sprintf("requestId=%s status=%s errorType=%s", entry.Record.RequestID, entry.Record.Status, entry.Record.ErrorType))
+			}
+
+		case "platform.initRuntimeDone":
+			s, _ := json.Marshal(logEntry)
+			entry := &platformInitRuntimeDone{}
+			if err := json.Unmarshal(s, &entry); err != nil {
+				Logger.Warning("Can't unmarshal platform.initRuntimeDone:", err)
+				continue
+			}
+			if entry.Record.Status != "" && entry.Record.Status != "success" {
+				initFailures.add(fmt.Sprintf("phase=%s status=%s errorType=%s", entry.Record.Phase, entry.Record.Status, entry.Record.ErrorType))
+			}
+
+		case "function":
+			if conf.logPattern == nil {
+				continue
+			}
+			var line string
+			switch record := logEntry.(map[string]interface{})["record"].(type) {
+			case string:
+				line = record
+			default:
+				s, _ := json.Marshal(record)
+				line = string(s)
+			}
+			if conf.logPattern.MatchString(line) {
+				logMatches.add(strings.TrimSpace(line))
+			}
+		}
+	}
+
+	reports := []*mackerel.CheckReport{
+		newCheckReport(CheckInvocationError, "invocation errors", &invocationErrors, conf.ErrorWarning, conf.ErrorCritical, now),
+		newCheckReport(CheckTimeout, "timeouts", &timeouts, conf.TimeoutWarning, conf.TimeoutCritical, now),
+		newCheckReport(CheckInitFailure, "init failures", &initFailures, conf.InitFailureWarning, conf.InitFailureCritical, now),
+	}
+	if conf.logPattern != nil {
+		reports = append(reports, newCheckReport(CheckLogPattern, "log lines matching "+conf.LogPattern, &logMatches, conf.LogPatternWarning, conf.LogPatternCritical, now))
+	}
+	return reports
+}
+
+func newCheckReport(name string, subject string, occurrences *checkOccurrences, warning int, critical int, now time.Time) *mackerel.CheckReport {
+	status := mackerel.CheckStatusOK
+	if critical > 0 && occurrences.count >= critical {
+		status = mackerel.CheckStatusCritical
+	} else if warning > 0 && occurrences.count >= warning {
+		status = mackerel.CheckStatusWarning
+	}
+
+	message := fmt.Sprintf("%d %s", occurrences.count, subject)
+	if len(occurrences.samples) > 0 {
+		message += "\n" + strings.Join(occurrences.samples, "\n")
+	}
+	return &mackerel.CheckReport{
+		Name:       name,
+		Status:     status,
+		Message:    message,
+		OccurredAt: now.Unix(),
+	}
+}
+
+// checkTmpUsage reports the higher of the utilizations of the space and the inodes of /tmp against the thresholds
+func checkTmpUsage(conf *CheckConfig, now time.Time) *mackerel.CheckReport {
+	usage, err := collector.GetDiskUsage(collector.TmpDir)
+	if err != nil {
+		Logger.Warning("Failed to get the usage of /tmp:", err)
+		return nil
+	}
+	utilization := usage.Utilization()
+	if inodes := usage.InodesUtilization(); inodes > utilization {
+		utilization = inodes
+	}
+
+	status := mackerel.CheckStatusOK
+	if conf.TmpUsageCritical > 0 && utilization >= conf.TmpUsageCritical {
+		status = mackerel.CheckStatusCritical
+	} else if conf.TmpUsageWarning > 0 && utilization >= conf.TmpUsageWarning {
+		status = mackerel.CheckStatusWarning
+	}
+	return &mackerel.CheckReport{
+		Name:       CheckTmpUsage,
+		Status:     status,
+		Message:    fmt.Sprintf("%.1f%% of /tmp used: %d bytes used, %d bytes available, %.1f%% of the inodes used", utilization, usage.Used, usage.Available, usage.InodesUtilization()),
+		OccurredAt: now.Unix(),
+	}
+}
@@ -0,0 +1,243 @@
+package dispatcher
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-collections/go-datastructures/queue"
+	"github.com/mackerelio/mackerel-client-go"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	Logger = logrus.NewEntry(logrus.New())
+	Logger.Logger.SetOutput(io.Discard)
+}
+
+// checkHost records the check reports posted by the dispatcher
+type checkHost struct {
+	mu      sync.Mutex
+	reports [][]*mackerel.CheckReport
+}
+
+func (h *checkHost) Retire() error          { return nil }
+func (h *checkHost) CreateGraphDefs() error { return nil }
+
+func (h *checkHost) PostCheckReports(reports []*mackerel.CheckReport) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reports = append(h.reports, reports)
+	return nil
+}
+
+func (h *checkHost) statuses() []map[string]mackerel.CheckStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	statuses := make([]map[string]mackerel.CheckStatus, 0, len(h.reports))
+	for _, reports := range h.reports {
+		m := make(map[string]mackerel.CheckStatus, len(reports))
+		for _, r := range reports {
+			m[r.Name] = r.Status
+		}
+		statuses = append(statuses, m)
+	}
+	return statuses
+}
+
+func newTestCheckConfig(t *testing.T, conf CheckConfig) *CheckConfig {
+	t.Helper()
+	conf.Enabled = true
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return &conf
+}
+
+func runtimeDone(requestID string, status string, errorType string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":   "platform.runtimeDone",
+		"record": map[string]interface{}{"requestId": requestID, "status": status, "errorType": errorType},
+	}
+}
+
+func TestGatherChecks(t *testing.T) {
+	conf := newTestCheckConfig(t, CheckConfig{
+		ErrorWarning:        1,
+		ErrorCritical:       3,
+		TimeoutCritical:     1,
+		InitFailureCritical: 1,
+		LogPattern:          "ERROR|panic",
+		LogPatternWarning:   2,
+	})
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name     string
+		entries  []interface{}
+		statuses map[string]mackerel.CheckStatus
+		messages map[string]string
+	}{
+		{
+			name:    "no entries",
+			entries: nil,
+			statuses: map[string]mackerel.CheckStatus{
+				CheckInvocationError: mackerel.CheckStatusOK,
+				CheckTimeout:         mackerel.CheckStatusOK,
+				CheckInitFailure:     mackerel.CheckStatusOK,
+				CheckLogPattern:      mackerel.CheckStatusOK,
+			},
+			messages: map[string]string{CheckInvocationError: "0 invocation errors"},
+		},
+		{
+			name: "errors below the critical threshold",
+			entries: []interface{}{
+				runtimeDone("request-1", "success", ""),
+				runtimeDone("request-2", "error", "Runtime.ExitError"),
+				runtimeDone("request-3", "failure", "Runtime.OutOfMemory"),
+			},
+			statuses: map[string]mackerel.CheckStatus{
+				CheckInvocationError: mackerel.CheckStatusWarning,
+				CheckTimeout:         mackerel.CheckStatusOK,
+			},
+			messages: map[string]string{
+				CheckInvocationError: "2 invocation errors\nrequestId=request-2 status=error errorType=Runtime.ExitError\nrequestId=request-3 status=failure errorType=Runtime.OutOfMemory",
+			},
+		},
+		{
+			name: "errors beyond the samples",
+			entries: []interface{}{
+				runtimeDone("request-1", "error", ""),
+				runtimeDone("request-2", "error", ""),
+				runtimeDone("request-3", "error", ""),
+				runtimeDone("request-4", "error", ""),
+			},
+			statuses: map[string]mackerel.CheckStatus{CheckInvocationError: mackerel.CheckStatusCritical},
+			messages: map[string]string{
+				CheckInvocationError: "4 invocation errors\nrequestId=request-1 status=error errorType=\nrequestId=request-2 status=error errorType=\nrequestId=request-3 status=error errorType=",
+			},
+		},
+		{
+			name: "timeout and init failure",
+			entries: []interface{}{
+				runtimeDone("request-1", "timeout", ""),
+				map[string]interface{}{
+					"type":   "platform.initRuntimeDone",
+					"record": map[string]interface{}{"initializationType": "on-demand", "phase": "init", "status": "error", "errorType": "Runtime.ImportModuleError"},
+				},
+			},
+			statuses: map[string]mackerel.CheckStatus{
+				CheckInvocationError: mackerel.CheckStatusOK,
+				CheckTimeout:         mackerel.CheckStatusCritical,
+				CheckInitFailure:     mackerel.CheckStatusCritical,
+			},
+			messages: map[string]string{
+				CheckTimeout:     "1 timeouts\nrequestId=request-1",
+				CheckInitFailure: "1 init failures\nphase=init status=error errorType=Runtime.ImportModuleError",
+			},
+		},
+		{
+			name: "log pattern",
+			entries: []interface{}{
+				map[string]interface{}{"type": "function", "record": "ERROR something failed\n"},
+				map[string]interface{}{"type": "function", "record": "INFO hello"},
+				map[string]interface{}{"type": "function", "record": map[string]interface{}{"level": "ERROR", "message": "failed"}},
+			},
+			statuses: map[string]mackerel.CheckStatus{CheckLogPattern: mackerel.CheckStatusWarning},
+			messages: map[string]string{
+				CheckLogPattern: "2 log lines matching ERROR|panic\nERROR something failed\n{\"level\":\"ERROR\",\"message\":\"failed\"}",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reports := gatherChecks(tt.entries, conf, now)
+			byName := make(map[string]*mackerel.CheckReport, len(reports))
+			for _, r := range reports {
+				if r.OccurredAt != now.Unix() {
+					t.Errorf("%s occurred at %d, want %d", r.Name, r.OccurredAt, now.Unix())
+				}
+				byName[r.Name] = r
+			}
+			for name, want := range tt.statuses {
+				if r, ok := byName[name]; !ok || r.Status != want {
+					t.Errorf("%s = %+v, want %s", name, r, want)
+				}
+			}
+			for name, want := range tt.messages {
+				if r, ok := byName[name]; !ok || r.Message != want {
+					t.Errorf("%s message = %q, want %q", name, r.Message, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGatherChecksWithoutLogPattern(t *testing.T) {
+	conf := newTestCheckConfig(t, CheckConfig{ErrorCritical: 1})
+	for _, r := range gatherChecks(nil, conf, time.Now()) {
+		if r.Name == CheckLogPattern {
+			t.Errorf("reports = %+v, want no report of the log pattern", r)
+		}
+	}
+}
+
+func TestDispatchReportsChecksWhileIdle(t *testing.T) {
+	h := &checkHost{}
+	d := NewDispatcher(h, nil, newTestCheckConfig(t, CheckConfig{ErrorCritical: 1}))
+	q := queue.New(10)
+	ctx := context.Background()
+
+	lastPostedAt = time.Time{}
+	if err := q.Put(runtimeDone("request-1", "error", "Runtime.ExitError")); err != nil {
+		t.Fatal(err)
+	}
+	d.Dispatch(ctx, q, false)
+
+	// the next tick after a minute, without telemetry
+	lastPostedAt = time.Now().Add(-2 * time.Minute)
+	d.Dispatch(ctx, q, false)
+	// within the minute, nothing is reported
+	d.Dispatch(ctx, q, false)
+
+	statuses := h.statuses()
+	if len(statuses) != 2 {
+		t.Fatalf("reports = %d, want 2", len(statuses))
+	}
+	if statuses[0][CheckInvocationError] != mackerel.CheckStatusCritical {
+		t.Errorf("first = %v, want CRITICAL", statuses[0])
+	}
+	if statuses[1][CheckInvocationError] != mackerel.CheckStatusOK {
+		t.Errorf("idle = %v, want OK to recover", statuses[1])
+	}
+}
+
+func TestDispatchDoesNotReportChecksWhenDisabled(t *testing.T) {
+	h := &checkHost{}
+	d := NewDispatcher(h, nil, &CheckConfig{})
+	lastPostedAt = time.Time{}
+	d.Dispatch(context.Background(), queue.New(1), false)
+	if n := len(h.statuses()); n != 0 {
+		t.Errorf("reports = %d, want none", n)
+	}
+}
+
+func TestChecks(t *testing.T) {
+	names := func(conf *CheckConfig) string {
+		ns := make([]string, 0)
+		for _, c := range conf.Checks() {
+			ns = append(ns, c.Name)
+		}
+		return strings.Join(ns, ",")
+	}
+	if got := names(&CheckConfig{}); got != "" {
+		t.Errorf("checks = %s, want none when disabled", got)
+	}
+	conf := newTestCheckConfig(t, CheckConfig{LogPattern: "ERROR", TmpUsageWarning: 80})
+	if got, want := names(conf), "lambda-invocation-error,lambda-timeout,lambda-init-failure,lambda-log-pattern,lambda-tmp-usage"; got != want {
+		t.Errorf("checks = %s, want %s", got, want)
+	}
+}
@@ -1,5 +1,76 @@
 package dispatcher
 
+import (
+	"fmt"
+	"regexp"
+)
+
 type DispatcherConfig struct {
 	MinBatchSize int64 `env:"DISPATCH_MIN_BATCH_SIZE" envDefault:"1"`
 }
+
+// CheckConfig holds the thresholds of the check monitoring reports derived from telemetry.
+// A threshold of 0 disables the corresponding severity.
+type CheckConfig struct {
+	Enabled             bool   `env:"EXT_MACKEREL_CHECK_ENABLED" envDefault:"false"`
+	ErrorWarning        int    `env:"EXT_MACKEREL_CHECK_ERROR_WARNING" envDefault:"1"`
+	ErrorCritical       int    `env:"EXT_MACKEREL_CHECK_ERROR_CRITICAL" envDefault:"5"`
+	TimeoutWarning      int    `env:"EXT_MACKEREL_CHECK_TIMEOUT_WARNING" envDefault:"0"`
+	TimeoutCritical     int    `env:"EXT_MACKEREL_CHECK_TIMEOUT_CRITICAL" envDefault:"1"`
+	InitFailureWarning  int    `env:"EXT_MACKEREL_CHECK_INIT_FAILURE_WARNING" envDefault:"0"`
+	InitFailureCritical int    `env:"EXT_MACKEREL_CHECK_INIT_FAILURE_CRITICAL" envDefault:"1"`
+	LogPattern          string `env:"EXT_MACKEREL_CHECK_LOG_PATTERN"`
+	LogPatternWarning   int    `env:"EXT_MACKEREL_CHECK_LOG_PATTERN_WARNING" envDefault:"1"`
+	LogPatternCritical  int    `env:"EXT_MACKEREL_CHECK_LOG_PATTERN_CRITICAL" envDefault:"0"`
+	// TmpUsageWarning and TmpUsageCritical are the thresholds of the utilization of /tmp in percent
+	TmpUsageWarning  float64 `env:"EXT_MACKEREL_CHECK_TMP_USAGE_WARNING" envDefault:"0"`
+	TmpUsageCritical float64 `env:"EXT_MACKEREL_CHECK_TMP_USAGE_CRITICAL" envDefault:"0"`
+
+	logPattern *regexp.Regexp
+}
+
+// Validate compiles the log pattern and checks the thresholds.
+func (c *CheckConfig) Validate() error {
+	for name, threshold := range map[string]int{
+		"EXT_MACKEREL_CHECK_ERROR_WARNING":         c.ErrorWarning,
+		"EXT_MACKEREL_CHECK_ERROR_CRITICAL":        c.ErrorCritical,
+		"EXT_MACKEREL_CHECK_TIMEOUT_WARNING":       c.TimeoutWarning,
+		"EXT_MACKEREL_CHECK_TIMEOUT_CRITICAL":      c.TimeoutCritical,
+		"EXT_MACKEREL_CHECK_INIT_FAILURE_WARNING":  c.InitFailureWarning,
+		"EXT_MACKEREL_CHECK_INIT_FAILURE_CRITICAL": c.InitFailureCritical,
+		"EXT_MACKEREL_CHECK_LOG_PATTERN_WARNING":   c.LogPatternWarning,
+		"EXT_MACKEREL_CHECK_LOG_PATTERN_CRITICAL":  c.LogPatternCritical,
+	} {
+		if threshold < 0 {
+			return fmt.Errorf("%s must not be negative: %d", name, threshold)
+		}
+	}
+
+	for name, threshold := range map[string]float64{
+		"EXT_MACKEREL_CHECK_TMP_USAGE_WARNING":  c.TmpUsageWarning,
+		"EXT_MACKEREL_CHECK_TMP_USAGE_CRITICAL": c.TmpUsageCritical,
+	} {
+		if threshold < 0 || threshold > 100 {
+			return fmt.Errorf("%s must be between 0 and 100: %v", name, threshold)
+		}
+	}
+
+	if c.LogPattern != "" {
+		re, err := regexp.Compile(c.LogPattern)
+		if err != nil {
+			return fmt.Errorf("invalid EXT_MACKEREL_CHECK_LOG_PATTERN: %w", err)
+		}
+		c.logPattern = re
+	}
+	return nil
+}
+
+// checksTmpUsage reports whether the utilization of /tmp is checked.
+func (c *CheckConfig) checksTmpUsage() bool {
+	return c.Enabled && (c.TmpUsageWarning > 0 || c.TmpUsageCritical > 0)
+}
+
+// SubscribesFunctionLogs reports whether function logs are needed to evaluate the checks.
+func (c *CheckConfig) SubscribesFunctionLogs() bool {
+	return c.Enabled && c.LogPattern != ""
+}
@@ -7,24 +7,50 @@ import (
 	"context"
 	"encoding/json"
 	"math"
+	"sort"
 	"time"
 
 	"github.com/golang-collections/go-datastructures/queue"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/collector"
 	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/host"
-	"github.com/mackerelio/go-osstat/loadavg"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
 	"github.com/mackerelio/mackerel-client-go"
 	"github.com/sirupsen/logrus"
 )
 
 type Dispatcher struct {
-	host host.Host
+	host      host.Host
+	sinks     []sink.Sink
+	checkConf *CheckConfig
+	// OnInitStart is called with the platform.initStart event of the environment if set
+	OnInitStart func(initStart *InitStart)
+	// SpanSinks receive the spans of the invocations if set
+	SpanSinks []sink.SpanSink
+	// LogSinks receive the function logs if set
+	LogSinks []sink.LogSink
+	// Sampler samples the stats of the OS and the runtime process on its own cadence if set
+	Sampler *collector.Sampler
+	spans   *spanBuilder
+	logs    *logRecordBuilder
 }
 
 var Logger *logrus.Entry
 
-func NewDispatcher(host host.Host) *Dispatcher {
+func NewDispatcher(host host.Host, sinks []sink.Sink, checkConf *CheckConfig) *Dispatcher {
 	return &Dispatcher{
-		host: host,
+		host:      host,
+		sinks:     sinks,
+		checkConf: checkConf,
+		spans:     newSpanBuilder(),
+		logs:      &logRecordBuilder{},
+	}
+}
+
+// RecordTracing records the tracing header of the invocation received from /event/next.
+// It is used as the trace context of the spans of the invocation.
+func (d *Dispatcher) RecordTracing(requestID string, value string) {
+	if len(d.SpanSinks) > 0 && value != "" {
+		d.spans.recordTracing(requestID, value, time.Now())
 	}
 }
 
@@ -32,23 +58,118 @@ var lastPostedAt time.Time = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
 
 func (d *Dispatcher) Dispatch(ctx context.Context, logEventsQueue *queue.Queue, force bool) {
 	now := time.Now()
-	if !logEventsQueue.Empty() && (force || lastPostedAt.Add(1*time.Minute).Before(now)) {
-		Logger.Info("[Dispatch] Dispatching", logEventsQueue.Len(), "log events")
-		logEntries, _ := logEventsQueue.Get(logEventsQueue.Len())
-		metrics := gatherMetrics(logEntries)
-		metrics = aggregateMetrics(metrics, now)
-		if len(metrics) > 0 {
-			metrics = getOSStat(metrics, now)
-			if err := d.host.PostMetrics(metrics); err != nil {
-				for _, logEntry := range logEntries {
-					logEventsQueue.Put(logEntry)
-				}
-			}
+	if !force && !lastPostedAt.Add(1*time.Minute).Before(now) {
+		return
+	}
+	sampled := d.drainSamples(now, force)
+	if logEventsQueue.Empty() {
+		// the stats and the checks are posted even while no telemetry arrives,
+		// so that the checks of an idle or stuck function keep reporting, e.g. the usage of /tmp, and recover from the errors
+		if len(sampled) > 0 {
+			d.PostMetrics(ctx, sampled)
 			lastPostedAt = now
 		}
+		if d.checkConf.Enabled {
+			d.postCheckReports(nil, now)
+			lastPostedAt = now
+		}
+		return
+	}
+	Logger.Info("[Dispatch] Dispatching", logEventsQueue.Len(), "log events")
+	logEntries, _ := logEventsQueue.Get(logEventsQueue.Len())
+	if d.OnInitStart != nil {
+		for _, initStart := range gatherInitStarts(logEntries) {
+			d.OnInitStart(initStart)
+		}
+	}
+	if len(d.SpanSinks) > 0 {
+		spans := d.spans.build(logEntries, now)
+		for _, s := range d.SpanSinks {
+			if err := s.SendSpans(ctx, spans); err != nil {
+				Logger.Warning("Failed to send spans to", s.Name(), ":", err)
+			}
+		}
+	}
+	if len(d.LogSinks) > 0 {
+		records := d.logs.build(logEntries)
+		for _, s := range d.LogSinks {
+			if err := s.SendLogs(ctx, records); err != nil {
+				Logger.Warning("Failed to send logs to", s.Name(), ":", err)
+			}
+		}
+	}
+	metrics := append(BuildMetrics(logEntries, now), sampled...)
+	if len(metrics) > 0 {
+		d.PostMetrics(ctx, metrics)
+		lastPostedAt = now
+	}
+	if d.checkConf.Enabled {
+		d.postCheckReports(logEntries, now)
+	}
+}
+
+// postCheckReports evaluates the checks on the log entries dispatched at now. No entries report no occurrences.
+func (d *Dispatcher) postCheckReports(logEntries []interface{}, now time.Time) {
+	reports := gatherChecks(logEntries, d.checkConf, now)
+	if d.checkConf.checksTmpUsage() {
+		if report := checkTmpUsage(d.checkConf, now); report != nil {
+			reports = append(reports, report)
+		}
+	}
+	if err := d.host.PostCheckReports(reports); err != nil {
+		Logger.Warning("Failed to post check reports:", err)
+	}
+}
+
+// drainSamples returns the metrics sampled since the previous dispatch.
+// The forced dispatch on shutdown samples once more since the environment won't be thawed again.
+func (d *Dispatcher) drainSamples(now time.Time, force bool) []*mackerel.MetricValue {
+	if d.Sampler == nil {
+		return nil
+	}
+	if force {
+		d.Sampler.Sample(now)
+	}
+	return d.Sampler.Drain()
+}
+
+// BuildMetrics aggregates the metrics of the log entries dispatched at now. The stats of the OS are not included.
+func BuildMetrics(logEntries []interface{}, now time.Time) []*mackerel.MetricValue {
+	metrics := gatherMetrics(logEntries)
+	metrics = aggregateMetrics(metrics, now)
+	if len(metrics) > 0 {
+		metrics = append(metrics, countEvents(logEntries, now)...)
+	}
+	return metrics
+}
+
+// PostMetrics sends the metrics to all the sinks. Each sink retries and keeps the failed metrics by itself.
+func (d *Dispatcher) PostMetrics(ctx context.Context, metrics []*mackerel.MetricValue) {
+	for _, s := range d.sinks {
+		if err := s.Send(ctx, metrics); err != nil {
+			Logger.Warning("Failed to send metrics to", s.Name(), ":", err)
+		}
 	}
 }
 
+// Flush sends the metrics and the logs queued in all the sinks
+func (d *Dispatcher) Flush(ctx context.Context) error {
+	var lastErr error
+	for _, s := range d.sinks {
+		if err := s.Flush(ctx); err != nil {
+			Logger.Warning("Failed to flush metrics to", s.Name(), ":", err)
+			lastErr = err
+		}
+	}
+	for _, s := range d.LogSinks {
+		if err := s.Flush(ctx); err != nil {
+			Logger.Warning("Failed to flush logs to", s.Name(), ":", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
 type platformInitReportRecordMetrics struct {
 	DurationMs float64 `json:"durationMs"`
 }
@@ -60,6 +181,26 @@ type platformInitReport struct {
 	Time   time.Time                `json:"time"`
 }
 
+type platformInitStartRecord struct {
+	FunctionVersion    string `json:"functionVersion"`
+	InitializationType string `json:"initializationType"`
+	Phase              string `json:"phase"`
+	RuntimeVersion     string `json:"runtimeVersion"`
+	RuntimeVersionArn  string `json:"runtimeVersionArn"`
+}
+type platformInitStart struct {
+	Record platformInitStartRecord `json:"record"`
+	Time   time.Time               `json:"time"`
+}
+
+// InitStart is the initialization of the runtime environment reported by platform.initStart
+type InitStart struct {
+	FunctionVersion    string
+	InitializationType string
+	RuntimeVersion     string
+	Time               time.Time
+}
+
 type platformReportRecordMetrics struct {
 	BilledDurationMs float64 `json:"billedDurationMs"`
 	DurationMs       float64 `json:"durationMs"`
@@ -81,12 +222,35 @@ type platformRuntimeDoneRecordMetrics struct {
 }
 type platformRuntimeDoneRecord struct {
 	Metrics platformRuntimeDoneRecordMetrics `json:"metrics"`
+	Status  string                           `json:"status"`
 }
 type platformRuntimeDone struct {
 	Record platformRuntimeDoneRecord `json:"record"`
 	Time   time.Time                 `json:"time"`
 }
 
+func gatherInitStarts(logEntries []interface{}) []*InitStart {
+	initStarts := make([]*InitStart, 0, 1)
+	for _, logEntry := range logEntries {
+		if logEntry.(map[string]interface{})["type"] != "platform.initStart" {
+			continue
+		}
+		s, _ := json.Marshal(logEntry)
+		entry := &platformInitStart{}
+		if err := json.Unmarshal(s, &entry); err != nil {
+			Logger.Warning("Can't unmarshal platform.initStart:", err)
+			continue
+		}
+		initStarts = append(initStarts, &InitStart{
+			FunctionVersion:    entry.Record.FunctionVersion,
+			InitializationType: entry.Record.InitializationType,
+			RuntimeVersion:     entry.Record.RuntimeVersion,
+			Time:               entry.Time,
+		})
+	}
+	return initStarts
+}
+
 func gatherMetrics(logEntries []interface{}) []*mackerel.MetricValue {
 	metrics := make([]*mackerel.MetricValue, 0, 8)
 	for _, logEntry := range logEntries {
@@ -144,6 +308,16 @@ func gatherMetrics(logEntries []interface{}) []*mackerel.MetricValue {
 					Value: entry.Record.Metrics.MemorySizeMB * 1024.0 * 1024.0,
 				},
 			)
+			if entry.Record.Metrics.MemorySizeMB > 0 {
+				metrics = append(
+					metrics,
+					&mackerel.MetricValue{
+						Name:  "custom.lambda.platform.report.memoryUtilization",
+						Time:  entry.Time.Unix(),
+						Value: entry.Record.Metrics.MaxMemoryUsedMB / entry.Record.Metrics.MemorySizeMB * 100.0,
+					},
+				)
+			}
 
 		case "platform.runtimeDone":
 			s, _ := json.Marshal(logEntry)
@@ -175,6 +349,11 @@ func gatherMetrics(logEntries []interface{}) []*mackerel.MetricValue {
 	return metrics
 }
 
+// percentileMetricNames are the metrics whose 99th percentile is posted in addition to avg, max and min
+var percentileMetricNames = map[string]bool{
+	"custom.lambda.platform.report.duration": true,
+}
+
 func aggregateMetrics(metrics []*mackerel.MetricValue, now time.Time) []*mackerel.MetricValue {
 	collectedMetricsMap := make(map[string][]*mackerel.MetricValue)
 	for _, metric := range metrics {
@@ -197,7 +376,7 @@ func aggregateMetrics(metrics []*mackerel.MetricValue, now time.Time) []*mackere
 		for _, metric := range ms {
 			sumValue += metric.Value.(float64)
 			maxValue = math.Max(maxValue, metric.Value.(float64))
-			minValue = math.Min(maxValue, metric.Value.(float64))
+			minValue = math.Min(minValue, metric.Value.(float64))
 		}
 		aggregatedMetrics = append(
 			aggregatedMetrics,
@@ -217,35 +396,84 @@ func aggregateMetrics(metrics []*mackerel.MetricValue, now time.Time) []*mackere
 				Value: minValue,
 			},
 		)
+		if percentileMetricNames[metricName] {
+			aggregatedMetrics = append(
+				aggregatedMetrics,
+				&mackerel.MetricValue{
+					Name:  metricName + ".p99",
+					Time:  now.Unix(),
+					Value: percentile(ms, 99),
+				},
+			)
+		}
 	}
 	return aggregatedMetrics
 }
 
-func getOSStat(metrics []*mackerel.MetricValue, now time.Time) []*mackerel.MetricValue {
-	loadavgStat, err := loadavg.Get()
-	if err != nil {
-		Logger.Warning("Failed to get loadavg:", err)
-		return metrics
+// percentile returns the nearest-rank percentile of the metric values
+func percentile(metrics []*mackerel.MetricValue, p float64) float64 {
+	values := make([]float64, 0, len(metrics))
+	for _, metric := range metrics {
+		values = append(values, metric.Value.(float64))
 	}
+	sort.Float64s(values)
+	rank := int(math.Ceil(p / 100.0 * float64(len(values))))
+	if rank < 1 {
+		rank = 1
+	}
+	return values[rank-1]
+}
 
-	metrics = append(
-		metrics,
-		&mackerel.MetricValue{
-			Name:  "custom.lambda.osstat.loadavg.loadavg1",
+// countEvents counts the invocations and the failed ones among them from platform.runtimeDone events,
+// the reports from platform.report events, and the cold starts from platform.initStart events.
+// The counts of the reports and the invocations are the numbers of the samples of the report and runtimeDone families.
+func countEvents(logEntries []interface{}, now time.Time) []*mackerel.MetricValue {
+	var count, errors, reports, coldStarts float64
+	for _, logEntry := range logEntries {
+		switch logEntry.(map[string]interface{})["type"] {
+		case "platform.report":
+			s, _ := json.Marshal(logEntry)
+			entry := &platformReport{}
+			if err := json.Unmarshal(s, &entry); err != nil {
+				continue
+			}
+			reports++
+
+		case "platform.runtimeDone":
+			s, _ := json.Marshal(logEntry)
+			entry := &platformRuntimeDone{}
+			if err := json.Unmarshal(s, &entry); err != nil {
+				continue
+			}
+			count++
+			if entry.Record.Status != "success" {
+				errors++
+			}
+
+		case "platform.initStart":
+			coldStarts++
+		}
+	}
+	return []*mackerel.MetricValue{
+		{
+			Name:  "custom.lambda.platform.runtimeDone.invocations.count",
 			Time:  now.Unix(),
-			Value: loadavgStat.Loadavg1,
+			Value: count,
 		},
-		&mackerel.MetricValue{
-			Name:  "custom.lambda.osstat.loadavg.loadavg5",
+		{
+			Name:  "custom.lambda.platform.runtimeDone.invocations.errors",
 			Time:  now.Unix(),
-			Value: loadavgStat.Loadavg5,
+			Value: errors,
 		},
-		&mackerel.MetricValue{
-			Name:  "custom.lambda.osstat.loadavg.loadavg15",
+		{
+			Name:  "custom.lambda.platform.report.count",
 			Time:  now.Unix(),
-			Value: loadavgStat.Loadavg15,
+			Value: reports,
 		},
-	)
-
-	return metrics
+		{
+			Name:  "custom.lambda.platform.initStart.count",
+			Time:  now.Unix(),
+			Value: coldStarts,
+		},
+	}
 }
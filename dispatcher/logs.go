@@ -0,0 +1,76 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
+)
+
+type functionLog struct {
+	Time   time.Time   `json:"time"`
+	Record interface{} `json:"record"`
+}
+
+// logRecordBuilder turns the function logs into records.
+// The lines in the text format are attributed to the invocation started last by platform.start,
+// which is kept across the dispatches since the logs may be delivered in a later batch.
+type logRecordBuilder struct {
+	mu               sync.Mutex
+	currentRequestID string
+}
+
+func (b *logRecordBuilder) build(logEntries []interface{}) []*sink.LogRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	records := make([]*sink.LogRecord, 0, len(logEntries))
+	for _, logEntry := range logEntries {
+		switch logEntry.(map[string]interface{})["type"] {
+		case "platform.start":
+			s, _ := json.Marshal(logEntry)
+			entry := &platformStart{}
+			if err := json.Unmarshal(s, &entry); err != nil {
+				Logger.Warning("Can't unmarshal platform.start:", err)
+				continue
+			}
+			b.currentRequestID = entry.Record.RequestID
+
+		case "platform.runtimeDone":
+			b.currentRequestID = ""
+
+		case "function":
+			s, _ := json.Marshal(logEntry)
+			entry := &functionLog{}
+			if err := json.Unmarshal(s, &entry); err != nil {
+				Logger.Warning("Can't unmarshal function:", err)
+				continue
+			}
+			record := &sink.LogRecord{Time: entry.Time, RequestID: b.currentRequestID}
+			switch r := entry.Record.(type) {
+			case string:
+				record.Message = r
+			case map[string]interface{}:
+				// the JSON log format
+				if requestID, ok := r["requestId"].(string); ok {
+					record.RequestID = requestID
+				}
+				if level, ok := r["level"].(string); ok {
+					record.Level = level
+				}
+				if message, ok := r["message"].(string); ok {
+					record.Message = message
+				} else {
+					m, _ := json.Marshal(r)
+					record.Message = string(m)
+				}
+			default:
+				m, _ := json.Marshal(r)
+				record.Message = string(m)
+			}
+			records = append(records, record)
+		}
+	}
+	return records
+}
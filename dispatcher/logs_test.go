@@ -0,0 +1,61 @@
+package dispatcher
+
+import (
+	"sync"
+	"testing"
+)
+
+func functionEvent(record interface{}) map[string]interface{} {
+	return map[string]interface{}{"time": "2024-01-02T03:04:05.000Z", "type": "function", "record": record}
+}
+
+func TestLogRecordBuilderAttributesLinesAcrossBatches(t *testing.T) {
+	b := &logRecordBuilder{}
+	first := b.build([]interface{}{
+		map[string]interface{}{"time": "2024-01-02T03:04:05.000Z", "type": "platform.start", "record": map[string]interface{}{"requestId": "request-1"}},
+		functionEvent("hello"),
+	})
+	// the rest of the logs of the invocation are delivered in the next batch
+	second := b.build([]interface{}{
+		functionEvent(map[string]interface{}{"requestId": "request-2", "level": "ERROR", "message": "failed"}),
+		functionEvent("world"),
+		map[string]interface{}{"time": "2024-01-02T03:04:06.000Z", "type": "platform.runtimeDone", "record": map[string]interface{}{"requestId": "request-1"}},
+		functionEvent("idle"),
+	})
+
+	records := append(first, second...)
+	want := []struct{ requestID, level, message string }{
+		{"request-1", "", "hello"},
+		{"request-2", "ERROR", "failed"},
+		{"request-1", "", "world"},
+		{"", "", "idle"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("records = %d, want %d", len(records), len(want))
+	}
+	for i, w := range want {
+		r := records[i]
+		if r.RequestID != w.requestID || r.Level != w.level || r.Message != w.message {
+			t.Errorf("records[%d] = %+v, want %+v", i, r, w)
+		}
+	}
+}
+
+// TestLogRecordBuilderIsSafeForConcurrentDispatches runs the builds of the ticker and of the main loop at once, for go test -race
+func TestLogRecordBuilderIsSafeForConcurrentDispatches(t *testing.T) {
+	b := &logRecordBuilder{}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				b.build([]interface{}{
+					map[string]interface{}{"type": "platform.start", "record": map[string]interface{}{"requestId": "request"}},
+					functionEvent("hello"),
+				})
+			}
+		}()
+	}
+	wg.Wait()
+}
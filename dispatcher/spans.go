@@ -0,0 +1,266 @@
+package dispatcher
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
+)
+
+// pendingSpanTTL is how long the start of an invocation waits for its end. It's the maximum timeout of Lambda.
+const pendingSpanTTL = 15 * time.Minute
+
+type telemetrySpan struct {
+	Name       string    `json:"name"`
+	Start      time.Time `json:"start"`
+	DurationMs float64   `json:"durationMs"`
+}
+
+type telemetryTracing struct {
+	SpanID string `json:"spanId"`
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+}
+
+type platformStartRecord struct {
+	RequestID string           `json:"requestId"`
+	Version   string           `json:"version"`
+	Tracing   telemetryTracing `json:"tracing"`
+}
+type platformStart struct {
+	Record platformStartRecord `json:"record"`
+	Time   time.Time           `json:"time"`
+}
+
+type platformRuntimeDoneSpansRecord struct {
+	RequestID string                           `json:"requestId"`
+	Status    string                           `json:"status"`
+	Metrics   platformRuntimeDoneRecordMetrics `json:"metrics"`
+	Spans     []telemetrySpan                  `json:"spans"`
+	Tracing   telemetryTracing                 `json:"tracing"`
+}
+type platformRuntimeDoneSpans struct {
+	Record platformRuntimeDoneSpansRecord `json:"record"`
+	Time   time.Time                      `json:"time"`
+}
+
+type platformInitRuntimeDoneSpansRecord struct {
+	InitializationType string          `json:"initializationType"`
+	Status             string          `json:"status"`
+	Spans              []telemetrySpan `json:"spans"`
+}
+type platformInitRuntimeDoneSpans struct {
+	Record platformInitRuntimeDoneSpansRecord `json:"record"`
+	Time   time.Time                          `json:"time"`
+}
+
+type pendingTracing struct {
+	value      string
+	recordedAt time.Time
+}
+
+type pendingStart struct {
+	start   time.Time
+	tracing string
+}
+
+type pendingInit struct {
+	start              time.Time
+	end                time.Time
+	initializationType string
+	status             string
+	spans              []telemetrySpan
+	done               bool
+}
+
+// spanBuilder builds the spans of invocations from the Telemetry API events.
+// The start and the end of an invocation may be dispatched separately, so the starts are kept until their ends arrive.
+type spanBuilder struct {
+	mu       sync.Mutex
+	tracings map[string]*pendingTracing
+	starts   map[string]*pendingStart
+	init     *pendingInit
+}
+
+func newSpanBuilder() *spanBuilder {
+	return &spanBuilder{
+		tracings: make(map[string]*pendingTracing),
+		starts:   make(map[string]*pendingStart),
+	}
+}
+
+func (b *spanBuilder) recordTracing(requestID string, value string, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tracings[requestID] = &pendingTracing{value: value, recordedAt: now}
+}
+
+func (b *spanBuilder) build(logEntries []interface{}, now time.Time) []*sink.Span {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	spans := make([]*sink.Span, 0)
+	for _, logEntry := range logEntries {
+		switch logEntry.(map[string]interface{})["type"] {
+		case "platform.initStart":
+			s, _ := json.Marshal(logEntry)
+			entry := &platformInitStart{}
+			if err := json.Unmarshal(s, &entry); err != nil {
+				continue
+			}
+			b.init = &pendingInit{start: entry.Time, initializationType: entry.Record.InitializationType}
+
+		case "platform.initRuntimeDone":
+			s, _ := json.Marshal(logEntry)
+			entry := &platformInitRuntimeDoneSpans{}
+			if err := json.Unmarshal(s, &entry); err != nil || b.init == nil {
+				continue
+			}
+			b.init.end = entry.Time
+			b.init.status = entry.Record.Status
+			b.init.spans = entry.Record.Spans
+			b.init.done = true
+
+		case "platform.start":
+			s, _ := json.Marshal(logEntry)
+			entry := &platformStart{}
+			if err := json.Unmarshal(s, &entry); err != nil {
+				continue
+			}
+			b.starts[entry.Record.RequestID] = &pendingStart{start: entry.Time, tracing: entry.Record.Tracing.Value}
+
+		case "platform.runtimeDone":
+			s, _ := json.Marshal(logEntry)
+			entry := &platformRuntimeDoneSpans{}
+			if err := json.Unmarshal(s, &entry); err != nil {
+				continue
+			}
+			spans = append(spans, b.buildInvocation(entry)...)
+		}
+	}
+
+	for requestID, start := range b.starts {
+		if now.Sub(start.start) > pendingSpanTTL {
+			delete(b.starts, requestID)
+		}
+	}
+	for requestID, tracing := range b.tracings {
+		if now.Sub(tracing.recordedAt) > pendingSpanTTL {
+			delete(b.tracings, requestID)
+		}
+	}
+	return spans
+}
+
+func (b *spanBuilder) buildInvocation(entry *platformRuntimeDoneSpans) []*sink.Span {
+	requestID := entry.Record.RequestID
+	duration := time.Duration(entry.Record.Metrics.DurationMs * float64(time.Millisecond))
+
+	start := entry.Time.Add(-duration)
+	tracing := entry.Record.Tracing.Value
+	if pending, ok := b.starts[requestID]; ok {
+		start = pending.start
+		if pending.tracing != "" {
+			tracing = pending.tracing
+		}
+		delete(b.starts, requestID)
+	}
+	if pending, ok := b.tracings[requestID]; ok {
+		tracing = pending.value
+		delete(b.tracings, requestID)
+	}
+
+	traceID, parentSpanID, ok := parseTraceContext(tracing)
+	if !ok {
+		traceID, parentSpanID = randomHex(16), ""
+	}
+
+	root := &sink.Span{
+		TraceID:      traceID,
+		SpanID:       randomHex(8),
+		ParentSpanID: parentSpanID,
+		Name:         "invoke",
+		Start:        start,
+		End:          start.Add(duration),
+		Attributes: map[string]string{
+			"faas.invocation_id": requestID,
+			"faas.status":        entry.Record.Status,
+		},
+		Failed: entry.Record.Status != "success",
+	}
+	spans := []*sink.Span{root}
+	spans = append(spans, childSpans(root, entry.Record.Spans)...)
+
+	if b.init != nil && b.init.done {
+		initSpan := &sink.Span{
+			TraceID:      traceID,
+			SpanID:       randomHex(8),
+			ParentSpanID: parentSpanID,
+			Name:         "init",
+			Start:        b.init.start,
+			End:          b.init.end,
+			Attributes: map[string]string{
+				"faas.coldstart":           "true",
+				"faas.initialization_type": b.init.initializationType,
+				"faas.status":              b.init.status,
+			},
+			Failed: b.init.status != "" && b.init.status != "success",
+		}
+		spans = append(spans, initSpan)
+		spans = append(spans, childSpans(initSpan, b.init.spans)...)
+		b.init = nil
+	}
+	return spans
+}
+
+func childSpans(parent *sink.Span, telemetrySpans []telemetrySpan) []*sink.Span {
+	spans := make([]*sink.Span, 0, len(telemetrySpans))
+	for _, s := range telemetrySpans {
+		spans = append(spans, &sink.Span{
+			TraceID:      parent.TraceID,
+			SpanID:       randomHex(8),
+			ParentSpanID: parent.SpanID,
+			Name:         s.Name,
+			Start:        s.Start,
+			End:          s.Start.Add(time.Duration(s.DurationMs * float64(time.Millisecond))),
+		})
+	}
+	return spans
+}
+
+// parseTraceContext returns the trace ID and the parent span ID in hex from an X-Amzn-Trace-Id header value
+// (Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1) or a W3C traceparent value.
+func parseTraceContext(value string) (string, string, bool) {
+	if value == "" {
+		return "", "", false
+	}
+	if parts := strings.Split(value, "-"); len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		return parts[1], parts[2], true
+	}
+
+	var traceID, parentSpanID string
+	for _, field := range strings.Split(value, ";") {
+		key, val, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch key {
+		case "Root":
+			root := strings.Split(val, "-")
+			if len(root) != 3 || len(root[1])+len(root[2]) != 32 {
+				return "", "", false
+			}
+			traceID = root[1] + root[2]
+		case "Parent":
+			parentSpanID = val
+		}
+	}
+	return traceID, parentSpanID, traceID != ""
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -3,10 +3,13 @@ module github.com/mackerelio-labs/mackerel-lambda-extension-agent
 go 1.19
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/aws/aws-sdk-go v1.44.158
 	github.com/caarlos0/env/v6 v6.10.1
+	github.com/golang/snappy v0.0.4
 	github.com/mackerelio/mackerel-client-go v0.23.0
 	github.com/sirupsen/logrus v1.9.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,135 @@
+package mackerel
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+const coldStartBurstTitle = "Cold start burst"
+
+// versionsAnnotationWindow is the period searched for the annotation of the same versions posted by another environment,
+// which saw them for the first time at the same moment, e.g. on the cold starts right after a deployment
+const versionsAnnotationWindow = 10 * time.Minute
+
+// AnnotateInitStart posts graph annotations on the services when the function version or the runtime version
+// is seen for the first time on the role, and when the cold starts in the role reach the burst threshold.
+func (h *Host) AnnotateInitStart(conf *AnnotationConfig, roleFullnames []string, functionVersion string, runtimeVersion string, at time.Time) error {
+	if !conf.Enabled {
+		return nil
+	}
+	for _, roleFullname := range roleFullnames {
+		service, role, err := splitRoleFullname(roleFullname)
+		if err != nil {
+			return err
+		}
+		if err := h.annotateVersions(service, role, functionVersion, runtimeVersion, at); err != nil {
+			return err
+		}
+		if conf.ColdStartBurstThreshold > 0 {
+			if err := h.annotateColdStartBurst(conf, service, role, at); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (h *Host) annotateVersions(service string, role string, functionVersion string, runtimeVersion string, at time.Time) error {
+	md := &versionsMetaData{}
+	if err := getRoleMetaData(h.client, service, role, versionsNamespace, md); err != nil {
+		return err
+	}
+
+	changes := make([]string, 0, 2)
+	if functionVersion != "" && !containsString(md.FunctionVersions, functionVersion) {
+		changes = append(changes, "function version "+functionVersion)
+	}
+	if runtimeVersion != "" && !containsString(md.RuntimeVersions, runtimeVersion) {
+		changes = append(changes, "runtime version "+runtimeVersion)
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	title := "Deployed " + strings.Join(changes, ", ")
+	annotations, err := h.client.FindGraphAnnotations(service, at.Add(-versionsAnnotationWindow).Unix(), at.Add(versionsAnnotationWindow).Unix())
+	if err != nil {
+		return err
+	}
+	annotated := false
+	for _, annotation := range annotations {
+		if annotation.Title == title && containsString(annotation.Roles, role) {
+			annotated = true
+			break
+		}
+	}
+	if !annotated {
+		Logger.Info("annotating", strings.Join(changes, ", "))
+		if _, err := h.client.CreateGraphAnnotation(&mackerel.GraphAnnotation{
+			Title:       title,
+			Description: fmt.Sprintf("First seen on %s:%s by host %s", service, role, h.currentID()),
+			From:        at.Unix(),
+			To:          at.Unix(),
+			Service:     service,
+			Roles:       []string{role},
+		}); err != nil {
+			return err
+		}
+	}
+
+	// the versions are recorded only after the annotation, so a failed annotation is retried by the next cold start.
+	// They are added to the latest metadata not to drop the versions recorded by other environments in the meantime.
+	latest := &versionsMetaData{}
+	if err := getRoleMetaData(h.client, service, role, versionsNamespace, latest); err != nil {
+		return err
+	}
+	if functionVersion != "" && !containsString(latest.FunctionVersions, functionVersion) {
+		latest.FunctionVersions = appendVersion(latest.FunctionVersions, functionVersion)
+	}
+	if runtimeVersion != "" && !containsString(latest.RuntimeVersions, runtimeVersion) {
+		latest.RuntimeVersions = appendVersion(latest.RuntimeVersions, runtimeVersion)
+	}
+	return putRoleMetaData(h.client, service, role, versionsNamespace, latest)
+}
+
+func (h *Host) annotateColdStartBurst(conf *AnnotationConfig, service string, role string, at time.Time) error {
+	from := at.Add(-conf.ColdStartBurstWindow)
+
+	hosts, err := h.client.FindHosts(&mackerel.FindHostsParam{Service: service, Roles: []string{role}})
+	if err != nil {
+		return err
+	}
+	coldStarts := 0
+	for _, host := range hosts {
+		if !host.DateFromCreatedAt().Before(from) {
+			coldStarts++
+		}
+	}
+	if coldStarts < conf.ColdStartBurstThreshold {
+		return nil
+	}
+
+	annotations, err := h.client.FindGraphAnnotations(service, from.Unix(), at.Unix())
+	if err != nil {
+		return err
+	}
+	for _, annotation := range annotations {
+		if annotation.Title == coldStartBurstTitle && containsString(annotation.Roles, role) {
+			return nil
+		}
+	}
+
+	Logger.Info("annotating cold start burst")
+	_, err = h.client.CreateGraphAnnotation(&mackerel.GraphAnnotation{
+		Title:       coldStartBurstTitle,
+		Description: fmt.Sprintf("%d environments started within %s", coldStarts, conf.ColdStartBurstWindow),
+		From:        from.Unix(),
+		To:          at.Unix(),
+		Service:     service,
+		Roles:       []string{role},
+	})
+	return err
+}
@@ -0,0 +1,112 @@
+package mackerel
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/host/mackerel/mackereltest"
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+func newTestAnnotatingHost(t *testing.T) (*mackereltest.Server, *Host) {
+	server := newTestServer(t)
+	host, err := CreateOrGetHost(newTestHostParam())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, host
+}
+
+func TestAnnotateInitStartAnnotatesNewVersionsOnce(t *testing.T) {
+	server, host := newTestAnnotatingHost(t)
+	conf := &AnnotationConfig{Enabled: true}
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if err := host.AnnotateInitStart(conf, []string{"lambda:sample-function"}, "3", "python:3.11.v1", now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	annotations := server.GraphAnnotations()
+	if len(annotations) != 1 || annotations[0].Title != "Deployed function version 3, runtime version python:3.11.v1" {
+		t.Fatalf("annotations = %+v, want one for the new versions", annotations)
+	}
+
+	var versions versionsMetaData
+	if err := json.Unmarshal(server.RoleMetadata("lambda", "sample-function", versionsNamespace), &versions); err != nil {
+		t.Fatal(err)
+	}
+	want := versionsMetaData{FunctionVersions: []string{"3"}, RuntimeVersions: []string{"python:3.11.v1"}}
+	if !reflect.DeepEqual(versions, want) {
+		t.Errorf("versions = %+v, want %+v", versions, want)
+	}
+}
+
+func TestAnnotateInitStartSkipsAnnotationOfAnotherEnvironment(t *testing.T) {
+	server, host := newTestAnnotatingHost(t)
+	conf := &AnnotationConfig{Enabled: true}
+	now := time.Now()
+
+	// another environment saw the version a moment ago, and hasn't recorded it in the metadata yet
+	if _, err := host.client.CreateGraphAnnotation(&mackerel.GraphAnnotation{
+		Title:   "Deployed function version 4",
+		From:    now.Add(-time.Second).Unix(),
+		To:      now.Add(-time.Second).Unix(),
+		Service: "lambda",
+		Roles:   []string{"sample-function"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// the same title long ago, e.g. before the version was forgotten, doesn't count
+	if _, err := host.client.CreateGraphAnnotation(&mackerel.GraphAnnotation{
+		Title:   "Deployed function version 5",
+		From:    now.Add(-24 * time.Hour).Unix(),
+		To:      now.Add(-24 * time.Hour).Unix(),
+		Service: "lambda",
+		Roles:   []string{"sample-function"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := host.AnnotateInitStart(conf, []string{"lambda:sample-function"}, "4", "", now); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(server.GraphAnnotations()); n != 2 {
+		t.Errorf("annotations = %d, want no duplicate of the annotation within the window", n)
+	}
+	if err := host.AnnotateInitStart(conf, []string{"lambda:sample-function"}, "5", "", now); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(server.GraphAnnotations()); n != 3 {
+		t.Errorf("annotations = %d, want a new one beyond the window", n)
+	}
+
+	var versions versionsMetaData
+	if err := json.Unmarshal(server.RoleMetadata("lambda", "sample-function", versionsNamespace), &versions); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(versions.FunctionVersions, []string{"4", "5"}) {
+		t.Errorf("function versions = %v, want recorded without the annotation", versions.FunctionVersions)
+	}
+}
+
+func TestAnnotateInitStartKeepsOtherNamespaces(t *testing.T) {
+	server, host := newTestAnnotatingHost(t)
+	lock := &reaperLockMetaData{LockedUntil: time.Now().Add(time.Hour).Unix(), LockedBy: "another-host"}
+	if err := putRoleMetaData(host.client, "lambda", "sample-function", reaperLockNamespace, lock); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := host.AnnotateInitStart(&AnnotationConfig{Enabled: true}, []string{"lambda:sample-function"}, "6", "", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	var locked reaperLockMetaData
+	if err := json.Unmarshal(server.RoleMetadata("lambda", "sample-function", reaperLockNamespace), &locked); err != nil {
+		t.Fatal(err)
+	}
+	if locked != *lock {
+		t.Errorf("lock = %+v, want %+v kept by the annotation", locked, *lock)
+	}
+}
@@ -0,0 +1,44 @@
+package mackerel
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const defaultAPIBase = "https://api.mackerelio.com/"
+
+// apiBase is the base URL of the Mackerel API used by all the clients of the package
+var apiBase = defaultAPIBase
+
+// UseAPIBase makes all the clients created afterwards call the Mackerel API at rawurl, e.g. a fake for testing
+func UseAPIBase(rawurl string) error {
+	if rawurl == "" {
+		rawurl = defaultAPIBase
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return fmt.Errorf("invalid EXT_MACKEREL_API_BASE: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid EXT_MACKEREL_API_BASE: %s, must be an http or https URL", rawurl)
+	}
+	apiBase = rawurl
+	return nil
+}
+
+// DashboardURL returns the URL of the custom dashboard at urlPath on the web console of the API base.
+// The console of api.mackerelio.com is mackerel.io, and the console of another API base is assumed to drop the "api." of its host.
+func DashboardURL(urlPath string) string {
+	u, err := url.Parse(apiBase)
+	if err != nil {
+		u, _ = url.Parse(defaultAPIBase)
+	}
+	host := u.Host
+	if host == "api.mackerelio.com" {
+		host = "mackerel.io"
+	} else {
+		host = strings.TrimPrefix(host, "api.")
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: host, Path: "/my/dashboards/" + urlPath}).String()
+}
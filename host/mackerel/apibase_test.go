@@ -0,0 +1,24 @@
+package mackerel
+
+import "testing"
+
+func TestDashboardURL(t *testing.T) {
+	defer UseAPIBase("")
+	tests := []struct {
+		apiBase string
+		want    string
+	}{
+		{"", "https://mackerel.io/my/dashboards/lambda-sample"},
+		{"https://api.mackerelio.com/", "https://mackerel.io/my/dashboards/lambda-sample"},
+		{"https://api.example.com/mackerel/", "https://example.com/my/dashboards/lambda-sample"},
+		{"http://127.0.0.1:8080", "http://127.0.0.1:8080/my/dashboards/lambda-sample"},
+	}
+	for _, tt := range tests {
+		if err := UseAPIBase(tt.apiBase); err != nil {
+			t.Fatal(err)
+		}
+		if got := DashboardURL("lambda-sample"); got != tt.want {
+			t.Errorf("DashboardURL with %q = %s, want %s", tt.apiBase, got, tt.want)
+		}
+	}
+}
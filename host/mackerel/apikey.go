@@ -0,0 +1,128 @@
+package mackerel
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// minRefetchInterval limits the fetches triggered by rejected requests, in case the stored API key itself is wrong
+const minRefetchInterval = 30 * time.Second
+
+// APIKeyRotator keeps the API key fetched from a secret store.
+// The key is fetched again when the refresh interval has passed or Mackerel rejects it, so that the rotation of the key is followed.
+type APIKeyRotator struct {
+	fetch           func() (string, error)
+	refreshInterval time.Duration
+	mu              sync.Mutex
+	apiKey          string
+	fetchedAt       time.Time
+}
+
+// apiKeyRotator is used by all the clients of the package if set
+var apiKeyRotator *APIKeyRotator
+
+// UseAPIKeyRotator makes all the clients created afterwards follow the rotation of the API key
+func UseAPIKeyRotator(r *APIKeyRotator) {
+	apiKeyRotator = r
+}
+
+// NewAPIKeyRotator returns a rotator of apiKey, which has been fetched by fetch just now.
+// The key is refreshed periodically unless refreshInterval is 0.
+func NewAPIKeyRotator(apiKey string, fetch func() (string, error), refreshInterval time.Duration) *APIKeyRotator {
+	return &APIKeyRotator{
+		fetch:           fetch,
+		refreshInterval: refreshInterval,
+		apiKey:          apiKey,
+		fetchedAt:       time.Now(),
+	}
+}
+
+// APIKey returns the current API key, which is fetched again if the refresh interval has passed.
+// The previous key is kept if the fetch fails.
+func (r *APIKeyRotator) APIKey() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.refreshInterval > 0 && time.Since(r.fetchedAt) >= r.refreshInterval {
+		r.refetch()
+	}
+	return r.apiKey
+}
+
+// Rejected fetches the API key again after Mackerel rejected the rejectedKey.
+// It returns the new key, or an empty string if the key has not changed.
+func (r *APIKeyRotator) Rejected(rejectedKey string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.apiKey == rejectedKey && time.Since(r.fetchedAt) >= minRefetchInterval {
+		r.refetch()
+	}
+	if r.apiKey == rejectedKey {
+		return ""
+	}
+	return r.apiKey
+}
+
+func (r *APIKeyRotator) refetch() {
+	apiKey, err := r.fetch()
+	r.fetchedAt = time.Now()
+	if err != nil {
+		Logger.Warning("Failed to fetch the API key, keeping the current one:", err)
+		return
+	}
+	if apiKey != r.apiKey {
+		Logger.Info("the API key is rotated")
+	}
+	r.apiKey = apiKey
+}
+
+// rotatingTransport sets the current API key to the requests, and retries a request rejected with 401 or 403 with the new key
+type rotatingTransport struct {
+	rotator *APIKeyRotator
+	base    http.RoundTripper
+}
+
+func (t *rotatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	apiKey := t.rotator.APIKey()
+	res, err := t.base.RoundTrip(withAPIKey(req, apiKey))
+	if err != nil || (res.StatusCode != http.StatusUnauthorized && res.StatusCode != http.StatusForbidden) {
+		return res, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		// the body has been consumed and can't be sent again
+		return res, nil
+	}
+	newKey := t.rotator.Rejected(apiKey)
+	if newKey == "" {
+		return res, nil
+	}
+
+	retry := withAPIKey(req, newKey)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return res, nil
+		}
+		retry.Body = body
+	}
+	res.Body.Close()
+	Logger.Info("retrying the request with the rotated API key")
+	return t.base.RoundTrip(retry)
+}
+
+func withAPIKey(req *http.Request, apiKey string) *http.Request {
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Api-Key", apiKey)
+	return req
+}
+
+// newClient returns a client of the Mackerel API at apiBase, which follows the rotation of the API key if UseAPIKeyRotator is called
+func newClient(apiKey string) *mackerel.Client {
+	client, _ := mackerel.NewClientWithOptions(apiKey, apiBase, false)
+	if apiKeyRotator != nil {
+		client.HTTPClient.Transport = &rotatingTransport{rotator: apiKeyRotator, base: http.DefaultTransport}
+	}
+	return client
+}
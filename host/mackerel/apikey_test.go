@@ -0,0 +1,155 @@
+package mackerel
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// secretSource is a fake of SSM or Secrets Manager. The key is rotated by setting another one.
+type secretSource struct {
+	mu      sync.Mutex
+	apiKey  string
+	err     error
+	fetches int
+}
+
+func (s *secretSource) rotate(apiKey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apiKey = apiKey
+}
+
+func (s *secretSource) fetch() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetches++
+	return s.apiKey, s.err
+}
+
+// useTestRotator makes the clients of the package use a rotator of the source's current key fetched at fetchedAt
+func useTestRotator(t *testing.T, source *secretSource, refreshInterval time.Duration, fetchedAt time.Time) *APIKeyRotator {
+	r := NewAPIKeyRotator(source.apiKey, source.fetch, refreshInterval)
+	r.fetchedAt = fetchedAt
+	UseAPIKeyRotator(r)
+	t.Cleanup(func() { UseAPIKeyRotator(nil) })
+	return r
+}
+
+func TestRotatingTransportRetriesWithRotatedKey(t *testing.T) {
+	server := newTestServer(t)
+	server.APIKey = "old-api-key"
+	source := &secretSource{apiKey: "old-api-key"}
+	useTestRotator(t, source, 0, time.Now().Add(-time.Hour))
+	client := newClient("old-api-key")
+	if err := client.CreateGraphDefs(GraphDefs); err != nil {
+		t.Fatal(err)
+	}
+
+	// the key is rotated in the secret store, and the old one is revoked
+	source.rotate("new-api-key")
+	server.APIKey = "new-api-key"
+	if err := client.CreateGraphDefs(GraphDefs); err != nil {
+		t.Fatalf("err = %v, want the request retried with the rotated key", err)
+	}
+	if source.fetches != 1 {
+		t.Errorf("fetches = %d, want 1 on the rejection", source.fetches)
+	}
+	if n := countRequests(server, http.MethodPost, "/api/v0/graph-defs/create", http.StatusForbidden); n != 1 {
+		t.Errorf("rejected requests = %d, want 1", n)
+	}
+	// the body of the retried request is sent again
+	if n := countRequests(server, http.MethodPost, "/api/v0/graph-defs/create", http.StatusOK); n != 2 {
+		t.Errorf("accepted requests = %d, want 2", n)
+	}
+
+	// the rotated key is used from the first attempt afterwards
+	if _, err := client.GetOrg(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRequests(server, http.MethodGet, "/api/v0/org", http.StatusForbidden); n != 0 {
+		t.Errorf("rejected requests = %d, want 0 with the rotated key", n)
+	}
+}
+
+func TestRotatingTransportReturnsRejectionOfUnchangedKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		fetchedAt time.Time
+		fetches   int
+	}{
+		// the store still has the rejected key
+		{"refetched", time.Now().Add(-time.Hour), 1},
+		// the key was fetched just now, so the rejection doesn't trigger another fetch
+		{"within minRefetchInterval", time.Now(), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t)
+			server.APIKey = "valid-api-key"
+			source := &secretSource{apiKey: "wrong-api-key"}
+			useTestRotator(t, source, 0, tt.fetchedAt)
+
+			if _, err := newClient("wrong-api-key").GetOrg(); err == nil {
+				t.Error("err = nil, want the rejection")
+			}
+			if source.fetches != tt.fetches {
+				t.Errorf("fetches = %d, want %d", source.fetches, tt.fetches)
+			}
+			if n := countRequests(server, http.MethodGet, "/api/v0/org", http.StatusForbidden); n != 1 {
+				t.Errorf("rejected requests = %d, want 1 without a retry", n)
+			}
+		})
+	}
+}
+
+func TestAPIKeyRotatorRefreshesPeriodically(t *testing.T) {
+	source := &secretSource{apiKey: "old-api-key"}
+	r := NewAPIKeyRotator(source.apiKey, source.fetch, time.Minute)
+	source.rotate("new-api-key")
+
+	if got := r.APIKey(); got != "old-api-key" {
+		t.Errorf("APIKey = %s, want the old key within the refresh interval", got)
+	}
+	r.fetchedAt = time.Now().Add(-time.Minute)
+	if got := r.APIKey(); got != "new-api-key" {
+		t.Errorf("APIKey = %s, want the rotated key after the refresh interval", got)
+	}
+
+	// a failed fetch keeps the current key
+	source.mu.Lock()
+	source.err = errors.New("throttled")
+	source.mu.Unlock()
+	r.fetchedAt = time.Now().Add(-time.Minute)
+	if got := r.APIKey(); got != "new-api-key" {
+		t.Errorf("APIKey = %s, want the current key kept on the failure", got)
+	}
+	if source.fetches != 2 {
+		t.Errorf("fetches = %d, want 2", source.fetches)
+	}
+}
+
+func TestRotatingTransportRetriesUnauthorized(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Api-Key") != "new-api-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	source := &secretSource{apiKey: "new-api-key"}
+	r := NewAPIKeyRotator("old-api-key", source.fetch, 0)
+	r.fetchedAt = time.Now().Add(-time.Hour)
+
+	client := &http.Client{Transport: &rotatingTransport{rotator: r, base: http.DefaultTransport}}
+	res, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200 retried with the rotated key", res.StatusCode)
+	}
+}
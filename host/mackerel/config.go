@@ -1,7 +1,63 @@
 package mackerel
 
+import (
+	"errors"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
+)
+
 type MackerelConfig struct {
-	ApiKey             string   `env:"EXT_MACKEREL_API_KEY"`
-	ApiKeySSMParamName string   `env:"EXT_MACKEREL_API_KEY_SSM"`
-	RoleFullnames      []string `env:"EXT_MACKEREL_ROLE_FULL_NAMES" envSeparator:","`
+	// ApiBase is the base URL of the Mackerel API
+	ApiBase            string `env:"EXT_MACKEREL_API_BASE" envDefault:"https://api.mackerelio.com/"`
+	ApiKey             string `env:"EXT_MACKEREL_API_KEY"`
+	ApiKeySSMParamName string `env:"EXT_MACKEREL_API_KEY_SSM"`
+	// ApiKeySecretID is the name or the ARN of the secret of Secrets Manager where the API key is stored
+	ApiKeySecretID string `env:"EXT_MACKEREL_API_KEY_SECRET"`
+	// ApiKeySecretJSONKey is the dot-separated path to the API key if the secret is a JSON object
+	ApiKeySecretJSONKey string `env:"EXT_MACKEREL_API_KEY_SECRET_JSON_KEY"`
+	// ApiKeyRefreshInterval is the interval to fetch the API key again from SSM or Secrets Manager. 0 disables the refresh.
+	ApiKeyRefreshInterval time.Duration `env:"EXT_MACKEREL_API_KEY_REFRESH_INTERVAL" envDefault:"0s"`
+	RoleFullnames         []string      `env:"EXT_MACKEREL_ROLE_FULL_NAMES" envSeparator:","`
+	// AutoCreateRoles creates the missing services and roles, and defaults RoleFullnames to lambda:<function name>
+	AutoCreateRoles  bool `env:"EXT_MACKEREL_AUTO_CREATE_ROLES" envDefault:"false"`
+	MonitorConfig    MonitorConfig
+	AnnotationConfig AnnotationConfig
+	ReaperConfig     ReaperConfig
+	SinkConfig       sink.Config `envPrefix:"EXT_MACKEREL_SINK_"`
+}
+
+// MonitorConfig declares the monitors provisioned for the roles by the monitors subcommand.
+// A monitor is provisioned only when either of its thresholds is set.
+type MonitorConfig struct {
+	ErrorRateWarning          *float64 `env:"EXT_MACKEREL_MONITOR_ERROR_RATE_WARNING"`
+	ErrorRateCritical         *float64 `env:"EXT_MACKEREL_MONITOR_ERROR_RATE_CRITICAL"`
+	DurationP99Warning        *float64 `env:"EXT_MACKEREL_MONITOR_DURATION_P99_WARNING"`
+	DurationP99Critical       *float64 `env:"EXT_MACKEREL_MONITOR_DURATION_P99_CRITICAL"`
+	MemoryUtilizationWarning  *float64 `env:"EXT_MACKEREL_MONITOR_MEMORY_UTILIZATION_WARNING"`
+	MemoryUtilizationCritical *float64 `env:"EXT_MACKEREL_MONITOR_MEMORY_UTILIZATION_CRITICAL"`
+	NotificationInterval      uint64   `env:"EXT_MACKEREL_MONITOR_NOTIFICATION_INTERVAL" envDefault:"0"`
+}
+
+// AnnotationConfig configures the graph annotations posted on the services of the roles.
+type AnnotationConfig struct {
+	Enabled                 bool          `env:"EXT_MACKEREL_ANNOTATION_ENABLED" envDefault:"false"`
+	ColdStartBurstThreshold int           `env:"EXT_MACKEREL_ANNOTATION_COLD_START_BURST_THRESHOLD" envDefault:"0"`
+	ColdStartBurstWindow    time.Duration `env:"EXT_MACKEREL_ANNOTATION_COLD_START_BURST_WINDOW" envDefault:"5m"`
+}
+
+// ReaperConfig configures the reaper of the hosts whose environment was killed without SHUTDOWN.
+type ReaperConfig struct {
+	Enabled bool `env:"EXT_MACKEREL_REAPER_ENABLED" envDefault:"false"`
+	// TTL has no default since it must be longer than the environments of the function stay frozen, which depends on the function
+	TTL      time.Duration `env:"EXT_MACKEREL_REAPER_TTL"`
+	Interval time.Duration `env:"EXT_MACKEREL_REAPER_INTERVAL" envDefault:"10m"`
+}
+
+// Validate requires the TTL when the reaper is enabled
+func (c *ReaperConfig) Validate() error {
+	if c.Enabled && c.TTL <= 0 {
+		return errors.New("EXT_MACKEREL_REAPER_TTL is required when EXT_MACKEREL_REAPER_ENABLED is true, set it longer than the environments of the function stay frozen")
+	}
+	return nil
 }
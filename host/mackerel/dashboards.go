@@ -0,0 +1,105 @@
+package mackerel
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+const (
+	dashboardGridWidth   = 24
+	dashboardValueHeight = 5
+	dashboardGraphWidth  = 8
+	dashboardGraphHeight = 10
+	dashboardTitlePrefix = "Lambda"
+)
+
+var dashboardURLPathInvalidChars = regexp.MustCompile("[^a-zA-Z0-9_-]+")
+
+type CreateOrUpdateDashboardParam struct {
+	MackerelApiKey string
+	RoleFullname   string
+	FunctionName   string
+}
+
+// CreateOrUpdateDashboard builds the custom dashboard of the role from GraphDefs.
+// An existing dashboard with the same title is updated instead of creating another one.
+func CreateOrUpdateDashboard(param *CreateOrUpdateDashboardParam) (*mackerel.Dashboard, error) {
+	if param.MackerelApiKey == "" {
+		return nil, errors.New("MackerelApiKey is not set")
+	}
+	if param.RoleFullname == "" {
+		return nil, errors.New("RoleFullname is not set")
+	}
+	client := newClient(param.MackerelApiKey)
+
+	dashboard := buildDashboard(param)
+
+	dashboards, err := client.FindDashboards()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dashboards {
+		if d.Title == dashboard.Title {
+			Logger.Info("updating dashboard:", d.ID)
+			dashboard.URLPath = d.URLPath
+			return client.UpdateDashboard(d.ID, dashboard)
+		}
+	}
+
+	Logger.Info("creating dashboard:", dashboard.Title)
+	return client.CreateDashboard(dashboard)
+}
+
+func buildDashboard(param *CreateOrUpdateDashboardParam) *mackerel.Dashboard {
+	roleFullname := strings.ReplaceAll(param.RoleFullname, " ", "")
+	widgets := make([]mackerel.Widget, 0, len(GraphDefs)+2)
+
+	fractionSize := int64(2)
+	widgets = append(
+		widgets,
+		mackerel.Widget{
+			Type:         "value",
+			Title:        "Error Rate",
+			Metric:       mackerel.Metric{Type: "expression", Expression: errorRateExpression(roleFullname)},
+			FractionSize: &fractionSize,
+			Suffix:       "%",
+			Layout:       mackerel.Layout{X: 0, Y: 0, Width: dashboardGridWidth / 2, Height: dashboardValueHeight},
+		},
+		mackerel.Widget{
+			Type:   "value",
+			Title:  "Cold Starts",
+			Metric: mackerel.Metric{Type: "expression", Expression: fmt.Sprintf("sum(role(%s, custom.lambda.platform.initStart.count))", roleFullname)},
+			Layout: mackerel.Layout{X: dashboardGridWidth / 2, Y: 0, Width: dashboardGridWidth / 2, Height: dashboardValueHeight},
+		},
+	)
+
+	graphsPerRow := dashboardGridWidth / dashboardGraphWidth
+	for i, graphDef := range GraphDefs {
+		widgets = append(widgets, mackerel.Widget{
+			Type:  "graph",
+			Title: graphDef.DisplayName,
+			Graph: mackerel.Graph{Type: "role", RoleFullName: roleFullname, Name: graphDef.Name},
+			Layout: mackerel.Layout{
+				X:      int64((i % graphsPerRow) * dashboardGraphWidth),
+				Y:      int64(dashboardValueHeight + (i/graphsPerRow)*dashboardGraphHeight),
+				Width:  dashboardGraphWidth,
+				Height: dashboardGraphHeight,
+			},
+		})
+	}
+
+	memo := "Generated by mackerel-lambda-extension-agent"
+	if param.FunctionName != "" {
+		memo += " for " + param.FunctionName
+	}
+	return &mackerel.Dashboard{
+		Title:   fmt.Sprintf("%s %s", dashboardTitlePrefix, roleFullname),
+		URLPath: "lambda-" + dashboardURLPathInvalidChars.ReplaceAllString(roleFullname, "-"),
+		Memo:    memo,
+		Widgets: widgets,
+	}
+}
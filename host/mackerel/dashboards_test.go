@@ -0,0 +1,91 @@
+package mackerel
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildDashboard(t *testing.T) {
+	dashboard := buildDashboard(&CreateOrUpdateDashboardParam{RoleFullname: "my service:sample function", FunctionName: "sample-function"})
+
+	if dashboard.Title != "Lambda myservice:samplefunction" || dashboard.URLPath != "lambda-myservice-samplefunction" {
+		t.Errorf("title = %q, url path = %q", dashboard.Title, dashboard.URLPath)
+	}
+	if dashboard.Memo != "Generated by mackerel-lambda-extension-agent for sample-function" {
+		t.Errorf("memo = %q", dashboard.Memo)
+	}
+	if len(dashboard.Widgets) != len(GraphDefs)+2 {
+		t.Fatalf("widgets = %d, want the values and a graph for each of %d graph defs", len(dashboard.Widgets), len(GraphDefs))
+	}
+
+	errorRate := dashboard.Widgets[0]
+	if errorRate.Type != "value" || errorRate.Metric.Expression != errorRateExpression("myservice:samplefunction") || errorRate.Suffix != "%" {
+		t.Errorf("error rate = %+v", errorRate)
+	}
+	coldStarts := dashboard.Widgets[1]
+	if coldStarts.Metric.Expression != "sum(role(myservice:samplefunction, custom.lambda.platform.initStart.count))" {
+		t.Errorf("cold starts = %+v", coldStarts)
+	}
+
+	// the graphs are laid out in rows of three below the values, without overlaps
+	occupied := make(map[[2]int64]bool)
+	for i, widget := range dashboard.Widgets[2:] {
+		if widget.Type != "graph" || widget.Graph.Type != "role" || widget.Graph.RoleFullName != "myservice:samplefunction" || widget.Graph.Name != GraphDefs[i].Name {
+			t.Errorf("graph %d = %+v", i, widget)
+		}
+		l := widget.Layout
+		if l.X+l.Width > dashboardGridWidth || l.Y < dashboardValueHeight {
+			t.Errorf("graph %d is out of the grid: %+v", i, l)
+		}
+		if occupied[[2]int64{l.X, l.Y}] {
+			t.Errorf("graph %d overlaps another at %+v", i, l)
+		}
+		occupied[[2]int64{l.X, l.Y}] = true
+	}
+	if l := dashboard.Widgets[5].Layout; l.X != 0 || l.Y != dashboardValueHeight+dashboardGraphHeight {
+		t.Errorf("the 4th graph is at %+v, want the start of the second row", l)
+	}
+}
+
+func TestCreateOrUpdateDashboard(t *testing.T) {
+	server := newTestServer(t)
+	param := &CreateOrUpdateDashboardParam{MackerelApiKey: "test-api-key", RoleFullname: "lambda:sample-function"}
+
+	created, err := CreateOrUpdateDashboard(param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == "" || created.URLPath != "lambda-lambda-sample-function" {
+		t.Errorf("created = %+v", created)
+	}
+
+	// the URL path renamed by an operator is kept on the update
+	client := newClient("test-api-key")
+	renamed := *created
+	renamed.URLPath = "renamed"
+	if _, err := client.UpdateDashboard(created.ID, &renamed); err != nil {
+		t.Fatal(err)
+	}
+	param.FunctionName = "sample-function"
+	updated, err := CreateOrUpdateDashboard(param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.ID != created.ID || updated.URLPath != "renamed" || !strings.HasSuffix(updated.Memo, "for sample-function") {
+		t.Errorf("updated = %+v, want %s updated in place", updated, created.ID)
+	}
+	if n := len(server.Dashboards()); n != 1 {
+		t.Errorf("dashboards = %d, want 1", n)
+	}
+}
+
+func TestCreateOrUpdateDashboardRequiresParams(t *testing.T) {
+	for _, param := range []*CreateOrUpdateDashboardParam{
+		{RoleFullname: "lambda:sample-function"},
+		{MackerelApiKey: "test-api-key"},
+	} {
+		if _, err := CreateOrUpdateDashboard(param); err == nil {
+			t.Errorf("%+v: err = nil, want an error", param)
+		}
+	}
+}
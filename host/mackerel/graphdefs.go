@@ -13,6 +13,22 @@ var GraphDefs []*mackerel.GraphDefsParam = []*mackerel.GraphDefsParam{
 			{Name: "custom.lambda.platform.initReport.duration.duration", DisplayName: "duration", IsStacked: false},
 		},
 	},
+	{
+		Name:        "custom.lambda.platform.initStart",
+		DisplayName: "Cold Starts",
+		Unit:        "integer",
+		Metrics: []*mackerel.GraphDefsMetric{
+			{Name: "custom.lambda.platform.initStart.count", DisplayName: "count", IsStacked: false},
+		},
+	},
+	{
+		Name:        "custom.lambda.platform.report",
+		DisplayName: "Reports",
+		Unit:        "integer",
+		Metrics: []*mackerel.GraphDefsMetric{
+			{Name: "custom.lambda.platform.report.count", DisplayName: "count", IsStacked: false},
+		},
+	},
 	{
 		Name:        "custom.lambda.platform.report.billedDuration",
 		DisplayName: "Billed Duration",
@@ -31,6 +47,7 @@ var GraphDefs []*mackerel.GraphDefsParam = []*mackerel.GraphDefsParam{
 			{Name: "custom.lambda.platform.report.duration.avg", DisplayName: "avg", IsStacked: false},
 			{Name: "custom.lambda.platform.report.duration.max", DisplayName: "max", IsStacked: false},
 			{Name: "custom.lambda.platform.report.duration.min", DisplayName: "min", IsStacked: false},
+			{Name: "custom.lambda.platform.report.duration.p99", DisplayName: "p99", IsStacked: false},
 		},
 	},
 	{
@@ -63,6 +80,25 @@ var GraphDefs []*mackerel.GraphDefsParam = []*mackerel.GraphDefsParam{
 			{Name: "custom.lambda.platform.report.memorySize.min", DisplayName: "min", IsStacked: false},
 		},
 	},
+	{
+		Name:        "custom.lambda.platform.report.memoryUtilization",
+		DisplayName: "Memory Utilization",
+		Unit:        "percentage",
+		Metrics: []*mackerel.GraphDefsMetric{
+			{Name: "custom.lambda.platform.report.memoryUtilization.avg", DisplayName: "avg", IsStacked: false},
+			{Name: "custom.lambda.platform.report.memoryUtilization.max", DisplayName: "max", IsStacked: false},
+			{Name: "custom.lambda.platform.report.memoryUtilization.min", DisplayName: "min", IsStacked: false},
+		},
+	},
+	{
+		Name:        "custom.lambda.platform.runtimeDone.invocations",
+		DisplayName: "Invocations",
+		Unit:        "integer",
+		Metrics: []*mackerel.GraphDefsMetric{
+			{Name: "custom.lambda.platform.runtimeDone.invocations.count", DisplayName: "count", IsStacked: false},
+			{Name: "custom.lambda.platform.runtimeDone.invocations.errors", DisplayName: "errors", IsStacked: false},
+		},
+	},
 	{
 		Name:        "custom.lambda.platform.runtimeDone.duration",
 		DisplayName: "Done Duration",
@@ -84,13 +120,18 @@ var GraphDefs []*mackerel.GraphDefsParam = []*mackerel.GraphDefsParam{
 		},
 	},
 	{
-		Name:        "custom.lambda.osstat.loadavg",
-		DisplayName: "loadavg",
-		Unit:        "float",
+		Name:        "custom.lambda.extension.shutdown",
+		DisplayName: "Shutdown Reason",
+		Unit:        "integer",
 		Metrics: []*mackerel.GraphDefsMetric{
-			{Name: "custom.lambda.osstat.loadavg.loadavg1", DisplayName: "loadavg1", IsStacked: false},
-			{Name: "custom.lambda.osstat.loadavg.loadavg5", DisplayName: "loadavg5", IsStacked: false},
-			{Name: "custom.lambda.osstat.loadavg.loadavg15", DisplayName: "loadavg15", IsStacked: false},
+			{Name: "custom.lambda.extension.shutdown.spindown", DisplayName: "spindown", IsStacked: true},
+			{Name: "custom.lambda.extension.shutdown.timeout", DisplayName: "timeout", IsStacked: true},
+			{Name: "custom.lambda.extension.shutdown.failure", DisplayName: "failure", IsStacked: true},
 		},
 	},
 }
+
+// RegisterGraphDefs adds the graph definitions of the metrics posted by other packages
+func RegisterGraphDefs(defs ...*mackerel.GraphDefsParam) {
+	GraphDefs = append(GraphDefs, defs...)
+}
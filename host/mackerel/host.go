@@ -1,10 +1,14 @@
 package mackerel
 
 import (
+	"context"
 	"errors"
+	"net/http"
 	"os"
+	"sync"
 
 	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/host"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
 	"github.com/mackerelio/mackerel-client-go"
 	"github.com/sirupsen/logrus"
 )
@@ -12,55 +16,101 @@ import (
 type Host struct {
 	client *mackerel.Client
 	ID     string
+	// param registers the host again when it has been retired while the environment is alive
+	param *CreateHostParam
+	mu    sync.Mutex
 }
 
 var _ host.Host = &Host{}
+var _ sink.Poster = &Host{}
 
 var Logger *logrus.Entry
 
-const hostIDFilePath = "/tmp/mackerel-lambda-extension-agent.id"
+// hostIDFilePath keeps the ID of the host while the environment is alive
+var hostIDFilePath = "/tmp/mackerel-lambda-extension-agent.id"
+
+// UseHostIDFile makes the host ID kept in path, e.g. in a temporary directory of a test running the agent
+func UseHostIDFile(path string) {
+	hostIDFilePath = path
+}
 
 type CreateHostParam struct {
 	MackerelApiKey string
 	RoleFullnames  []string
 	FunctionName   string
+	FunctionArn    string
 	EnvironmentID  string
+	Checks         []mackerel.CheckConfig
 }
 type CreateOrGetHostParam = CreateHostParam
 
+// CustomIdentifier returns the identifier of the host unique to the runtime environment of the function.
+// It returns an empty string if the function ARN is unknown.
+func (p *CreateHostParam) CustomIdentifier() string {
+	if p.FunctionArn == "" {
+		return ""
+	}
+	return p.FunctionArn + "/" + p.EnvironmentID
+}
+
 func CreateOrGetHost(param *CreateOrGetHostParam) (*Host, error) {
 	host, err := GetHost(param.MackerelApiKey)
 	if err != nil {
 		return nil, err
 	}
 	if host != nil {
-		Logger.Info("host already exists. hostID =", host.ID)
-		return host, nil
+		retired, err := host.retired()
+		if err != nil {
+			return nil, err
+		}
+		if !retired {
+			Logger.Info("host already exists. hostID =", host.ID)
+			host.param = param
+			return host, nil
+		}
+		Logger.Info("the stored host has been retired. hostID =", host.ID)
 	}
 
-	host, err = CreateHost(param)
+	host, err = FindHostByCustomIdentifier(param.MackerelApiKey, param.CustomIdentifier())
 	if err != nil {
 		return nil, err
 	}
-	Logger.Info("created a new host. hostID =", host.ID)
+	if host != nil {
+		Logger.Info("found the host registered by the environment. hostID =", host.ID)
+	} else {
+		host, err = CreateHost(param)
+		if err != nil {
+			return nil, err
+		}
+		Logger.Info("created a new host. hostID =", host.ID)
+	}
+	host.param = param
+	storeHostID(host.ID)
 
 	return host, nil
 }
 
+func storeHostID(hostID string) {
+	if err := os.WriteFile(hostIDFilePath, []byte(hostID), 0600); err != nil {
+		Logger.Warning("Failed to store the host ID:", err)
+	}
+}
+
 func CreateHost(param *CreateHostParam) (*Host, error) {
 	if param.MackerelApiKey == "" {
 		return nil, errors.New("MackerelApiKey is not set")
 	}
-	client := mackerel.NewClient(param.MackerelApiKey)
+	client := newClient(param.MackerelApiKey)
 
 	hostID, err := client.CreateHost(&mackerel.CreateHostParam{
-		Name:          param.EnvironmentID,
-		DisplayName:   param.FunctionName,
-		Memo:          "",
-		Meta:          mackerel.HostMeta{},
-		Interfaces:    []mackerel.Interface{},
-		RoleFullnames: param.RoleFullnames,
-		Checks:        []mackerel.CheckConfig{},
+		Name:             param.EnvironmentID,
+		DisplayName:      param.FunctionName,
+		Memo:             "",
+		Meta:             mackerel.HostMeta{AgentName: agentName},
+		Interfaces:       []mackerel.Interface{},
+		RoleFullnames:    param.RoleFullnames,
+		Checks:           param.Checks,
+		CustomIdentifier: param.CustomIdentifier(),
 	})
 	if err != nil {
 		return nil, err
@@ -76,7 +126,7 @@ func GetHost(apiKey string) (*Host, error) {
 	if apiKey == "" {
 		return nil, errors.New("MackerelApiKey is not set")
 	}
-	client := mackerel.NewClient(apiKey)
+	client := newClient(apiKey)
 
 	_, err := os.Stat(hostIDFilePath)
 	if err != nil {
@@ -95,9 +145,48 @@ func GetHost(apiKey string) (*Host, error) {
 	return host, nil
 }
 
+// NewHost returns the host of hostID registered before
+func NewHost(apiKey string, hostID string) (*Host, error) {
+	if apiKey == "" {
+		return nil, errors.New("MackerelApiKey is not set")
+	}
+	return &Host{
+		client: newClient(apiKey),
+		ID:     hostID,
+	}, nil
+}
+
+// FindHostByCustomIdentifier returns the active host registered with the custom identifier, or nil if there is none.
+func FindHostByCustomIdentifier(apiKey string, customIdentifier string) (*Host, error) {
+	if apiKey == "" {
+		return nil, errors.New("MackerelApiKey is not set")
+	}
+	if customIdentifier == "" {
+		return nil, nil
+	}
+	client := newClient(apiKey)
+
+	found, err := client.FindHostByCustomIdentifier(customIdentifier, &mackerel.FindHostByCustomIdentifierParam{})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if found == nil || found.IsRetired {
+		return nil, nil
+	}
+
+	host := &Host{
+		client: client,
+		ID:     found.ID,
+	}
+	return host, nil
+}
+
 func (h *Host) Retire() error {
 	Logger.Info("retiring the host")
-	return h.client.RetireHost(h.ID)
+	return h.client.RetireHost(h.currentID())
 }
 
 func (h *Host) CreateGraphDefs() error {
@@ -105,7 +194,76 @@ func (h *Host) CreateGraphDefs() error {
 	return h.client.CreateGraphDefs(GraphDefs)
 }
 
-func (h *Host) PostMetrics(metrics []*mackerel.MetricValue) error {
+func (h *Host) Name() string {
+	return "mackerel"
+}
+
+// Post posts the metrics as the host metrics. Client errors except 429 are not retried,
+// but the host is registered again and the metrics are posted once more if the host has been retired.
+func (h *Host) Post(ctx context.Context, metrics []*mackerel.MetricValue) error {
 	Logger.Info("posting metrics")
-	return h.client.PostHostMetricValuesByHostID(h.ID, metrics)
+	err := h.client.PostHostMetricValuesByHostID(h.currentID(), metrics)
+	if !isClientError(err) {
+		return err
+	}
+	if retired, _ := h.retired(); retired {
+		Logger.Warning("The host has been retired, registering it again")
+		if err := h.reregister(); err != nil {
+			return err
+		}
+		err = h.client.PostHostMetricValuesByHostID(h.currentID(), metrics)
+	}
+	if isClientError(err) {
+		return sink.Permanent(err)
+	}
+	return err
+}
+
+// isClientError reports whether err is a 4xx response other than 429
+func isClientError(err error) bool {
+	apiErr, ok := err.(*mackerel.APIError)
+	return ok && apiErr.StatusCode >= 400 && apiErr.StatusCode < 500 && apiErr.StatusCode != http.StatusTooManyRequests
+}
+
+func (h *Host) currentID() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.ID
+}
+
+// retired reports whether the host has been retired, e.g. by the reaper of another environment while this one was frozen
+func (h *Host) retired() (bool, error) {
+	found, err := h.client.FindHost(h.currentID())
+	if err != nil {
+		if isNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return found.IsRetired, nil
+}
+
+// reregister registers the host again with the parameters it was registered with
+func (h *Host) reregister() error {
+	if h.param == nil {
+		return errors.New("the retired host can't be registered again")
+	}
+	created, err := CreateHost(h.param)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.ID = created.ID
+	h.mu.Unlock()
+	Logger.Info("registered the host again. hostID =", created.ID)
+	storeHostID(created.ID)
+	return nil
+}
+
+func (h *Host) PostCheckReports(reports []*mackerel.CheckReport) error {
+	Logger.Info("posting check reports")
+	for _, report := range reports {
+		report.Source = mackerel.NewCheckSourceHost(h.currentID())
+	}
+	return h.client.PostCheckReports(&mackerel.CheckReports{Reports: reports})
 }
@@ -0,0 +1,256 @@
+package mackerel
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/host/mackerel/mackereltest"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
+	"github.com/mackerelio/mackerel-client-go"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	Logger = logrus.NewEntry(logrus.New())
+	Logger.Logger.SetOutput(io.Discard)
+	sink.Logger = Logger
+}
+
+// newTestServer starts the fake Mackerel API and points the clients and the host ID file of the package to the test
+func newTestServer(t *testing.T) *mackereltest.Server {
+	server := mackereltest.NewServer()
+	server.APIKey = "test-api-key"
+	t.Cleanup(server.Close)
+	if err := UseAPIBase(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { UseAPIBase("") })
+	original := hostIDFilePath
+	hostIDFilePath = filepath.Join(t.TempDir(), "host.id")
+	t.Cleanup(func() { hostIDFilePath = original })
+	return server
+}
+
+func newTestHostParam() *CreateOrGetHostParam {
+	return &CreateOrGetHostParam{
+		MackerelApiKey: "test-api-key",
+		RoleFullnames:  []string{"lambda:sample-function"},
+		FunctionName:   "sample-function",
+		FunctionArn:    "arn:aws:lambda:us-east-1:000000000000:function:sample-function",
+		EnvironmentID:  "4f5b1c0e-0000-4000-8000-000000000000",
+	}
+}
+
+// countRequests returns the number of the requests received by the server with the method, the path and the status
+func countRequests(server *mackereltest.Server, method string, path string, status int) int {
+	count := 0
+	for _, r := range server.Requests() {
+		if r.Method == method && r.Path == path && r.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+func testMetrics() []*mackerel.MetricValue {
+	return []*mackerel.MetricValue{
+		{Name: "custom.lambda.platform.report.duration.avg", Time: 1700000000, Value: 1.5},
+		{Name: "custom.lambda.platform.runtimeDone.invocations.count", Time: 1700000000, Value: 3},
+	}
+}
+
+func TestCreateOrGetHostRegistersHost(t *testing.T) {
+	server := newTestServer(t)
+	param := newTestHostParam()
+
+	host, err := CreateOrGetHost(param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := server.Hosts()
+	if len(hosts) != 1 || hosts[0].ID != host.ID {
+		t.Fatalf("hosts = %+v, want the created host %s", hosts, host.ID)
+	}
+	if hosts[0].Name != param.EnvironmentID || hosts[0].DisplayName != param.FunctionName {
+		t.Errorf("host = %+v, want the name of the environment and the display name of the function", hosts[0])
+	}
+	if hosts[0].CustomIdentifier != param.CustomIdentifier() {
+		t.Errorf("custom identifier = %s, want %s", hosts[0].CustomIdentifier, param.CustomIdentifier())
+	}
+	if roles := hosts[0].Roles["lambda"]; len(roles) != 1 || roles[0] != "sample-function" {
+		t.Errorf("roles = %v, want lambda:sample-function", hosts[0].Roles)
+	}
+	stored, err := os.ReadFile(hostIDFilePath)
+	if err != nil || string(stored) != host.ID {
+		t.Errorf("stored host ID = %q (%v), want %s", stored, err, host.ID)
+	}
+
+	// the next start of the agent in the same environment reuses the stored host
+	again, err := CreateOrGetHost(param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != host.ID {
+		t.Errorf("host ID = %s, want the stored %s", again.ID, host.ID)
+	}
+	if n := countRequests(server, http.MethodPost, "/api/v0/hosts", http.StatusOK); n != 1 {
+		t.Errorf("host registrations = %d, want 1", n)
+	}
+}
+
+func TestCreateOrGetHostFindsHostByCustomIdentifier(t *testing.T) {
+	server := newTestServer(t)
+	param := newTestHostParam()
+	server.AddHost(&mackerel.Host{ID: "registered", Name: param.EnvironmentID, CustomIdentifier: param.CustomIdentifier()})
+
+	host, err := CreateOrGetHost(param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.ID != "registered" {
+		t.Errorf("host ID = %s, want the host registered with the custom identifier", host.ID)
+	}
+	if n := countRequests(server, http.MethodPost, "/api/v0/hosts", http.StatusOK); n != 0 {
+		t.Errorf("host registrations = %d, want none", n)
+	}
+}
+
+func TestCreateOrGetHostRegistersAgainRetiredHost(t *testing.T) {
+	server := newTestServer(t)
+	param := newTestHostParam()
+	retired, err := CreateOrGetHost(param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := retired.Retire(); err != nil {
+		t.Fatal(err)
+	}
+
+	host, err := CreateOrGetHost(param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.ID == retired.ID {
+		t.Errorf("host ID = %s, want a new host instead of the retired one", host.ID)
+	}
+	if n := countRequests(server, http.MethodPost, "/api/v0/hosts", http.StatusOK); n != 2 {
+		t.Errorf("host registrations = %d, want 2", n)
+	}
+}
+
+func TestPostRetriesThrottledAndUnavailable(t *testing.T) {
+	server := newTestServer(t)
+	host, err := CreateOrGetHost(newTestHostParam())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Inject(mackereltest.Failure{Method: http.MethodPost, PathPrefix: "/api/v0/tsdb", Status: http.StatusTooManyRequests, Count: 1})
+	server.Inject(mackereltest.Failure{Method: http.MethodPost, PathPrefix: "/api/v0/tsdb", Status: http.StatusServiceUnavailable, Count: 1})
+
+	s := sink.NewBatchingSink(host, &sink.Config{BatchConfig: sink.BatchConfig{BatchSize: 100, MaxRetries: 2, RetryInterval: time.Millisecond}, MaxBufferedMetrics: 100})
+	if err := s.Send(context.Background(), testMetrics()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := server.Metrics()
+	if len(metrics) != 2 {
+		t.Fatalf("metrics = %d, want 2", len(metrics))
+	}
+	for _, m := range metrics {
+		if m.HostID != host.ID {
+			t.Errorf("metric %s is posted to %s, want %s", m.Name, m.HostID, host.ID)
+		}
+	}
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusOK} {
+		if n := countRequests(server, http.MethodPost, "/api/v0/tsdb", status); n != 1 {
+			t.Errorf("posts with %d = %d, want 1", status, n)
+		}
+	}
+}
+
+func TestPostRejectedMetricsArePermanent(t *testing.T) {
+	server := newTestServer(t)
+	host, err := CreateOrGetHost(newTestHostParam())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Inject(mackereltest.Failure{Method: http.MethodPost, PathPrefix: "/api/v0/tsdb", Status: http.StatusBadRequest})
+
+	err = host.Post(context.Background(), testMetrics())
+	if err == nil || !sink.IsPermanent(err) {
+		t.Fatalf("err = %v, want a permanent error", err)
+	}
+
+	// the batching sink drops the rejected metrics without retries
+	s := sink.NewBatchingSink(host, &sink.Config{BatchConfig: sink.BatchConfig{BatchSize: 100, MaxRetries: 2, RetryInterval: time.Millisecond}, MaxBufferedMetrics: 100})
+	if err := s.Send(context.Background(), testMetrics()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s.Dropped() != 2 {
+		t.Errorf("dropped = %d, want 2", s.Dropped())
+	}
+	if n := countRequests(server, http.MethodPost, "/api/v0/tsdb", http.StatusBadRequest); n != 2 {
+		t.Errorf("posts = %d, want one per Post without retries", n)
+	}
+}
+
+func TestPostRegistersAgainRetiredHost(t *testing.T) {
+	server := newTestServer(t)
+	host, err := CreateOrGetHost(newTestHostParam())
+	if err != nil {
+		t.Fatal(err)
+	}
+	retiredID := host.ID
+	// e.g. the reaper of another environment retired the host while this one was frozen
+	other, err := NewHost("test-api-key", retiredID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Retire(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := host.Post(context.Background(), testMetrics()); err != nil {
+		t.Fatal(err)
+	}
+	if host.currentID() == retiredID {
+		t.Fatal("the retired host is not registered again")
+	}
+	for _, m := range server.Metrics() {
+		if m.HostID != host.currentID() {
+			t.Errorf("metric %s is posted to %s, want the new host %s", m.Name, m.HostID, host.currentID())
+		}
+	}
+	stored, _ := os.ReadFile(hostIDFilePath)
+	if string(stored) != host.currentID() {
+		t.Errorf("stored host ID = %s, want the new host %s", stored, host.currentID())
+	}
+}
+
+func TestRetire(t *testing.T) {
+	server := newTestServer(t)
+	host, err := CreateOrGetHost(newTestHostParam())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := host.Retire(); err != nil {
+		t.Fatal(err)
+	}
+	if retired := server.RetiredHostIDs(); len(retired) != 1 || retired[0] != host.ID {
+		t.Errorf("retired hosts = %v, want %s", retired, host.ID)
+	}
+	if n := countRequests(server, http.MethodPost, "/api/v0/hosts/"+host.ID+"/retire", http.StatusOK); n != 1 {
+		t.Errorf("retirements = %d, want 1", n)
+	}
+}
@@ -0,0 +1,638 @@
+// Package mackereltest provides an in-process fake of the Mackerel API.
+// It records the requests of the agent, and injects failures to exercise the retries.
+package mackereltest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// Failure makes the requests matching Method and PathPrefix fail.
+// The request responds Status after Delay. A Delay longer than the timeout of the client emulates a timeout.
+type Failure struct {
+	Method     string
+	PathPrefix string
+	Status     int
+	Delay      time.Duration
+	// Count is the number of the requests to fail. 0 fails all of them.
+	Count int
+}
+
+// Request is a request received by the server
+type Request struct {
+	Method string
+	Path   string
+	Status int
+}
+
+// Server is a fake of the Mackerel API. It keeps the services and roles, the hosts, the graph defs, the metrics, the check reports,
+// the monitors, the role metadata, the graph annotations and the dashboards in memory.
+type Server struct {
+	// URL is the base URL of the API to be set to EXT_MACKEREL_API_BASE
+	URL string
+	// APIKey is the key accepted by the server if set. The requests with another key are rejected with 403.
+	APIKey string
+	// ReadOnlyAPIKey is the key accepted only by the GET requests if set, as a key without the write permission
+	ReadOnlyAPIKey string
+
+	server           *httptest.Server
+	mu               sync.Mutex
+	failures         []*Failure
+	requests         []*Request
+	services         []*mackerel.Service
+	roles            map[string][]*mackerel.Role
+	hosts            []*mackerel.Host
+	graphDefs        []*mackerel.GraphDefsParam
+	metrics          []*mackerel.HostMetricValue
+	checkReports     []*mackerel.CheckReport
+	retiredHostIDs   []string
+	monitors         []map[string]interface{}
+	roleMetadata     map[string]json.RawMessage
+	graphAnnotations []*mackerel.GraphAnnotation
+	dashboards       []*mackerel.Dashboard
+}
+
+// NewServer starts a fake of the Mackerel API. Call Close to stop it.
+func NewServer() *Server {
+	s := &Server{
+		roles:        make(map[string][]*mackerel.Role),
+		roleMetadata: make(map[string]json.RawMessage),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.URL = s.server.URL
+	return s
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Inject adds a failure. The failures are matched in the order of the injection.
+func (s *Server) Inject(f Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failure := f
+	s.failures = append(s.failures, &failure)
+}
+
+// AddHost registers a host as if it was created before, e.g. by another environment
+func (s *Server) AddHost(host *mackerel.Host) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hosts = append(s.hosts, host)
+}
+
+// AddService registers a service and its roles as if they were created before
+func (s *Server) AddService(name string, roles ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.findService(name) == nil {
+		s.services = append(s.services, &mackerel.Service{Name: name, Roles: []string{}})
+	}
+	for _, role := range roles {
+		s.addRole(name, &mackerel.Role{Name: role})
+	}
+}
+
+func (s *Server) Requests() []*Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Request{}, s.requests...)
+}
+
+func (s *Server) Services() []*mackerel.Service {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*mackerel.Service{}, s.services...)
+}
+
+func (s *Server) Roles(service string) []*mackerel.Role {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*mackerel.Role{}, s.roles[service]...)
+}
+
+// RoleMetadata returns the role metadata of the namespace, or nil if it's not stored
+func (s *Server) RoleMetadata(service string, role string, namespace string) json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.roleMetadata[fmt.Sprintf("/api/v0/services/%s/roles/%s/metadata/%s", service, role, namespace)]
+}
+
+func (s *Server) Hosts() []*mackerel.Host {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*mackerel.Host{}, s.hosts...)
+}
+
+func (s *Server) GraphDefs() []*mackerel.GraphDefsParam {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*mackerel.GraphDefsParam{}, s.graphDefs...)
+}
+
+func (s *Server) Metrics() []*mackerel.HostMetricValue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*mackerel.HostMetricValue{}, s.metrics...)
+}
+
+func (s *Server) CheckReports() []*mackerel.CheckReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*mackerel.CheckReport{}, s.checkReports...)
+}
+
+func (s *Server) RetiredHostIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.retiredHostIDs...)
+}
+
+func (s *Server) GraphAnnotations() []*mackerel.GraphAnnotation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*mackerel.GraphAnnotation{}, s.graphAnnotations...)
+}
+
+func (s *Server) Dashboards() []*mackerel.Dashboard {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*mackerel.Dashboard{}, s.dashboards...)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	status := s.serve(w, r)
+	s.mu.Lock()
+	s.requests = append(s.requests, &Request{Method: r.Method, Path: r.URL.Path, Status: status})
+	s.mu.Unlock()
+}
+
+// serve responds the request and returns the status
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) int {
+	apiKey := r.Header.Get("X-Api-Key")
+	readOnly := s.ReadOnlyAPIKey != "" && apiKey == s.ReadOnlyAPIKey
+	if s.APIKey != "" && apiKey != s.APIKey && !readOnly {
+		return writeError(w, http.StatusForbidden, "Authentication failed")
+	}
+	if readOnly && r.Method != http.MethodGet {
+		return writeError(w, http.StatusForbidden, "Permission denied")
+	}
+	if failure := s.matchFailure(r); failure != nil {
+		select {
+		case <-r.Context().Done():
+			return 0
+		case <-time.After(failure.Delay):
+		}
+		return writeError(w, failure.Status, "injected failure")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := r.URL.Path
+	switch {
+	case r.Method == http.MethodPost && path == "/api/v0/hosts":
+		return s.createHost(w, r)
+	case r.Method == http.MethodGet && path == "/api/v0/hosts":
+		return s.findHosts(w, r)
+	case r.Method == http.MethodPost && path == "/api/v0/hosts/bulk-retire":
+		return s.bulkRetireHosts(w, r)
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/api/v0/hosts/") && strings.HasSuffix(path, "/retire"):
+		return s.retireHost(w, strings.TrimSuffix(strings.TrimPrefix(path, "/api/v0/hosts/"), "/retire"))
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/api/v0/hosts/"):
+		return s.findHost(w, strings.TrimPrefix(path, "/api/v0/hosts/"))
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/api/v0/hosts-by-custom-identifier/"):
+		return s.findHostByCustomIdentifier(w, strings.TrimPrefix(path, "/api/v0/hosts-by-custom-identifier/"))
+	case r.Method == http.MethodPost && path == "/api/v0/graph-defs/create":
+		var graphDefs []*mackerel.GraphDefsParam
+		if err := json.NewDecoder(r.Body).Decode(&graphDefs); err != nil {
+			return writeError(w, http.StatusBadRequest, err.Error())
+		}
+		s.graphDefs = append(s.graphDefs, graphDefs...)
+		return writeSuccess(w)
+	case r.Method == http.MethodPost && path == "/api/v0/tsdb":
+		return s.postMetrics(w, r)
+	case r.Method == http.MethodGet && path == "/api/v0/tsdb/latest":
+		return s.fetchLatestMetrics(w, r)
+	case r.Method == http.MethodPost && path == "/api/v0/monitoring/checks/report":
+		var reports mackerel.CheckReports
+		if err := json.NewDecoder(r.Body).Decode(&reports); err != nil {
+			return writeError(w, http.StatusBadRequest, err.Error())
+		}
+		s.checkReports = append(s.checkReports, reports.Reports...)
+		return writeSuccess(w)
+	case path == "/api/v0/monitors" || strings.HasPrefix(path, "/api/v0/monitors/"):
+		return s.serveMonitors(w, r)
+	case r.Method == http.MethodGet && path == "/api/v0/org":
+		return writeJSON(w, map[string]string{"name": "mackereltest"})
+	case strings.HasPrefix(path, "/api/v0/services/") && strings.Contains(path, "/metadata/"):
+		return s.serveRoleMetadata(w, r)
+	case path == "/api/v0/services":
+		return s.serveServices(w, r)
+	case strings.HasPrefix(path, "/api/v0/services/") && strings.HasSuffix(path, "/roles"):
+		return s.serveRoles(w, r, strings.TrimSuffix(strings.TrimPrefix(path, "/api/v0/services/"), "/roles"))
+	case path == "/api/v0/graph-annotations":
+		return s.serveGraphAnnotations(w, r)
+	case path == "/api/v0/dashboards" || strings.HasPrefix(path, "/api/v0/dashboards/"):
+		return s.serveDashboards(w, r)
+	default:
+		return writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *Server) serveServices(w http.ResponseWriter, r *http.Request) int {
+	switch r.Method {
+	case http.MethodGet:
+		return writeJSON(w, map[string]interface{}{"services": s.services})
+	case http.MethodPost:
+		param := &mackerel.CreateServiceParam{}
+		if err := json.NewDecoder(r.Body).Decode(param); err != nil {
+			return writeError(w, http.StatusBadRequest, err.Error())
+		}
+		if s.findService(param.Name) != nil {
+			return writeError(w, http.StatusBadRequest, "Service already exists.")
+		}
+		service := &mackerel.Service{Name: param.Name, Memo: param.Memo, Roles: []string{}}
+		s.services = append(s.services, service)
+		return writeJSON(w, service)
+	default:
+		return writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) serveRoles(w http.ResponseWriter, r *http.Request, service string) int {
+	if s.findService(service) == nil {
+		return writeError(w, http.StatusNotFound, "Service Not Found.")
+	}
+	switch r.Method {
+	case http.MethodGet:
+		roles := s.roles[service]
+		if roles == nil {
+			roles = []*mackerel.Role{}
+		}
+		return writeJSON(w, map[string]interface{}{"roles": roles})
+	case http.MethodPost:
+		role := &mackerel.Role{}
+		if err := json.NewDecoder(r.Body).Decode(role); err != nil {
+			return writeError(w, http.StatusBadRequest, err.Error())
+		}
+		for _, existing := range s.roles[service] {
+			if existing.Name == role.Name {
+				return writeError(w, http.StatusBadRequest, "Role already exists.")
+			}
+		}
+		s.addRole(service, role)
+		return writeJSON(w, role)
+	default:
+		return writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) findService(name string) *mackerel.Service {
+	for _, service := range s.services {
+		if service.Name == name {
+			return service
+		}
+	}
+	return nil
+}
+
+func (s *Server) addRole(service string, role *mackerel.Role) {
+	for _, r := range s.roles[service] {
+		if r.Name == role.Name {
+			return
+		}
+	}
+	s.roles[service] = append(s.roles[service], role)
+	found := s.findService(service)
+	found.Roles = append(found.Roles, role.Name)
+}
+
+func (s *Server) matchFailure(r *http.Request) *Failure {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.failures {
+		if (f.Method != "" && f.Method != r.Method) || !strings.HasPrefix(r.URL.Path, f.PathPrefix) {
+			continue
+		}
+		if f.Count > 0 {
+			f.Count--
+			if f.Count == 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+func (s *Server) createHost(w http.ResponseWriter, r *http.Request) int {
+	param := &mackerel.CreateHostParam{}
+	if err := json.NewDecoder(r.Body).Decode(param); err != nil {
+		return writeError(w, http.StatusBadRequest, err.Error())
+	}
+	if param.CustomIdentifier != "" && s.findByCustomIdentifier(param.CustomIdentifier) != nil {
+		return writeError(w, http.StatusConflict, "the custom identifier is already used")
+	}
+	host := &mackerel.Host{
+		ID:               randomID(),
+		Name:             param.Name,
+		DisplayName:      param.DisplayName,
+		CustomIdentifier: param.CustomIdentifier,
+		Meta:             param.Meta,
+		Status:           "working",
+		CreatedAt:        int32(time.Now().Unix()),
+		Roles:            make(mackerel.Roles),
+	}
+	for _, roleFullname := range param.RoleFullnames {
+		if service, role, ok := strings.Cut(roleFullname, ":"); ok {
+			host.Roles[service] = append(host.Roles[service], role)
+		}
+	}
+	s.hosts = append(s.hosts, host)
+	return writeJSON(w, map[string]string{"id": host.ID})
+}
+
+func (s *Server) findHosts(w http.ResponseWriter, r *http.Request) int {
+	query := r.URL.Query()
+	service := query.Get("service")
+	roles := query["role"]
+	hosts := make([]*mackerel.Host, 0)
+	for _, host := range s.hosts {
+		if host.IsRetired {
+			continue
+		}
+		if service != "" && !hasRole(host, service, roles) {
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return writeJSON(w, map[string]interface{}{"hosts": hosts})
+}
+
+func hasRole(host *mackerel.Host, service string, roles []string) bool {
+	hostRoles, ok := host.Roles[service]
+	if !ok {
+		return false
+	}
+	if len(roles) == 0 {
+		return true
+	}
+	for _, role := range roles {
+		for _, hostRole := range hostRoles {
+			if role == hostRole {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Server) findHost(w http.ResponseWriter, id string) int {
+	host := s.findByID(id)
+	if host == nil {
+		return writeError(w, http.StatusNotFound, "Host Not Found.")
+	}
+	return writeJSON(w, map[string]interface{}{"host": host})
+}
+
+func (s *Server) findHostByCustomIdentifier(w http.ResponseWriter, customIdentifier string) int {
+	host := s.findByCustomIdentifier(customIdentifier)
+	if host == nil {
+		return writeError(w, http.StatusNotFound, "Host Not Found.")
+	}
+	return writeJSON(w, map[string]interface{}{"host": host})
+}
+
+func (s *Server) retireHost(w http.ResponseWriter, id string) int {
+	host := s.findByID(id)
+	if host == nil || host.IsRetired {
+		return writeError(w, http.StatusNotFound, "Host Not Found.")
+	}
+	host.IsRetired = true
+	s.retiredHostIDs = append(s.retiredHostIDs, id)
+	return writeSuccess(w)
+}
+
+func (s *Server) bulkRetireHosts(w http.ResponseWriter, r *http.Request) int {
+	var param struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&param); err != nil {
+		return writeError(w, http.StatusBadRequest, err.Error())
+	}
+	for _, id := range param.IDs {
+		if host := s.findByID(id); host == nil || host.IsRetired {
+			return writeError(w, http.StatusNotFound, "Host Not Found.")
+		}
+	}
+	for _, id := range param.IDs {
+		s.findByID(id).IsRetired = true
+		s.retiredHostIDs = append(s.retiredHostIDs, id)
+	}
+	return writeSuccess(w)
+}
+
+func (s *Server) findByID(id string) *mackerel.Host {
+	for _, host := range s.hosts {
+		if host.ID == id {
+			return host
+		}
+	}
+	return nil
+}
+
+func (s *Server) findByCustomIdentifier(customIdentifier string) *mackerel.Host {
+	for _, host := range s.hosts {
+		if host.CustomIdentifier == customIdentifier && !host.IsRetired {
+			return host
+		}
+	}
+	return nil
+}
+
+func (s *Server) postMetrics(w http.ResponseWriter, r *http.Request) int {
+	var metrics []*mackerel.HostMetricValue
+	if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+		return writeError(w, http.StatusBadRequest, err.Error())
+	}
+	for _, m := range metrics {
+		if host := s.findByID(m.HostID); host == nil || host.IsRetired {
+			return writeError(w, http.StatusBadRequest, "Host Not Found: "+m.HostID)
+		}
+	}
+	s.metrics = append(s.metrics, metrics...)
+	return writeSuccess(w)
+}
+
+func (s *Server) fetchLatestMetrics(w http.ResponseWriter, r *http.Request) int {
+	query := r.URL.Query()
+	latest := make(mackerel.LatestMetricValues)
+	for _, hostID := range query["hostId"] {
+		latest[hostID] = make(map[string]*mackerel.MetricValue)
+		for _, name := range query["name"] {
+			latest[hostID][name] = nil
+		}
+	}
+	for _, m := range s.metrics {
+		values, ok := latest[m.HostID]
+		if !ok {
+			continue
+		}
+		if current, ok := values[m.Name]; ok && (current == nil || current.Time <= m.Time) {
+			values[m.Name] = m.MetricValue
+		}
+	}
+	return writeJSON(w, map[string]interface{}{"tsdbLatest": latest})
+}
+
+func (s *Server) serveMonitors(w http.ResponseWriter, r *http.Request) int {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v0/monitors"), "/")
+	switch r.Method {
+	case http.MethodGet:
+		if id == "" {
+			return writeJSON(w, map[string]interface{}{"monitors": s.monitors})
+		}
+		for _, m := range s.monitors {
+			if m["id"] == id {
+				return writeJSON(w, map[string]interface{}{"monitor": m})
+			}
+		}
+		return writeError(w, http.StatusNotFound, "Monitor Not Found.")
+	case http.MethodPost, http.MethodPut:
+		monitor := make(map[string]interface{})
+		if err := json.NewDecoder(r.Body).Decode(&monitor); err != nil {
+			return writeError(w, http.StatusBadRequest, err.Error())
+		}
+		if r.Method == http.MethodPost {
+			monitor["id"] = randomID()
+			s.monitors = append(s.monitors, monitor)
+			return writeJSON(w, monitor)
+		}
+		for i, m := range s.monitors {
+			if m["id"] == id {
+				monitor["id"] = id
+				s.monitors[i] = monitor
+				return writeJSON(w, monitor)
+			}
+		}
+		return writeError(w, http.StatusNotFound, "Monitor Not Found.")
+	default:
+		return writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) serveRoleMetadata(w http.ResponseWriter, r *http.Request) int {
+	key := r.URL.Path
+	switch r.Method {
+	case http.MethodGet:
+		metadata, ok := s.roleMetadata[key]
+		if !ok {
+			return writeError(w, http.StatusNotFound, "Metadata Not Found.")
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(metadata)
+		return http.StatusOK
+	case http.MethodPut:
+		var metadata json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+			return writeError(w, http.StatusBadRequest, err.Error())
+		}
+		s.roleMetadata[key] = metadata
+		return writeSuccess(w)
+	default:
+		return writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) serveGraphAnnotations(w http.ResponseWriter, r *http.Request) int {
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		service := query.Get("service")
+		from, _ := strconv.ParseInt(query.Get("from"), 10, 64)
+		to, _ := strconv.ParseInt(query.Get("to"), 10, 64)
+		annotations := make([]*mackerel.GraphAnnotation, 0)
+		for _, a := range s.graphAnnotations {
+			if a.Service == service && a.To >= from && a.From <= to {
+				annotations = append(annotations, a)
+			}
+		}
+		return writeJSON(w, map[string]interface{}{"graphAnnotations": annotations})
+	case http.MethodPost:
+		annotation := &mackerel.GraphAnnotation{}
+		if err := json.NewDecoder(r.Body).Decode(annotation); err != nil {
+			return writeError(w, http.StatusBadRequest, err.Error())
+		}
+		annotation.ID = randomID()
+		s.graphAnnotations = append(s.graphAnnotations, annotation)
+		return writeJSON(w, annotation)
+	default:
+		return writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) serveDashboards(w http.ResponseWriter, r *http.Request) int {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v0/dashboards"), "/")
+	switch r.Method {
+	case http.MethodGet:
+		return writeJSON(w, map[string]interface{}{"dashboards": s.dashboards})
+	case http.MethodPost, http.MethodPut:
+		dashboard := &mackerel.Dashboard{}
+		if err := json.NewDecoder(r.Body).Decode(dashboard); err != nil {
+			return writeError(w, http.StatusBadRequest, err.Error())
+		}
+		if r.Method == http.MethodPost {
+			dashboard.ID = randomID()
+			s.dashboards = append(s.dashboards, dashboard)
+			return writeJSON(w, dashboard)
+		}
+		for i, d := range s.dashboards {
+			if d.ID == id {
+				dashboard.ID = id
+				s.dashboards[i] = dashboard
+				return writeJSON(w, dashboard)
+			}
+		}
+		return writeError(w, http.StatusNotFound, "Dashboard Not Found.")
+	default:
+		return writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) int {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+	return http.StatusOK
+}
+
+func writeSuccess(w http.ResponseWriter) int {
+	return writeJSON(w, map[string]bool{"success": true})
+}
+
+func writeError(w http.ResponseWriter, status int, message string) int {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]string{"message": message},
+	})
+	return status
+}
+
+func randomID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
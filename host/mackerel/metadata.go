@@ -0,0 +1,102 @@
+package mackerel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// The role metadata shared by the agents in the role is split into the namespaces by its writers,
+// so that a write of one doesn't overwrite the others written at the same time by other environments.
+const (
+	// versionsNamespace keeps the versions seen in the role, written on the cold starts
+	versionsNamespace = "mackerel-lambda-extension-agent"
+	// reaperLockNamespace keeps the reaper lock, written by the reaper
+	reaperLockNamespace = "mackerel-lambda-extension-agent-reaper-lock"
+	// retireFailuresNamespace keeps the hosts which failed to retire, written on SHUTDOWN and by the reaper
+	retireFailuresNamespace = "mackerel-lambda-extension-agent-retire-failures"
+)
+
+// maxRoleMetaDataVersions is the number of versions remembered in the role metadata
+const maxRoleMetaDataVersions = 20
+
+type versionsMetaData struct {
+	FunctionVersions []string `json:"functionVersions,omitempty"`
+	RuntimeVersions  []string `json:"runtimeVersions,omitempty"`
+}
+
+type reaperLockMetaData struct {
+	LockedUntil int64 `json:"lockedUntil,omitempty"`
+	// LockedBy is the host holding the reaper lock
+	LockedBy string `json:"lockedBy,omitempty"`
+}
+
+type retireFailuresMetaData struct {
+	// HostIDs are the hosts which failed to retire on SHUTDOWN, retired by the reaper regardless of the TTL
+	HostIDs []string `json:"hostIds,omitempty"`
+}
+
+func splitRoleFullname(roleFullname string) (string, string, error) {
+	service, role, ok := strings.Cut(roleFullname, ":")
+	if !ok {
+		return "", "", fmt.Errorf("invalid role full name: %s", roleFullname)
+	}
+	return strings.TrimSpace(service), strings.TrimSpace(role), nil
+}
+
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*mackerel.APIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// getRoleMetaData reads the role metadata of the namespace into md. md is left as it is if it's not stored yet.
+func getRoleMetaData(client *mackerel.Client, service string, role string, namespace string, md interface{}) error {
+	res, err := client.GetRoleMetaData(service, role, namespace)
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	s, err := json.Marshal(res.RoleMetaData)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(s, md)
+}
+
+func putRoleMetaData(client *mackerel.Client, service string, role string, namespace string, md interface{}) error {
+	return client.PutRoleMetaData(service, role, namespace, md)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// removeStrings returns the values except the removed ones
+func removeStrings(values []string, removed []string) []string {
+	kept := make([]string, 0, len(values))
+	for _, v := range values {
+		if !containsString(removed, v) {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// appendVersion appends the version forgetting the oldest ones beyond maxRoleMetaDataVersions
+func appendVersion(versions []string, version string) []string {
+	versions = append(versions, version)
+	if len(versions) > maxRoleMetaDataVersions {
+		versions = versions[len(versions)-maxRoleMetaDataVersions:]
+	}
+	return versions
+}
@@ -0,0 +1,195 @@
+package mackerel
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+const (
+	monitorNamePrefix = "lambda"
+	provisionedMemo   = "Provisioned by mackerel-lambda-extension-agent"
+)
+
+// ProvisionedMonitor is the result of the provisioning of a monitor
+type ProvisionedMonitor struct {
+	Name string
+	// Action is created, updated or unchanged
+	Action string
+}
+
+// ProvisionMonitors creates or updates the monitors declared in conf.
+// Existing monitors are looked up by name, and only the fields managed by the agent are compared and updated,
+// so provisioning is idempotent and keeps the fields edited by operators such as muting.
+// It's meant to run once per deployment, not on every cold start, since the lookup and the creation aren't atomic.
+func ProvisionMonitors(apiKey string, conf *MonitorConfig, roleFullnames []string) ([]*ProvisionedMonitor, error) {
+	if len(roleFullnames) == 0 {
+		return nil, errors.New("EXT_MACKEREL_ROLE_FULL_NAMES is required to provision monitors")
+	}
+	monitors := desiredMonitors(conf, roleFullnames)
+	if len(monitors) == 0 {
+		return nil, errors.New("no monitors are declared, set the thresholds of EXT_MACKEREL_MONITOR_*")
+	}
+	client := newClient(apiKey)
+
+	existingMonitors, err := client.FindMonitors()
+	if err != nil {
+		return nil, err
+	}
+	monitorsByName := make(map[string]mackerel.Monitor, len(existingMonitors))
+	for _, monitor := range existingMonitors {
+		monitorsByName[monitor.MonitorName()] = monitor
+	}
+
+	results := make([]*ProvisionedMonitor, 0, len(monitors))
+	for _, monitor := range monitors {
+		existing, ok := monitorsByName[monitor.MonitorName()]
+		if !ok {
+			Logger.Info("creating monitor:", monitor.MonitorName())
+			if _, err := client.CreateMonitor(monitor); err != nil {
+				return results, err
+			}
+			results = append(results, &ProvisionedMonitor{Name: monitor.MonitorName(), Action: "created"})
+			continue
+		}
+		if existing.MonitorType() != monitor.MonitorType() {
+			return results, fmt.Errorf("monitor %q already exists with another type %q", monitor.MonitorName(), existing.MonitorType())
+		}
+		updated, changed := applyManagedFields(existing, monitor)
+		if !changed {
+			results = append(results, &ProvisionedMonitor{Name: monitor.MonitorName(), Action: "unchanged"})
+			continue
+		}
+		Logger.Info("updating monitor:", monitor.MonitorName())
+		if _, err := client.UpdateMonitor(existing.MonitorID(), updated); err != nil {
+			return results, err
+		}
+		results = append(results, &ProvisionedMonitor{Name: monitor.MonitorName(), Action: "updated"})
+	}
+	return results, nil
+}
+
+func desiredMonitors(conf *MonitorConfig, roleFullnames []string) []mackerel.Monitor {
+	scope := strings.Join(roleFullnames, ",")
+	monitors := make([]mackerel.Monitor, 0, len(roleFullnames)+2)
+
+	if conf.ErrorRateWarning != nil || conf.ErrorRateCritical != nil {
+		for _, roleFullname := range roleFullnames {
+			roleName := strings.ReplaceAll(roleFullname, " ", "")
+			monitors = append(monitors, &mackerel.MonitorExpression{
+				Name:                 fmt.Sprintf("%s error rate %s", monitorNamePrefix, roleName),
+				Memo:                 provisionedMemo,
+				Type:                 "expression",
+				Expression:           errorRateExpression(roleName),
+				Operator:             ">",
+				Warning:              conf.ErrorRateWarning,
+				Critical:             conf.ErrorRateCritical,
+				NotificationInterval: conf.NotificationInterval,
+			})
+		}
+	}
+
+	if conf.DurationP99Warning != nil || conf.DurationP99Critical != nil {
+		monitors = append(monitors, &mackerel.MonitorHostMetric{
+			Name:                 fmt.Sprintf("%s p99 duration %s", monitorNamePrefix, scope),
+			Memo:                 provisionedMemo,
+			Type:                 "host",
+			Metric:               "custom.lambda.platform.report.duration.p99",
+			Operator:             ">",
+			Warning:              conf.DurationP99Warning,
+			Critical:             conf.DurationP99Critical,
+			Duration:             1,
+			MaxCheckAttempts:     1,
+			Scopes:               roleFullnames,
+			NotificationInterval: conf.NotificationInterval,
+		})
+	}
+
+	if conf.MemoryUtilizationWarning != nil || conf.MemoryUtilizationCritical != nil {
+		monitors = append(monitors, &mackerel.MonitorHostMetric{
+			Name:                 fmt.Sprintf("%s memory utilization %s", monitorNamePrefix, scope),
+			Memo:                 provisionedMemo,
+			Type:                 "host",
+			Metric:               "custom.lambda.platform.report.memoryUtilization.max",
+			Operator:             ">",
+			Warning:              conf.MemoryUtilizationWarning,
+			Critical:             conf.MemoryUtilizationCritical,
+			Duration:             1,
+			MaxCheckAttempts:     1,
+			Scopes:               roleFullnames,
+			NotificationInterval: conf.NotificationInterval,
+		})
+	}
+
+	return monitors
+}
+
+// errorRateExpression returns the expression of the error rate of the role in percent
+func errorRateExpression(roleFullname string) string {
+	return fmt.Sprintf(
+		"scale(divide(sum(role(%s, custom.lambda.platform.runtimeDone.invocations.errors)), sum(role(%s, custom.lambda.platform.runtimeDone.invocations.count))), 100)",
+		roleFullname, roleFullname,
+	)
+}
+
+// applyManagedFields copies the fields managed by the agent from desired onto a copy of existing,
+// and reports whether any of them differs. The other fields like isMute and excludeScopes are kept as they are.
+func applyManagedFields(existing mackerel.Monitor, desired mackerel.Monitor) (mackerel.Monitor, bool) {
+	switch e := existing.(type) {
+	case *mackerel.MonitorExpression:
+		d := desired.(*mackerel.MonitorExpression)
+		changed := e.Memo != d.Memo ||
+			e.Expression != d.Expression ||
+			e.Operator != d.Operator ||
+			!equalThreshold(e.Warning, d.Warning) ||
+			!equalThreshold(e.Critical, d.Critical) ||
+			e.NotificationInterval != d.NotificationInterval
+		m := *e
+		m.Memo, m.Expression, m.Operator = d.Memo, d.Expression, d.Operator
+		m.Warning, m.Critical, m.NotificationInterval = d.Warning, d.Critical, d.NotificationInterval
+		return &m, changed
+	case *mackerel.MonitorHostMetric:
+		d := desired.(*mackerel.MonitorHostMetric)
+		changed := e.Memo != d.Memo ||
+			e.Metric != d.Metric ||
+			e.Operator != d.Operator ||
+			!equalThreshold(e.Warning, d.Warning) ||
+			!equalThreshold(e.Critical, d.Critical) ||
+			e.Duration != d.Duration ||
+			e.MaxCheckAttempts != d.MaxCheckAttempts ||
+			!equalStringSets(e.Scopes, d.Scopes) ||
+			e.NotificationInterval != d.NotificationInterval
+		m := *e
+		m.Memo, m.Metric, m.Operator = d.Memo, d.Metric, d.Operator
+		m.Warning, m.Critical, m.NotificationInterval = d.Warning, d.Critical, d.NotificationInterval
+		m.Duration, m.MaxCheckAttempts, m.Scopes = d.Duration, d.MaxCheckAttempts, d.Scopes
+		return &m, changed
+	}
+	return desired, true
+}
+
+func equalThreshold(a *float64, b *float64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func equalStringSets(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sortedA := append([]string{}, a...)
+	sortedB := append([]string{}, b...)
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+	for i := range sortedA {
+		if sortedA[i] != sortedB[i] {
+			return false
+		}
+	}
+	return true
+}
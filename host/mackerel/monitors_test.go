@@ -0,0 +1,180 @@
+package mackerel
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+func threshold(v float64) *float64 {
+	return &v
+}
+
+func provisionedActions(results []*ProvisionedMonitor) map[string]string {
+	actions := make(map[string]string, len(results))
+	for _, r := range results {
+		actions[r.Name] = r.Action
+	}
+	return actions
+}
+
+func TestDesiredMonitors(t *testing.T) {
+	roles := []string{"lambda:sample-function", "lambda:other function"}
+	if monitors := desiredMonitors(&MonitorConfig{}, roles); len(monitors) != 0 {
+		t.Errorf("monitors = %d, want none without the thresholds", len(monitors))
+	}
+
+	monitors := desiredMonitors(&MonitorConfig{
+		ErrorRateCritical:        threshold(10),
+		DurationP99Warning:       threshold(3000),
+		MemoryUtilizationWarning: threshold(80),
+		NotificationInterval:     60,
+	}, roles)
+	names := make([]string, 0, len(monitors))
+	for _, m := range monitors {
+		names = append(names, m.MonitorName())
+	}
+	want := []string{
+		"lambda error rate lambda:sample-function",
+		"lambda error rate lambda:otherfunction",
+		"lambda p99 duration lambda:sample-function,lambda:other function",
+		"lambda memory utilization lambda:sample-function,lambda:other function",
+	}
+	if strings.Join(names, "\n") != strings.Join(want, "\n") {
+		t.Errorf("names = %q, want %q", names, want)
+	}
+
+	errorRate := monitors[0].(*mackerel.MonitorExpression)
+	if errorRate.Expression != errorRateExpression("lambda:sample-function") || errorRate.Warning != nil || *errorRate.Critical != 10 || errorRate.NotificationInterval != 60 {
+		t.Errorf("error rate = %+v", errorRate)
+	}
+	duration := monitors[2].(*mackerel.MonitorHostMetric)
+	if duration.Metric != "custom.lambda.platform.report.duration.p99" || *duration.Warning != 3000 || duration.Critical != nil || len(duration.Scopes) != 2 {
+		t.Errorf("p99 duration = %+v", duration)
+	}
+}
+
+func TestApplyManagedFields(t *testing.T) {
+	desired := &mackerel.MonitorHostMetric{
+		Name: "lambda p99 duration", Memo: provisionedMemo, Type: "host", Metric: "custom.lambda.platform.report.duration.p99",
+		Operator: ">", Warning: threshold(3000), Duration: 1, MaxCheckAttempts: 1, Scopes: []string{"lambda:a", "lambda:b"},
+	}
+	existing := *desired
+	existing.ID = "monitor-id"
+	existing.IsMute = true
+	existing.ExcludeScopes = []string{"lambda:a"}
+	existing.Warning = threshold(3000)
+	existing.Scopes = []string{"lambda:b", "lambda:a"}
+
+	if _, changed := applyManagedFields(&existing, desired); changed {
+		t.Error("changed = true, want false for the same thresholds and the scopes in another order")
+	}
+
+	desired.Critical = threshold(5000)
+	updated, changed := applyManagedFields(&existing, desired)
+	if !changed {
+		t.Fatal("changed = false, want true for the new critical threshold")
+	}
+	m := updated.(*mackerel.MonitorHostMetric)
+	if m.ID != "monitor-id" || !m.IsMute || len(m.ExcludeScopes) != 1 || *m.Critical != 5000 {
+		t.Errorf("updated = %+v, want the critical threshold changed keeping the fields of the operators", m)
+	}
+	if existing.Critical != nil {
+		t.Error("the existing monitor is modified")
+	}
+}
+
+func TestProvisionMonitors(t *testing.T) {
+	newTestServer(t)
+	roles := []string{"lambda:sample-function"}
+	conf := &MonitorConfig{ErrorRateWarning: threshold(5), DurationP99Critical: threshold(3000)}
+
+	results, err := ProvisionMonitors("test-api-key", conf, roles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"lambda error rate lambda:sample-function":   "created",
+		"lambda p99 duration lambda:sample-function": "created",
+	}
+	if got := provisionedActions(results); !reflect.DeepEqual(got, want) {
+		t.Errorf("first = %v, want %v", got, want)
+	}
+
+	results, err = ProvisionMonitors("test-api-key", conf, roles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range want {
+		want[name] = "unchanged"
+	}
+	if got := provisionedActions(results); !reflect.DeepEqual(got, want) {
+		t.Errorf("second = %v, want %v", got, want)
+	}
+
+	// an operator mutes the monitor, and then the threshold is changed
+	client := newClient("test-api-key")
+	monitors, err := client.FindMonitors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range monitors {
+		if h, ok := m.(*mackerel.MonitorHostMetric); ok {
+			h.IsMute = true
+			if _, err := client.UpdateMonitor(h.ID, h); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	conf.DurationP99Critical = threshold(5000)
+	results, err = ProvisionMonitors("test-api-key", conf, roles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want["lambda p99 duration lambda:sample-function"] = "updated"
+	if got := provisionedActions(results); !reflect.DeepEqual(got, want) {
+		t.Errorf("third = %v, want %v", got, want)
+	}
+
+	monitors, err = client.FindMonitors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(monitors) != 2 {
+		t.Fatalf("monitors = %d, want 2", len(monitors))
+	}
+	for _, m := range monitors {
+		if h, ok := m.(*mackerel.MonitorHostMetric); ok && (!h.IsMute || *h.Critical != 5000) {
+			t.Errorf("p99 duration = %+v, want muted with the new threshold", h)
+		}
+	}
+}
+
+func TestProvisionMonitorsErrors(t *testing.T) {
+	newTestServer(t)
+	client := newClient("test-api-key")
+	// a monitor of another type has the name
+	if _, err := client.CreateMonitor(&mackerel.MonitorHostMetric{
+		Name: "lambda error rate lambda:sample-function", Type: "host", Metric: "loadavg5", Operator: ">", Warning: threshold(1), Duration: 1,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		conf  *MonitorConfig
+		roles []string
+		want  string
+	}{
+		{&MonitorConfig{ErrorRateWarning: threshold(5)}, nil, "EXT_MACKEREL_ROLE_FULL_NAMES is required"},
+		{&MonitorConfig{}, []string{"lambda:sample-function"}, "no monitors are declared"},
+		{&MonitorConfig{ErrorRateWarning: threshold(5)}, []string{"lambda:sample-function"}, `already exists with another type "host"`},
+	}
+	for _, tt := range tests {
+		_, err := ProvisionMonitors("test-api-key", tt.conf, tt.roles)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("err = %v, want %s", err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package mackerel
+
+import (
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// agentName marks the hosts registered by this extension in their meta
+const agentName = "mackerel-lambda-extension-agent"
+
+// reaperFetchBatchSize is the number of hosts whose latest metrics are fetched at once
+const reaperFetchBatchSize = 100
+
+// reaperLivenessMetricNames are posted on every dispatch, so their latest values tell when the host was last alive
+var reaperLivenessMetricNames = []string{
+	"custom.lambda.osstat.loadavg.loadavg1",
+	"custom.lambda.platform.runtimeDone.invocations.count",
+}
+
+// ReapOrphanedHosts retires the hosts in the roles which were registered by this extension but haven't posted
+// metrics for conf.TTL, e.g. because their environment was killed without SHUTDOWN.
+// Reaping is rate-limited per role by a lock stored in the role metadata.
+func (h *Host) ReapOrphanedHosts(conf *ReaperConfig, roleFullnames []string, now time.Time) error {
+	if !conf.Enabled {
+		return nil
+	}
+	for _, roleFullname := range roleFullnames {
+		service, role, err := splitRoleFullname(roleFullname)
+		if err != nil {
+			return err
+		}
+		locked, err := h.lockReaper(service, role, now, now.Add(conf.Interval))
+		if err != nil {
+			return err
+		}
+		if !locked {
+			Logger.Info("reaper is locked by another environment:", roleFullname)
+			continue
+		}
+		failures := &retireFailuresMetaData{}
+		if err := getRoleMetaData(h.client, service, role, retireFailuresNamespace, failures); err != nil {
+			return err
+		}
+		if err := h.reapOrphanedHosts(conf, service, role, failures.HostIDs, now); err != nil {
+			return err
+		}
+		if len(failures.HostIDs) > 0 {
+			// read again not to drop the hosts recorded while reaping
+			latest := &retireFailuresMetaData{}
+			if err := getRoleMetaData(h.client, service, role, retireFailuresNamespace, latest); err != nil {
+				return err
+			}
+			latest.HostIDs = removeStrings(latest.HostIDs, failures.HostIDs)
+			if err := putRoleMetaData(h.client, service, role, retireFailuresNamespace, latest); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lockReaper takes the reaper lock of the role until the given time. It returns false if another environment holds the lock.
+// The metadata has no compare-and-swap, so the lock is read back to give way to an environment which wrote it later,
+// but the environments writing it at the same time may reap together. Reaping is idempotent, so it only costs the API calls.
+func (h *Host) lockReaper(service string, role string, now time.Time, until time.Time) (bool, error) {
+	lock := &reaperLockMetaData{}
+	if err := getRoleMetaData(h.client, service, role, reaperLockNamespace, lock); err != nil {
+		return false, err
+	}
+	if time.Unix(lock.LockedUntil, 0).After(now) {
+		return false, nil
+	}
+	lock = &reaperLockMetaData{LockedUntil: until.Unix(), LockedBy: h.currentID()}
+	if err := putRoleMetaData(h.client, service, role, reaperLockNamespace, lock); err != nil {
+		return false, err
+	}
+
+	locked := &reaperLockMetaData{}
+	if err := getRoleMetaData(h.client, service, role, reaperLockNamespace, locked); err != nil {
+		return false, err
+	}
+	return locked.LockedBy == h.currentID(), nil
+}
+
+// RecordRetireFailure records the host in the role metadata so that the reaper retires it regardless of the TTL.
+func (h *Host) RecordRetireFailure(roleFullnames []string) error {
+	for _, roleFullname := range roleFullnames {
+		service, role, err := splitRoleFullname(roleFullname)
+		if err != nil {
+			return err
+		}
+		failures := &retireFailuresMetaData{}
+		if err := getRoleMetaData(h.client, service, role, retireFailuresNamespace, failures); err != nil {
+			return err
+		}
+		if containsString(failures.HostIDs, h.currentID()) {
+			continue
+		}
+		failures.HostIDs = append(failures.HostIDs, h.currentID())
+		if err := putRoleMetaData(h.client, service, role, retireFailuresNamespace, failures); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Host) reapOrphanedHosts(conf *ReaperConfig, service string, role string, retireFailedHostIDs []string, now time.Time) error {
+	hosts, err := h.client.FindHosts(&mackerel.FindHostsParam{Service: service, Roles: []string{role}})
+	if err != nil {
+		return err
+	}
+
+	orphanedHostIDs := make([]string, 0, len(retireFailedHostIDs))
+	candidates := make([]*mackerel.Host, 0, len(hosts))
+	for _, host := range hosts {
+		if host.ID == h.currentID() || host.IsRetired || host.Meta.AgentName != agentName {
+			continue
+		}
+		if containsString(retireFailedHostIDs, host.ID) {
+			orphanedHostIDs = append(orphanedHostIDs, host.ID)
+			continue
+		}
+		if now.Sub(host.DateFromCreatedAt()) < conf.TTL {
+			continue
+		}
+		candidates = append(candidates, host)
+	}
+
+	for start := 0; start < len(candidates); start += reaperFetchBatchSize {
+		end := start + reaperFetchBatchSize
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+		hostIDs := make([]string, 0, end-start)
+		for _, host := range candidates[start:end] {
+			hostIDs = append(hostIDs, host.ID)
+		}
+		latestMetricValues, err := h.client.FetchLatestMetricValues(hostIDs, reaperLivenessMetricNames)
+		if err != nil {
+			return err
+		}
+		for _, host := range candidates[start:end] {
+			lastPostedAt := host.DateFromCreatedAt()
+			for _, metricValue := range latestMetricValues[host.ID] {
+				if metricValue != nil && time.Unix(metricValue.Time, 0).After(lastPostedAt) {
+					lastPostedAt = time.Unix(metricValue.Time, 0)
+				}
+			}
+			if now.Sub(lastPostedAt) >= conf.TTL {
+				orphanedHostIDs = append(orphanedHostIDs, host.ID)
+			}
+		}
+	}
+
+	if len(orphanedHostIDs) == 0 {
+		return nil
+	}
+	Logger.Info("retiring orphaned hosts:", orphanedHostIDs)
+	return h.retireHosts(orphanedHostIDs)
+}
+
+// retireHosts retires the hosts at once. If some of them are gone, e.g. retired by another environment reaping
+// at the same time, it retires the rest one by one.
+func (h *Host) retireHosts(hostIDs []string) error {
+	err := h.client.BulkRetireHosts(hostIDs)
+	if err == nil || !isNotFound(err) {
+		return err
+	}
+	for _, hostID := range hostIDs {
+		if err := h.client.RetireHost(hostID); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
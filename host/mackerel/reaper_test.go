@@ -0,0 +1,147 @@
+package mackerel
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/host/mackerel/mackereltest"
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// addRoleHost registers a host in lambda:sample-function created at the time, as if by another environment
+func addRoleHost(server *mackereltest.Server, id string, agent string, createdAt time.Time) {
+	server.AddHost(&mackerel.Host{
+		ID:        id,
+		Name:      id,
+		Meta:      mackerel.HostMeta{AgentName: agent},
+		Roles:     mackerel.Roles{"lambda": []string{"sample-function"}},
+		CreatedAt: int32(createdAt.Unix()),
+	})
+}
+
+func newTestReaper(t *testing.T) (*mackereltest.Server, *Host, *ReaperConfig) {
+	server := newTestServer(t)
+	host, err := CreateOrGetHost(newTestHostParam())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, host, &ReaperConfig{Enabled: true, TTL: time.Hour, Interval: 10 * time.Minute}
+}
+
+func retiredIDs(server *mackereltest.Server) []string {
+	ids := server.RetiredHostIDs()
+	sort.Strings(ids)
+	return ids
+}
+
+func TestReapOrphanedHostsRetiresHostsBeyondTTL(t *testing.T) {
+	server, host, conf := newTestReaper(t)
+	now := time.Now()
+	addRoleHost(server, "orphaned", agentName, now.Add(-2*time.Hour))
+	addRoleHost(server, "alive", agentName, now.Add(-2*time.Hour))
+	addRoleHost(server, "young", agentName, now.Add(-10*time.Minute))
+	addRoleHost(server, "other-agent", "mackerel-agent", now.Add(-2*time.Hour))
+	if err := host.client.PostHostMetricValuesByHostID("alive", []*mackerel.MetricValue{
+		{Name: "custom.lambda.osstat.loadavg.loadavg1", Time: now.Add(-10 * time.Minute).Unix(), Value: 0.5},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := host.ReapOrphanedHosts(conf, []string{"lambda:sample-function"}, now); err != nil {
+		t.Fatal(err)
+	}
+	if got := retiredIDs(server); !reflect.DeepEqual(got, []string{"orphaned"}) {
+		t.Errorf("retired = %v, want only the host of this extension beyond the TTL", got)
+	}
+}
+
+func TestReapOrphanedHostsRetiresRecordedFailures(t *testing.T) {
+	server, host, conf := newTestReaper(t)
+	now := time.Now()
+	addRoleHost(server, "failed", agentName, now.Add(-time.Minute))
+
+	failed := &Host{client: host.client, ID: "failed"}
+	if err := failed.RecordRetireFailure([]string{"lambda:sample-function"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := host.ReapOrphanedHosts(conf, []string{"lambda:sample-function"}, now); err != nil {
+		t.Fatal(err)
+	}
+	if got := retiredIDs(server); !reflect.DeepEqual(got, []string{"failed"}) {
+		t.Errorf("retired = %v, want the recorded host regardless of the TTL", got)
+	}
+	var failures retireFailuresMetaData
+	if err := json.Unmarshal(server.RoleMetadata("lambda", "sample-function", retireFailuresNamespace), &failures); err != nil {
+		t.Fatal(err)
+	}
+	if len(failures.HostIDs) != 0 {
+		t.Errorf("retire failures = %v, want cleared after reaping", failures.HostIDs)
+	}
+	if server.RoleMetadata("lambda", "sample-function", versionsNamespace) != nil {
+		t.Error("the versions namespace is written by the reaper")
+	}
+}
+
+func TestReapOrphanedHostsSkipsRoleLockedByAnotherEnvironment(t *testing.T) {
+	server, host, conf := newTestReaper(t)
+	now := time.Now()
+	addRoleHost(server, "orphaned", agentName, now.Add(-2*time.Hour))
+	if err := putRoleMetaData(host.client, "lambda", "sample-function", reaperLockNamespace, &reaperLockMetaData{
+		LockedUntil: now.Add(5 * time.Minute).Unix(),
+		LockedBy:    "another-host",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := host.ReapOrphanedHosts(conf, []string{"lambda:sample-function"}, now); err != nil {
+		t.Fatal(err)
+	}
+	if got := retiredIDs(server); len(got) != 0 {
+		t.Errorf("retired = %v, want nothing while another environment holds the lock", got)
+	}
+
+	// the lock has expired
+	later := now.Add(10 * time.Minute)
+	if err := host.ReapOrphanedHosts(conf, []string{"lambda:sample-function"}, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := retiredIDs(server); !reflect.DeepEqual(got, []string{"orphaned"}) {
+		t.Errorf("retired = %v, want the orphaned host after the lock expired", got)
+	}
+	var lock reaperLockMetaData
+	if err := json.Unmarshal(server.RoleMetadata("lambda", "sample-function", reaperLockNamespace), &lock); err != nil {
+		t.Fatal(err)
+	}
+	if lock.LockedBy != host.currentID() || lock.LockedUntil != later.Add(conf.Interval).Unix() {
+		t.Errorf("lock = %+v, want held by %s until %d", lock, host.currentID(), later.Add(conf.Interval).Unix())
+	}
+
+	// the lock taken above rate-limits the next reaping
+	addRoleHost(server, "orphaned-later", agentName, now.Add(-2*time.Hour))
+	if err := host.ReapOrphanedHosts(conf, []string{"lambda:sample-function"}, later.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if got := retiredIDs(server); len(got) != 1 {
+		t.Errorf("retired = %v, want no reaping within the interval", got)
+	}
+}
+
+func TestRetireHostsSkipsHostsAlreadyRetired(t *testing.T) {
+	server, host, _ := newTestReaper(t)
+	now := time.Now()
+	addRoleHost(server, "orphaned", agentName, now.Add(-2*time.Hour))
+	addRoleHost(server, "reaped", agentName, now.Add(-2*time.Hour))
+	if err := host.client.RetireHost("reaped"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := host.retireHosts([]string{"orphaned", "reaped"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := retiredIDs(server); !reflect.DeepEqual(got, []string{"orphaned", "reaped"}) {
+		t.Errorf("retired = %v, want both", got)
+	}
+}
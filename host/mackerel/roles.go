@@ -0,0 +1,101 @@
+package mackerel
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+const (
+	// DefaultService is the service of the default role of the function
+	DefaultService = "lambda"
+	// maxRoleNameLength is the maximum length of the names of the services and the roles
+	maxRoleNameLength = 63
+)
+
+// DefaultRoleFullname returns the role full name the hosts of the function belong to when no role is configured
+func DefaultRoleFullname(functionName string) string {
+	role := functionName
+	if len(role) > maxRoleNameLength {
+		role = role[:maxRoleNameLength]
+	}
+	return DefaultService + ":" + role
+}
+
+// CreateMissingRoles creates the services and the roles of roleFullnames which don't exist yet, with the memo noting the function
+func CreateMissingRoles(apiKey string, roleFullnames []string, functionName string) error {
+	if apiKey == "" {
+		return errors.New("MackerelApiKey is not set")
+	}
+	client := newClient(apiKey)
+	memo := fmt.Sprintf("Created by %s for the Lambda function %s", agentName, functionName)
+
+	services, err := client.FindServices()
+	if err != nil {
+		return err
+	}
+	roles := make(map[string][]string)
+	for _, s := range services {
+		roles[s.Name] = s.Roles
+	}
+
+	for _, roleFullname := range roleFullnames {
+		service, role, err := splitRoleFullname(roleFullname)
+		if err != nil {
+			return err
+		}
+		if _, ok := roles[service]; !ok {
+			if err := createService(client, service, memo); err != nil {
+				return err
+			}
+			roles[service] = []string{}
+		}
+		if containsString(roles[service], role) {
+			continue
+		}
+		if err := createRole(client, service, role, memo); err != nil {
+			return err
+		}
+		roles[service] = append(roles[service], role)
+	}
+	return nil
+}
+
+// createService creates the service. It succeeds if another environment of the function has created it meanwhile.
+func createService(client *mackerel.Client, service string, memo string) error {
+	Logger.Info("creating service:", service)
+	_, err := client.CreateService(&mackerel.CreateServiceParam{Name: service, Memo: memo})
+	if err == nil {
+		return nil
+	}
+	services, findErr := client.FindServices()
+	if findErr != nil {
+		return err
+	}
+	for _, s := range services {
+		if s.Name == service {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to create the service %s: %w", service, err)
+}
+
+// createRole creates the role. It succeeds if another environment of the function has created it meanwhile.
+func createRole(client *mackerel.Client, service string, role string, memo string) error {
+	Logger.Info("creating role:", service+":"+role)
+	_, err := client.CreateRole(service, &mackerel.CreateRoleParam{Name: role, Memo: memo})
+	if err == nil {
+		return nil
+	}
+	roles, findErr := client.FindRoles(service)
+	if findErr != nil {
+		return err
+	}
+	for _, r := range roles {
+		if r.Name == role {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to create the role %s:%s: %w", service, role, err)
+}
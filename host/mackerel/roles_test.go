@@ -0,0 +1,111 @@
+package mackerel
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/host/mackerel/mackereltest"
+)
+
+func roleNames(server *mackereltest.Server, service string) []string {
+	names := make([]string, 0)
+	for _, r := range server.Roles(service) {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+func TestDefaultRoleFullname(t *testing.T) {
+	if got := DefaultRoleFullname("sample-function"); got != "lambda:sample-function" {
+		t.Errorf("DefaultRoleFullname = %s", got)
+	}
+	long := strings.Repeat("a", 70)
+	if got := DefaultRoleFullname(long); got != "lambda:"+strings.Repeat("a", maxRoleNameLength) {
+		t.Errorf("DefaultRoleFullname = %s, want the role truncated to %d characters", got, maxRoleNameLength)
+	}
+}
+
+func TestCreateMissingRoles(t *testing.T) {
+	server := newTestServer(t)
+	server.AddService("web", "api")
+
+	roles := []string{"lambda:sample-function", "lambda:worker", "web:api", "web:batch"}
+	if err := CreateMissingRoles("test-api-key", roles, "sample-function"); err != nil {
+		t.Fatal(err)
+	}
+	if got := roleNames(server, "lambda"); strings.Join(got, ",") != "sample-function,worker" {
+		t.Errorf("roles of lambda = %v", got)
+	}
+	if got := roleNames(server, "web"); strings.Join(got, ",") != "api,batch" {
+		t.Errorf("roles of web = %v", got)
+	}
+	for _, s := range server.Services() {
+		if s.Name == "lambda" && s.Memo != "Created by mackerel-lambda-extension-agent for the Lambda function sample-function" {
+			t.Errorf("memo = %q", s.Memo)
+		}
+	}
+
+	// the existing ones aren't created again
+	if err := CreateMissingRoles("test-api-key", roles, "sample-function"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRequests(server, http.MethodPost, "/api/v0/services", http.StatusOK); n != 1 {
+		t.Errorf("created services = %d, want 1", n)
+	}
+	if n := len(server.Services()); n != 2 {
+		t.Errorf("services = %d, want 2", n)
+	}
+}
+
+func TestCreateRoleCreatedMeanwhile(t *testing.T) {
+	server := newTestServer(t)
+	// another environment of the function has created them after this one listed the services
+	server.AddService("lambda", "sample-function")
+	client := newClient("test-api-key")
+
+	if err := createService(client, "lambda", "memo"); err != nil {
+		t.Errorf("createService = %v, want nil for the existing service", err)
+	}
+	if err := createRole(client, "lambda", "sample-function", "memo"); err != nil {
+		t.Errorf("createRole = %v, want nil for the existing role", err)
+	}
+	if got := roleNames(server, "lambda"); len(got) != 1 {
+		t.Errorf("roles = %v, want 1", got)
+	}
+}
+
+func TestCreateMissingRolesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		apiKey  string
+		roles   []string
+		failure *mackereltest.Failure
+		want    string
+	}{
+		{"no API key", "", []string{"lambda:sample-function"}, nil, "MackerelApiKey is not set"},
+		{"invalid role", "test-api-key", []string{"sample-function"}, nil, "invalid role full name: sample-function"},
+		{
+			"service creation failure", "test-api-key", []string{"lambda:sample-function"},
+			&mackereltest.Failure{Method: http.MethodPost, PathPrefix: "/api/v0/services", Status: http.StatusInternalServerError, Count: 1},
+			"failed to create the service lambda",
+		},
+		{
+			"role creation failure", "test-api-key", []string{"lambda:sample-function"},
+			&mackereltest.Failure{Method: http.MethodPost, PathPrefix: "/api/v0/services/lambda/roles", Status: http.StatusInternalServerError, Count: 1},
+			"failed to create the role lambda:sample-function",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t)
+			if tt.failure != nil {
+				server.Inject(*tt.failure)
+			}
+			err := CreateMissingRoles(tt.apiKey, tt.roles, "sample-function")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
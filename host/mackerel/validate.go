@@ -0,0 +1,58 @@
+package mackerel
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// VerifyAPIKey checks that the API key is accepted and has the write permission.
+// The write permission is checked by posting the graph defs of the agent, which the agent posts on every start anyway.
+func VerifyAPIKey(apiKey string) error {
+	if apiKey == "" {
+		return errors.New("MackerelApiKey is not set")
+	}
+	client := newClient(apiKey)
+	if _, err := client.GetOrg(); err != nil {
+		return fmt.Errorf("the API key is rejected: %w", err)
+	}
+	if err := client.CreateGraphDefs(GraphDefs); err != nil {
+		if apiErr, ok := err.(*mackerel.APIError); ok && apiErr.StatusCode == http.StatusForbidden {
+			return errors.New("the API key has no write permission")
+		}
+		return err
+	}
+	return nil
+}
+
+// FindMissingRoles returns the role full names whose service or role doesn't exist
+func FindMissingRoles(apiKey string, roleFullnames []string) ([]string, error) {
+	if apiKey == "" {
+		return nil, errors.New("MackerelApiKey is not set")
+	}
+	client := newClient(apiKey)
+
+	services, err := client.FindServices()
+	if err != nil {
+		return nil, err
+	}
+	roles := make(map[string][]string)
+	for _, s := range services {
+		roles[s.Name] = s.Roles
+	}
+
+	missing := make([]string, 0)
+	for _, roleFullname := range roleFullnames {
+		service, role, err := splitRoleFullname(roleFullname)
+		if err != nil {
+			return nil, err
+		}
+		serviceRoles, ok := roles[service]
+		if !ok || !containsString(serviceRoles, role) {
+			missing = append(missing, roleFullname)
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,66 @@
+package mackerel
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/host/mackerel/mackereltest"
+)
+
+func TestVerifyAPIKey(t *testing.T) {
+	server := newTestServer(t)
+	server.ReadOnlyAPIKey = "read-only-api-key"
+
+	if err := VerifyAPIKey("test-api-key"); err != nil {
+		t.Errorf("err = %v, want nil for the key with the write permission", err)
+	}
+	if len(server.GraphDefs()) != len(GraphDefs) {
+		t.Errorf("graph defs = %d, want %d posted by the write probe", len(server.GraphDefs()), len(GraphDefs))
+	}
+
+	tests := []struct {
+		apiKey string
+		want   string
+	}{
+		{"read-only-api-key", "the API key has no write permission"},
+		{"unknown-api-key", "the API key is rejected"},
+		{"", "MackerelApiKey is not set"},
+	}
+	for _, tt := range tests {
+		err := VerifyAPIKey(tt.apiKey)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: err = %v, want %s", tt.apiKey, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyAPIKeyReportsServerError(t *testing.T) {
+	server := newTestServer(t)
+	server.Inject(mackereltest.Failure{Method: http.MethodPost, PathPrefix: "/api/v0/graph-defs/create", Status: http.StatusInternalServerError})
+
+	err := VerifyAPIKey("test-api-key")
+	if err == nil || strings.Contains(err.Error(), "no write permission") {
+		t.Errorf("err = %v, want the error of the server", err)
+	}
+}
+
+func TestFindMissingRoles(t *testing.T) {
+	server := newTestServer(t)
+	server.AddService("lambda", "sample-function")
+	server.AddService("batch")
+
+	missing, err := FindMissingRoles("test-api-key", []string{"lambda:sample-function", "lambda:other-function", "batch:job", "unknown:role"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"lambda:other-function", "batch:job", "unknown:role"}
+	if !reflect.DeepEqual(missing, want) {
+		t.Errorf("missing = %v, want %v", missing, want)
+	}
+
+	if _, err := FindMissingRoles("test-api-key", []string{"no-separator"}); err == nil {
+		t.Error("err = nil, want an error for the invalid role full name")
+	}
+}
@@ -1,10 +1,46 @@
 package lambda
 
+import (
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
 type AWSLambdaConfig struct {
-	Region        string `env:"AWS_REGION,required"`
-	FunctionName  string `env:"AWS_LAMBDA_FUNCTION_NAME,required"`
-	RuntimeApi    string `env:"AWS_LAMBDA_RUNTIME_API,required"`
-	IsSAMLocal    bool   `env:"AWS_SAM_LOCAL" envDefault:"false"`
-	EnvironmentID string
-	ExtensionName string
+	Region          string `env:"AWS_REGION,required"`
+	FunctionName    string `env:"AWS_LAMBDA_FUNCTION_NAME,required"`
+	FunctionVersion string `env:"AWS_LAMBDA_FUNCTION_VERSION"`
+	RuntimeApi      string `env:"AWS_LAMBDA_RUNTIME_API,required"`
+	IsSAMLocal      bool   `env:"AWS_SAM_LOCAL" envDefault:"false"`
+	EnvironmentID   string
+	ExtensionName   string
+	FunctionArn     string
+}
+
+// FunctionArn returns the unqualified ARN of the function, or an empty string if the account ID is unknown
+func FunctionArn(region string, accountID string, functionName string) string {
+	if accountID == "" {
+		return ""
+	}
+	partition, _ := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region)
+	partitionID := partition.ID()
+	if partitionID == "" {
+		partitionID = endpoints.AwsPartitionID
+	}
+	return arn.ARN{
+		Partition: partitionID,
+		Service:   "lambda",
+		Region:    region,
+		AccountID: accountID,
+		Resource:  "function:" + functionName,
+	}.String()
+}
+
+// AWSConfig is the access of the agent to the AWS APIs
+type AWSConfig struct {
+	Region string `env:"AWS_REGION"`
+	// EndpointURL replaces the endpoints of all the AWS services, e.g. to test against a local fake
+	EndpointURL  string `env:"EXT_AWS_ENDPOINT_URL"`
+	SessionToken string `env:"AWS_SESSION_TOKEN"`
+	// ParametersSecretsPort is the port of the AWS Parameters and Secrets Lambda Extension
+	ParametersSecretsPort string `env:"PARAMETERS_SECRETS_EXTENSION_HTTP_PORT" envDefault:"2773"`
 }
@@ -0,0 +1,332 @@
+// Package emulator serves the Lambda Extensions API and the Telemetry API locally,
+// so that the agent can be run and tested outside of Lambda.
+package emulator
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/lambda/extension"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/lambda/telemetry"
+)
+
+const (
+	extensionNameHeader       = "Lambda-Extension-Name"
+	extensionIdentifierHeader = "Lambda-Extension-Identifier"
+)
+
+// Function is the function information returned on registration and reported in the telemetry
+type Function struct {
+	Name    string
+	Version string
+	Handler string
+	// AccountID is returned on registration when the extension accepts the accountId feature
+	AccountID      string
+	MemorySizeMB   int
+	RuntimeVersion string
+	// InitDuration is reported by the init telemetry pushed on subscription
+	InitDuration time.Duration
+}
+
+// Emulator is a local Lambda runtime environment with a single extension
+type Emulator struct {
+	function Function
+	server   *http.Server
+
+	mu           sync.Mutex
+	extensionID  string
+	subscription *telemetry.SubscribeRequest
+	registered   chan struct{}
+	subscribed   chan struct{}
+	events       chan *extension.NextEventResponse
+	polled       chan struct{}
+	pushErrs     []error
+}
+
+// New returns an emulator of the function. Call Start to serve the APIs.
+func New(function Function) *Emulator {
+	if function.Version == "" {
+		function.Version = "$LATEST"
+	}
+	if function.MemorySizeMB == 0 {
+		function.MemorySizeMB = 128
+	}
+	return &Emulator{
+		function:   function,
+		registered: make(chan struct{}),
+		subscribed: make(chan struct{}),
+		events:     make(chan *extension.NextEventResponse),
+		polled:     make(chan struct{}, 1),
+	}
+}
+
+// Start serves the APIs on a free local port, and returns the address to be set to AWS_LAMBDA_RUNTIME_API
+func (e *Emulator) Start() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/2020-01-01/extension/register", e.handleRegister)
+	mux.HandleFunc("/2020-01-01/extension/event/next", e.handleNextEvent)
+	mux.HandleFunc("/2020-01-01/extension/init/error", e.handleError)
+	mux.HandleFunc("/2020-01-01/extension/exit/error", e.handleError)
+	mux.HandleFunc("/2022-07-01/telemetry", e.handleSubscribe)
+
+	e.server = &http.Server{Handler: mux}
+	go e.server.Serve(listener)
+	return listener.Addr().String(), nil
+}
+
+// Close stops serving the APIs. The pending /event/next requests are aborted.
+func (e *Emulator) Close() error {
+	if e.server == nil {
+		return nil
+	}
+	return e.server.Close()
+}
+
+// Registered is closed when the extension has registered
+func (e *Emulator) Registered() <-chan struct{} {
+	return e.registered
+}
+
+// Subscribed is closed when the extension has subscribed to the Telemetry API
+func (e *Emulator) Subscribed() <-chan struct{} {
+	return e.subscribed
+}
+
+// Subscription returns the request of the subscription to the Telemetry API, or nil if the extension has not subscribed
+func (e *Emulator) Subscription() *telemetry.SubscribeRequest {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.subscription
+}
+
+// PushErrors returns the errors of the pushes of the telemetry to the listener
+func (e *Emulator) PushErrors() []error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]error{}, e.pushErrs...)
+}
+
+func (e *Emulator) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get(extensionNameHeader) == "" {
+		http.Error(w, "missing "+extensionNameHeader, http.StatusBadRequest)
+		return
+	}
+
+	e.mu.Lock()
+	if e.extensionID != "" {
+		e.mu.Unlock()
+		http.Error(w, "extension already registered", http.StatusForbidden)
+		return
+	}
+	e.extensionID = randomID()
+	id := e.extensionID
+	e.mu.Unlock()
+
+	res := &extension.RegisterResponse{
+		FunctionName:    e.function.Name,
+		FunctionVersion: e.function.Version,
+		Handler:         e.function.Handler,
+	}
+	if r.Header.Get("Lambda-Extension-Accept-Feature") == "accountId" {
+		res.AccountID = e.function.AccountID
+	}
+	w.Header().Set(extensionIdentifierHeader, id)
+	writeJSON(w, res)
+	close(e.registered)
+}
+
+func (e *Emulator) handleNextEvent(w http.ResponseWriter, r *http.Request) {
+	if !e.authorized(w, r) {
+		return
+	}
+	select {
+	case e.polled <- struct{}{}:
+	default:
+	}
+	select {
+	case <-r.Context().Done():
+	case event := <-e.events:
+		writeJSON(w, event)
+	}
+}
+
+func (e *Emulator) handleError(w http.ResponseWriter, r *http.Request) {
+	if !e.authorized(w, r) {
+		return
+	}
+	writeJSON(w, &extension.StatusResponse{Status: "OK"})
+}
+
+func (e *Emulator) handleSubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !e.authorized(w, r) {
+		return
+	}
+	subscription := &telemetry.SubscribeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(subscription); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if subscription.Destination.URI == "" {
+		http.Error(w, "missing destination URI", http.StatusBadRequest)
+		return
+	}
+
+	e.mu.Lock()
+	first := e.subscription == nil
+	e.subscription = subscription
+	e.mu.Unlock()
+
+	w.Write([]byte("OK"))
+	if first {
+		close(e.subscribed)
+		go e.pushInit()
+	}
+}
+
+func (e *Emulator) authorized(w http.ResponseWriter, r *http.Request) bool {
+	e.mu.Lock()
+	id := e.extensionID
+	e.mu.Unlock()
+	if id == "" || r.Header.Get(extensionIdentifierHeader) != id {
+		http.Error(w, "unknown extension identifier", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// pushInit pushes the telemetry of the initialization of the runtime
+func (e *Emulator) pushInit() {
+	now := time.Now()
+	start := now.Add(-e.function.InitDuration)
+	e.Push(
+		Record(start, "platform.initStart", map[string]interface{}{
+			"initializationType": "on-demand",
+			"phase":              "init",
+			"functionName":       e.function.Name,
+			"functionVersion":    e.function.Version,
+			"runtimeVersion":     e.function.RuntimeVersion,
+		}),
+		Record(now, "platform.initRuntimeDone", map[string]interface{}{
+			"initializationType": "on-demand",
+			"phase":              "init",
+			"status":             "success",
+		}),
+		Record(now, "platform.initReport", map[string]interface{}{
+			"initializationType": "on-demand",
+			"phase":              "init",
+			"metrics": map[string]interface{}{
+				"durationMs": float64(e.function.InitDuration) / float64(time.Millisecond),
+			},
+		}),
+	)
+}
+
+// Push sends a batch of telemetry events to the listener of the subscription.
+// The events of the types not subscribed are dropped as the Telemetry API does.
+func (e *Emulator) Push(events ...map[string]interface{}) error {
+	subscription := e.Subscription()
+	if subscription == nil {
+		return errors.New("the extension has not subscribed to the Telemetry API")
+	}
+	batch := make([]map[string]interface{}, 0, len(events))
+	for _, event := range events {
+		if subscribes(subscription, event) {
+			batch = append(batch, event)
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	err := e.post(string(subscription.Destination.URI), batch)
+	if err != nil {
+		e.mu.Lock()
+		e.pushErrs = append(e.pushErrs, err)
+		e.mu.Unlock()
+	}
+	return err
+}
+
+func (e *Emulator) post(uri string, batch []map[string]interface{}) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	res, err := http.Post(uri, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s failed: %d[%s]", uri, res.StatusCode, res.Status)
+	}
+	return nil
+}
+
+func subscribes(subscription *telemetry.SubscribeRequest, event map[string]interface{}) bool {
+	eventType, _ := event["type"].(string)
+	for _, t := range subscription.EventTypes {
+		switch {
+		case t == telemetry.Platform && strings.HasPrefix(eventType, "platform."):
+			return true
+		case string(t) == eventType:
+			return true
+		}
+	}
+	return false
+}
+
+// send delivers the event to the next /event/next request of the extension
+func (e *Emulator) send(ctx context.Context, event *extension.NextEventResponse) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case e.events <- event:
+		return nil
+	}
+}
+
+// Record returns a telemetry event of the type with the record
+func Record(t time.Time, eventType string, record interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"time":   t.UTC().Format(time.RFC3339Nano),
+		"type":   eventType,
+		"record": record,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	s := hex.EncodeToString(b)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
@@ -0,0 +1,163 @@
+package emulator
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/lambda/extension"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/lambda/telemetry"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	extension.Logger = logrus.NewEntry(logger)
+	telemetry.Logger = logrus.NewEntry(logger)
+}
+
+// drainEvents waits until the listener has received at least n events, and returns the types of all of them
+func drainEvents(t *testing.T, listener *telemetry.TelemetryApiListener, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for listener.LogEventsQueue.Len() < int64(n) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	items, err := listener.LogEventsQueue.Get(listener.LogEventsQueue.Len())
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := make([]string, 0, len(items))
+	for _, item := range items {
+		event, _ := item.(map[string]interface{})
+		eventType, _ := event["type"].(string)
+		types = append(types, eventType)
+	}
+	return types
+}
+
+func countType(types []string, eventType string) int {
+	count := 0
+	for _, t := range types {
+		if t == eventType {
+			count++
+		}
+	}
+	return count
+}
+
+func TestEmulatorDrivesExtensionAndTelemetryClients(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	em := New(Function{Name: "sample-function", InitDuration: 100 * time.Millisecond})
+	runtimeAPI, err := em.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer em.Close()
+
+	extCli := extension.NewClient(runtimeAPI)
+	extID, err := extCli.Register(ctx, "test-extension")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extCli.Function.FunctionName != "sample-function" || extCli.Function.FunctionVersion != "$LATEST" {
+		t.Errorf("registered function = %+v, want sample-function $LATEST", extCli.Function)
+	}
+
+	listener := telemetry.NewTelemetryApiListener(true)
+	listenerURI, err := listener.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Shutdown()
+	tlmCli := telemetry.NewClient(runtimeAPI)
+	if _, err := tlmCli.Subscribe(ctx, extID, listenerURI, []telemetry.EventType{telemetry.Platform, telemetry.Function}); err != nil {
+		t.Fatal(err)
+	}
+	initTypes := drainEvents(t, listener, 3)
+	for _, eventType := range []string{"platform.initStart", "platform.initRuntimeDone", "platform.initReport"} {
+		if countType(initTypes, eventType) != 1 {
+			t.Errorf("init events = %v, want %s", initTypes, eventType)
+		}
+	}
+
+	played := make(chan error, 1)
+	go func() {
+		played <- em.Play(ctx, []Event{
+			{Invoke: &Invocation{RequestID: "request-1", Duration: 10 * time.Millisecond, Logs: []string{"hello"}}},
+			{Invoke: &Invocation{Status: "error", ErrorType: "Runtime.ExitError"}},
+			{Shutdown: extension.Spindown},
+		})
+	}()
+
+	first, err := extCli.NextEvent(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.EventType != extension.Invoke || first.RequestID != "request-1" {
+		t.Errorf("first event = %+v, want INVOKE of request-1", first)
+	}
+	if first.DeadlineMs <= time.Now().UnixMilli() {
+		t.Errorf("deadline = %d, want after now", first.DeadlineMs)
+	}
+	second, err := extCli.NextEvent(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.EventType != extension.Invoke || second.RequestID == "" {
+		t.Errorf("second event = %+v, want INVOKE with a generated request ID", second)
+	}
+	shutdown, err := extCli.NextEvent(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shutdown.EventType != extension.Shutdown || shutdown.ShutdownReason != extension.Spindown {
+		t.Errorf("last event = %+v, want SHUTDOWN of spindown", shutdown)
+	}
+	if err := <-played; err != nil {
+		t.Fatal(err)
+	}
+
+	types := drainEvents(t, listener, 7)
+	for eventType, want := range map[string]int{
+		"platform.start":       2,
+		"function":             1,
+		"platform.runtimeDone": 2,
+		"platform.report":      2,
+	} {
+		if got := countType(types, eventType); got != want {
+			t.Errorf("%s events = %d, want %d in %v", eventType, got, want, types)
+		}
+	}
+	if errs := em.PushErrors(); len(errs) > 0 {
+		t.Errorf("push errors = %v", errs)
+	}
+}
+
+func TestEmulatorRejectsUnknownExtension(t *testing.T) {
+	em := New(Function{Name: "sample-function"})
+	runtimeAPI, err := em.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer em.Close()
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+runtimeAPI+"/2020-01-01/extension/event/next", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(extensionIdentifierHeader, "unknown")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d, want 403 before the registration", res.StatusCode)
+	}
+}
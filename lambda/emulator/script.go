@@ -0,0 +1,143 @@
+package emulator
+
+import (
+	"context"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/lambda/extension"
+)
+
+// Invocation is an INVOKE event and the telemetry of the invocation
+type Invocation struct {
+	// RequestID is generated if empty
+	RequestID string
+	// Duration is the time the function runs. The invocation is reported after it.
+	Duration time.Duration
+	// Timeout is the deadline of the invocation from its start. Default is 3s.
+	Timeout time.Duration
+	// Status of platform.runtimeDone: success, error, failure or timeout. Default is success.
+	Status          string
+	ErrorType       string
+	MaxMemoryUsedMB int
+	// Tracing is the X-Ray tracing header given to the extension
+	Tracing string
+	// Logs are the lines written by the function
+	Logs []string
+}
+
+// Event is a step of a script: an invocation, or a shutdown if Invoke is nil
+type Event struct {
+	Invoke   *Invocation
+	Shutdown extension.ShutdownReason
+}
+
+// Play delivers the events to the extension in order.
+// It waits for each /event/next request of the extension, and pushes the telemetry of an invocation after its Duration.
+// It returns when the SHUTDOWN event has been delivered, or all the events have been.
+func (e *Emulator) Play(ctx context.Context, events []Event) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-e.subscribed:
+	}
+
+	for _, event := range events {
+		if event.Invoke == nil {
+			reason := event.Shutdown
+			if reason == "" {
+				reason = extension.Spindown
+			}
+			return e.send(ctx, &extension.NextEventResponse{
+				EventType:      extension.Shutdown,
+				DeadlineMs:     time.Now().Add(2 * time.Second).UnixMilli(),
+				ShutdownReason: reason,
+			})
+		}
+		if err := e.invoke(ctx, event.Invoke); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Emulator) invoke(ctx context.Context, inv *Invocation) error {
+	requestID := inv.RequestID
+	if requestID == "" {
+		requestID = randomID()
+	}
+	timeout := inv.Timeout
+	if timeout == 0 {
+		timeout = 3 * time.Second
+	}
+	status := inv.Status
+	if status == "" {
+		status = "success"
+	}
+
+	start := time.Now()
+	event := &extension.NextEventResponse{
+		EventType:          extension.Invoke,
+		DeadlineMs:         start.Add(timeout).UnixMilli(),
+		RequestID:          requestID,
+		InvokedFunctionArn: "arn:aws:lambda:us-east-1:000000000000:function:" + e.function.Name,
+	}
+	if inv.Tracing != "" {
+		event.Tracing = extension.Tracing{Type: "X-Amzn-Trace-Id", Value: inv.Tracing}
+	}
+	if err := e.send(ctx, event); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(inv.Duration):
+	}
+	end := time.Now()
+	durationMs := float64(end.Sub(start)) / float64(time.Millisecond)
+
+	batch := []map[string]interface{}{
+		Record(start, "platform.start", map[string]interface{}{
+			"requestId": requestID,
+			"version":   e.function.Version,
+		}),
+	}
+	for _, line := range inv.Logs {
+		batch = append(batch, Record(end, "function", line))
+	}
+	runtimeDone := map[string]interface{}{
+		"requestId": requestID,
+		"status":    status,
+		"metrics": map[string]interface{}{
+			"durationMs":    durationMs,
+			"producedBytes": 0,
+		},
+	}
+	if inv.ErrorType != "" {
+		runtimeDone["errorType"] = inv.ErrorType
+	}
+	batch = append(batch,
+		Record(end, "platform.runtimeDone", runtimeDone),
+		Record(end, "platform.report", map[string]interface{}{
+			"requestId": requestID,
+			"status":    status,
+			"metrics": map[string]interface{}{
+				"durationMs":       durationMs,
+				"billedDurationMs": float64(int64(durationMs) + 1),
+				"memorySizeMB":     e.function.MemorySizeMB,
+				"maxMemoryUsedMB":  inv.MaxMemoryUsedMB,
+			},
+		}),
+	)
+	return e.Push(batch...)
+}
+
+// WaitPolling waits until the extension is waiting for the next event, i.e. it has finished handling the previous one
+func (e *Emulator) WaitPolling(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-e.polled:
+		return nil
+	}
+}
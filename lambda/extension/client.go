@@ -19,6 +19,8 @@ type RegisterResponse struct {
 	FunctionName    string `json:"functionName"`
 	FunctionVersion string `json:"functionVersion"`
 	Handler         string `json:"handler"`
+	// AccountID is set only when the accountId feature is accepted on registration
+	AccountID string `json:"accountId,omitempty"`
 }
 
 // NextEventResponse is the response for /event/next
@@ -28,6 +30,8 @@ type NextEventResponse struct {
 	RequestID          string    `json:"requestId"`
 	InvokedFunctionArn string    `json:"invokedFunctionArn"`
 	Tracing            Tracing   `json:"tracing"`
+	// ShutdownReason is set on the SHUTDOWN event
+	ShutdownReason ShutdownReason `json:"shutdownReason"`
 }
 
 // Tracing is part of the response for /event/next
@@ -36,6 +40,15 @@ type Tracing struct {
 	Value string `json:"value"`
 }
 
+// ShutdownReason represents the reason of the SHUTDOWN event
+type ShutdownReason string
+
+const (
+	Spindown ShutdownReason = "spindown"
+	Timeout  ShutdownReason = "timeout"
+	Failure  ShutdownReason = "failure"
+)
+
 // StatusResponse is the body of the response for /init/error and /exit/error
 type StatusResponse struct {
 	Status string `json:"status"`
@@ -54,6 +67,7 @@ const (
 	extensionNameHeader      = "Lambda-Extension-Name"
 	extensionIdentiferHeader = "Lambda-Extension-Identifier"
 	extensionErrorType       = "Lambda-Extension-Function-Error-Type"
+	extensionAcceptFeature   = "Lambda-Extension-Accept-Feature"
 )
 
 // Client is a simple client for the Lambda Extensions API
@@ -61,6 +75,8 @@ type Client struct {
 	httpClient  *http.Client
 	baseUrl     string
 	ExtensionID string
+	// Function is the function information received on registration
+	Function RegisterResponse
 }
 
 var Logger *logrus.Entry
@@ -91,6 +107,7 @@ func (e *Client) Register(ctx context.Context, extensionName string) (string, er
 		return "", err
 	}
 	httpReq.Header.Set(extensionNameHeader, extensionName)
+	httpReq.Header.Set(extensionAcceptFeature, "accountId")
 
 	httpRes, err := e.httpClient.Do(httpReq)
 	if err != nil {
@@ -113,6 +130,7 @@ func (e *Client) Register(ctx context.Context, extensionName string) (string, er
 		return "", err
 	}
 
+	e.Function = res
 	e.ExtensionID = httpRes.Header.Get(extensionIdentiferHeader)
 	Logger.Info("Registration success with extensionID", e.ExtensionID)
 	return e.ExtensionID, nil
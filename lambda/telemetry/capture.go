@@ -0,0 +1,205 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
+)
+
+type CaptureConfig struct {
+	// Enabled records every batch received from the Telemetry API
+	Enabled bool   `env:"EXT_TELEMETRY_CAPTURE" envDefault:"false"`
+	Path    string `env:"EXT_TELEMETRY_CAPTURE_PATH" envDefault:"/tmp/mackerel-lambda-extension-agent-telemetry.jsonl"`
+	// MaxBytes is the size the file is rotated at
+	MaxBytes int64 `env:"EXT_TELEMETRY_CAPTURE_MAX_BYTES" envDefault:"5242880"`
+	// MaxFiles is the number of the rotated files kept as Path.1, Path.2, ...
+	MaxFiles int `env:"EXT_TELEMETRY_CAPTURE_MAX_FILES" envDefault:"2"`
+	// UploadURL is the endpoint the capture is posted to at shutdown. Nothing is uploaded if it's empty.
+	UploadURL     string        `env:"EXT_TELEMETRY_CAPTURE_UPLOAD_URL"`
+	UploadHeaders sink.Headers  `env:"EXT_TELEMETRY_CAPTURE_UPLOAD_HEADERS"`
+	UploadTimeout time.Duration `env:"EXT_TELEMETRY_CAPTURE_UPLOAD_TIMEOUT" envDefault:"5s"`
+}
+
+// Validate checks the sizes of the rotation
+func (c *CaptureConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.MaxBytes <= 0 {
+		return fmt.Errorf("invalid EXT_TELEMETRY_CAPTURE_MAX_BYTES: %d, must be positive", c.MaxBytes)
+	}
+	if c.MaxFiles < 0 {
+		return fmt.Errorf("invalid EXT_TELEMETRY_CAPTURE_MAX_FILES: %d, must not be negative", c.MaxFiles)
+	}
+	return nil
+}
+
+// capturedBatch is a line of the capture, which the replay subcommand reads
+type capturedBatch struct {
+	ReceivedAt string          `json:"receivedAt"`
+	Events     json.RawMessage `json:"events"`
+}
+
+// Capture writes the batches received from the Telemetry API as JSON lines, rotating the file by its size
+type Capture struct {
+	conf *CaptureConfig
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewCapture opens the capture file, appending to the one left by the previous runtime environment if any
+func NewCapture(conf *CaptureConfig) (*Capture, error) {
+	c := &Capture{conf: conf}
+	if err := c.open(os.O_APPEND); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Capture) open(flag int) error {
+	file, err := os.OpenFile(c.conf.Path, os.O_CREATE|os.O_WRONLY|flag, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	c.file = file
+	c.size = info.Size()
+	return nil
+}
+
+// Write records the body of a request of the Telemetry API received at receivedAt
+func (c *Capture) Write(receivedAt time.Time, body []byte) error {
+	if !json.Valid(body) {
+		return errors.New("the batch is not valid JSON")
+	}
+	line, err := json.Marshal(&capturedBatch{
+		ReceivedAt: receivedAt.UTC().Format(time.RFC3339Nano),
+		Events:     body,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return errors.New("the capture is closed")
+	}
+	if c.size > 0 && c.size+int64(len(line)) > c.conf.MaxBytes {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := c.file.Write(line)
+	c.size += int64(n)
+	return err
+}
+
+// rotate shifts the rotated files, dropping the oldest one, and starts a new file
+func (c *Capture) rotate() error {
+	if err := c.file.Close(); err != nil {
+		return err
+	}
+	c.file = nil
+	if c.conf.MaxFiles == 0 {
+		if err := os.Remove(c.conf.Path); err != nil {
+			return err
+		}
+	} else {
+		for i := c.conf.MaxFiles - 1; i >= 1; i-- {
+			if err := os.Rename(c.rotatedPath(i), c.rotatedPath(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		if err := os.Rename(c.conf.Path, c.rotatedPath(1)); err != nil {
+			return err
+		}
+	}
+	return c.open(os.O_TRUNC)
+}
+
+func (c *Capture) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d", c.conf.Path, i)
+}
+
+// Files returns the existing files of the capture from the oldest
+func (c *Capture) Files() []string {
+	files := make([]string, 0, c.conf.MaxFiles+1)
+	for i := c.conf.MaxFiles; i >= 1; i-- {
+		if _, err := os.Stat(c.rotatedPath(i)); err == nil {
+			files = append(files, c.rotatedPath(i))
+		}
+	}
+	if _, err := os.Stat(c.conf.Path); err == nil {
+		files = append(files, c.conf.Path)
+	}
+	return files
+}
+
+// Close stops recording. The batches received afterwards are dropped.
+func (c *Capture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// Upload closes the capture and posts all of its files to UploadURL in the order of the records
+func (c *Capture) Upload(ctx context.Context) error {
+	if err := c.Close(); err != nil {
+		return err
+	}
+	if c.conf.UploadURL == "" {
+		return nil
+	}
+
+	readers := make([]io.Reader, 0)
+	for _, path := range c.Files() {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		readers = append(readers, file)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.conf.UploadTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.conf.UploadURL, io.MultiReader(readers...))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	for k, v := range c.conf.UploadHeaders {
+		req.Header.Set(k, v)
+	}
+	Logger.Info("uploading the telemetry capture")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s failed: %d[%s]", c.conf.UploadURL, res.StatusCode, res.Status)
+	}
+	return nil
+}
@@ -113,13 +113,7 @@ type SubscribeResponse struct {
 }
 
 // Subscribes to the Telemetry API to start receiving the log events
-func (c *Client) Subscribe(ctx context.Context, extensionId string, listenerUri string) (*SubscribeResponse, error) {
-	eventTypes := []EventType{
-		Platform,
-		// Function,
-		// Extension,
-	}
-
+func (c *Client) Subscribe(ctx context.Context, extensionId string, listenerUri string, eventTypes []EventType) (*SubscribeResponse, error) {
 	bufferingConfig := BufferingCfg{
 		MaxItems:  1000,
 		MaxBytes:  256 * 1024,
@@ -22,7 +22,9 @@ type TelemetryApiListener struct {
 	httpServer *http.Server
 	// LogEventsQueue is a synchronous queue and is used to put the received log events to be dispatched later
 	LogEventsQueue *queue.Queue
-	isSAMLocal     bool
+	// Capture records the raw batches if set
+	Capture    *Capture
+	isSAMLocal bool
 }
 
 func NewTelemetryApiListener(isSAMLocal bool) *TelemetryApiListener {
@@ -48,8 +50,10 @@ func (s *TelemetryApiListener) listenOnAddress() string {
 func (s *TelemetryApiListener) Start() (string, error) {
 	address := s.listenOnAddress()
 	Logger.Info("Starting on address", address)
-	s.httpServer = &http.Server{Addr: address}
-	http.HandleFunc("/", s.http_handler)
+	// a mux of its own, so that the listener can be started again in the same process, e.g. in tests
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.http_handler)
+	s.httpServer = &http.Server{Addr: address, Handler: mux}
 	go func() {
 		err := s.httpServer.ListenAndServe()
 		if err != http.ErrServerClosed {
@@ -75,6 +79,12 @@ func (s *TelemetryApiListener) http_handler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	if s.Capture != nil {
+		if err := s.Capture.Write(time.Now(), body); err != nil {
+			Logger.Warning("Failed to capture the telemetry:", err)
+		}
+	}
+
 	// Parse and put the log messages into the queue
 	var slice []interface{}
 	_ = json.Unmarshal(body, &slice)
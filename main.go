@@ -2,16 +2,23 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/collector"
 	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/dispatcher"
 	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/host/mackerel"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/lambda"
 	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/lambda/extension"
 	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/lambda/telemetry"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink/logs"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink/otlp"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
@@ -50,9 +57,20 @@ func init() {
 	extension.Logger = logrus.WithFields(logrus.Fields{"ext": extName, "pkg": "lambda/extension"})
 	telemetry.Logger = logrus.WithFields(logrus.Fields{"ext": extName, "pkg": "lambda/telemetry"})
 	dispatcher.Logger = logrus.WithFields(logrus.Fields{"ext": extName, "pkg": "dispatcher"})
+	sink.Logger = logrus.WithFields(logrus.Fields{"ext": extName, "pkg": "sink"})
+	otlp.Logger = logrus.WithFields(logrus.Fields{"ext": extName, "pkg": "sink/otlp"})
+	logs.Logger = logrus.WithFields(logrus.Fields{"ext": extName, "pkg": "sink/logs"})
+	prometheus.Logger = logrus.WithFields(logrus.Fields{"ext": extName, "pkg": "sink/prometheus"})
+	collector.Logger = logrus.WithFields(logrus.Fields{"ext": extName, "pkg": "collector"})
+
+	mackerel.RegisterGraphDefs(collector.GraphDefs()...)
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runSubcommand(os.Args[1], os.Args[2:]))
+	}
+
 	conf, err := GetConfig()
 	if err != nil {
 		Logger.Error(err)
@@ -68,43 +86,148 @@ func main() {
 		Logger.Info("received signal", s, "terminating")
 	}()
 
+	if err := run(ctx, conf); err != nil {
+		Logger.Error(err)
+	}
+}
+
+// run registers the extension, and handles the events of the Lambda runtime until SHUTDOWN or the cancel of ctx
+func run(ctx context.Context, conf *Config) error {
 	extCli := extension.NewClient(conf.AWSLambdaConfig.RuntimeApi)
 	extID, err := extCli.Register(ctx, conf.AWSLambdaConfig.ExtensionName)
 	if err != nil {
-		Logger.Error(err)
-		return
+		return err
+	}
+	// the account ID isn't exposed to the environment, and an empty ARN leaves the host without the custom identifier
+	conf.AWSLambdaConfig.FunctionArn = lambda.FunctionArn(conf.AWSLambdaConfig.Region, extCli.Function.AccountID, conf.AWSLambdaConfig.FunctionName)
+	if conf.AWSLambdaConfig.FunctionArn == "" {
+		Logger.Warning("The account ID is not given on registration, the host is registered without the custom identifier")
 	}
 
 	tlmListener := telemetry.NewTelemetryApiListener(conf.AWSLambdaConfig.IsSAMLocal)
+	if conf.CaptureConfig.Enabled {
+		capture, err := telemetry.NewCapture(&conf.CaptureConfig)
+		if err != nil {
+			return err
+		}
+		tlmListener.Capture = capture
+	}
 	tlmListenerUri, err := tlmListener.Start()
 	if err != nil {
-		Logger.Error(err)
-		return
+		return err
+	}
+	defer tlmListener.Shutdown()
+
+	// The extension logs must not be subscribed. The agent logs while dispatching and shipping,
+	// and its own lines would come back through the listener endlessly.
+	eventTypes := []telemetry.EventType{telemetry.Platform}
+	if conf.CheckConfig.SubscribesFunctionLogs() || conf.LogsConfig.Endpoint != "" {
+		eventTypes = append(eventTypes, telemetry.Function)
 	}
 
 	tlmCli := telemetry.NewClient(conf.AWSLambdaConfig.RuntimeApi)
-	if _, err = tlmCli.Subscribe(ctx, extID, tlmListenerUri); err != nil {
-		Logger.Error(err)
-		return
+	if _, err = tlmCli.Subscribe(ctx, extID, tlmListenerUri, eventTypes); err != nil {
+		return err
+	}
+
+	if conf.MackerelConfig.AutoCreateRoles {
+		if err := mackerel.CreateMissingRoles(conf.MackerelConfig.ApiKey, conf.MackerelConfig.RoleFullnames, conf.AWSLambdaConfig.FunctionName); err != nil {
+			return err
+		}
 	}
 
 	host, err := mackerel.CreateOrGetHost(&mackerel.CreateOrGetHostParam{
 		MackerelApiKey: conf.MackerelConfig.ApiKey,
 		RoleFullnames:  conf.MackerelConfig.RoleFullnames,
 		FunctionName:   conf.AWSLambdaConfig.FunctionName,
+		FunctionArn:    conf.AWSLambdaConfig.FunctionArn,
 		EnvironmentID:  conf.AWSLambdaConfig.EnvironmentID,
+		Checks:         conf.CheckConfig.Checks(),
 	})
 	if err != nil {
-		Logger.Error(err)
-		return
+		return err
 	}
 
 	if err := host.CreateGraphDefs(); err != nil {
-		Logger.Error(err)
-		return
+		return err
 	}
 
-	dispatcher := dispatcher.NewDispatcher(host)
+	go func() {
+		if err := host.ReapOrphanedHosts(&conf.MackerelConfig.ReaperConfig, conf.MackerelConfig.RoleFullnames, time.Now()); err != nil {
+			Logger.Warning("Failed to reap orphaned hosts:", err)
+		}
+	}()
+
+	onInitStart := func(initStart *dispatcher.InitStart) {
+		functionVersion := extCli.Function.FunctionVersion
+		if functionVersion == "" {
+			functionVersion = initStart.FunctionVersion
+		}
+		if err := host.AnnotateInitStart(&conf.MackerelConfig.AnnotationConfig, conf.MackerelConfig.RoleFullnames, functionVersion, initStart.RuntimeVersion, initStart.Time); err != nil {
+			Logger.Warning("Failed to annotate:", err)
+		}
+	}
+
+	sinks := []sink.Sink{
+		sink.NewBatchingSink(host, &conf.MackerelConfig.SinkConfig),
+	}
+	otlpResource := &otlp.Resource{
+		FunctionName:    conf.AWSLambdaConfig.FunctionName,
+		FunctionVersion: conf.AWSLambdaConfig.FunctionVersion,
+		EnvironmentID:   conf.AWSLambdaConfig.EnvironmentID,
+		Region:          conf.AWSLambdaConfig.Region,
+	}
+	if conf.OTLPConfig.Endpoint != "" {
+		exporter, err := otlp.NewExporter(&conf.OTLPConfig, otlpResource)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, sink.NewBatchingSink(exporter, &conf.OTLPConfig.SinkConfig))
+	}
+
+	if conf.PrometheusConfig.RemoteWriteURL != "" {
+		writer := prometheus.NewRemoteWriter(&conf.PrometheusConfig, map[string]string{
+			"function_name":    conf.AWSLambdaConfig.FunctionName,
+			"function_version": conf.AWSLambdaConfig.FunctionVersion,
+			"environment_id":   conf.AWSLambdaConfig.EnvironmentID,
+			"region":           conf.AWSLambdaConfig.Region,
+		})
+		sinks = append(sinks, sink.NewBatchingSink(writer, &conf.PrometheusConfig.SinkConfig))
+	}
+
+	spanSinks := []sink.SpanSink{}
+	if conf.OTLPConfig.TracesEnabled {
+		exporter, err := otlp.NewTraceExporter(&conf.OTLPConfig, otlpResource)
+		if err != nil {
+			return err
+		}
+		spanSinks = append(spanSinks, exporter)
+	}
+
+	logSinks := []sink.LogSink{}
+	if conf.LogsConfig.Endpoint != "" {
+		logSinks = append(logSinks, logs.NewShipper(&conf.LogsConfig, map[string]string{
+			"function_name": conf.AWSLambdaConfig.FunctionName,
+			"host_id":       host.ID,
+		}))
+	}
+
+	dispatcher := dispatcher.NewDispatcher(host, sinks, &conf.CheckConfig)
+	dispatcher.OnInitStart = onInitStart
+	dispatcher.SpanSinks = spanSinks
+	dispatcher.LogSinks = logSinks
+
+	sampler := collector.NewSampler(collector.Default(), conf.CollectorConfig.Interval)
+	go sampler.Run(ctx)
+	dispatcher.Sampler = sampler
+
+	coordinator := &shutdownCoordinator{
+		dispatcher:     dispatcher,
+		host:           host,
+		logEventsQueue: tlmListener.LogEventsQueue,
+		capture:        tlmListener.Capture,
+		roleFullnames:  conf.MackerelConfig.RoleFullnames,
+	}
 
 	ticker := time.NewTicker(60 * time.Second)
 	defer ticker.Stop()
@@ -117,7 +240,7 @@ func main() {
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return nil
 		default:
 			Logger.Info("Waiting for next event...")
 
@@ -125,19 +248,45 @@ func main() {
 			res, err := extCli.NextEvent(ctx)
 			if err != nil {
 				Logger.Warning(err)
-				return
+				return nil
 			}
 
-			// Dispatching log events from previous invocations
-			dispatcher.Dispatch(ctx, tlmListener.LogEventsQueue, false)
-
 			if res.EventType == extension.Shutdown {
 				// Dispatch all remaining telemetry, handle shutdown
 				Logger.Info("Shutdown event")
-				dispatcher.Dispatch(ctx, tlmListener.LogEventsQueue, true)
-				host.Retire()
-				return
+				coordinator.Shutdown(res)
+				return nil
 			}
+
+			dispatcher.RecordTracing(res.RequestID, res.Tracing.Value)
+
+			// The ticker of the sampler doesn't run while the environment is frozen
+			sampler.SampleIfDue(time.Now())
+
+			// Dispatching log events from previous invocations
+			dispatcher.Dispatch(ctx, tlmListener.LogEventsQueue, false)
 		}
 	}
 }
+
+// runSubcommand runs the one-shot command given on the command line and returns the exit code
+func runSubcommand(name string, args []string) int {
+	var err error
+	switch name {
+	case "dashboard":
+		err = runDashboard(args)
+	case "monitors":
+		err = runMonitors(args)
+	case "replay":
+		err = runReplay(args)
+	case "validate":
+		err = runValidate(args)
+	default:
+		err = fmt.Errorf("unknown subcommand: %s", name)
+	}
+	if err != nil {
+		Logger.Error(err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/host/mackerel"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/host/mackerel/mackereltest"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/lambda/emulator"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/lambda/extension"
+)
+
+const testEnvironmentID = "4f5b1c0e-0000-4000-8000-000000000000"
+
+// startTestAgent points the agent to the emulator and the fake Mackerel API, and runs it until it returns
+func startTestAgent(t *testing.T, ctx context.Context, em *emulator.Emulator, server *mackereltest.Server) <-chan error {
+	t.Helper()
+	runtimeAPI, err := em.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { em.Close() })
+
+	dir := t.TempDir()
+	bootID := filepath.Join(dir, "boot_id")
+	if err := os.WriteFile(bootID, []byte(testEnvironmentID+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	original := bootIDPath
+	bootIDPath = bootID
+	t.Cleanup(func() { bootIDPath = original })
+	mackerel.UseHostIDFile(filepath.Join(dir, "host.id"))
+
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "sample-function")
+	t.Setenv("AWS_LAMBDA_RUNTIME_API", runtimeAPI)
+	t.Setenv("AWS_SAM_LOCAL", "true")
+	t.Setenv("EXT_MACKEREL_API_KEY", server.APIKey)
+	t.Setenv("EXT_MACKEREL_API_BASE", server.URL)
+	t.Setenv("EXT_CONFIG_FILE", "")
+	t.Cleanup(func() { mackerel.UseAPIBase("") })
+
+	conf, err := GetConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, conf)
+	}()
+	return done
+}
+
+// sumMetric returns the sum of the posted values of the metric, and whether any is posted
+func sumMetric(server *mackereltest.Server, name string) (float64, bool) {
+	sum, found := 0.0, false
+	for _, m := range server.Metrics() {
+		if m.Name == name {
+			sum += m.Value.(float64)
+			found = true
+		}
+	}
+	return sum, found
+}
+
+func TestAgentPostsMetricsAndRetiresHostOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	server := mackereltest.NewServer()
+	server.APIKey = "test-api-key"
+	defer server.Close()
+	em := emulator.New(emulator.Function{Name: "sample-function", AccountID: "000000000000", InitDuration: 150 * time.Millisecond})
+
+	done := startTestAgent(t, ctx, em, server)
+	err := em.Play(ctx, []emulator.Event{
+		{Invoke: &emulator.Invocation{Duration: 20 * time.Millisecond, MaxMemoryUsedMB: 64}},
+		{Invoke: &emulator.Invocation{Duration: 10 * time.Millisecond, Status: "error", ErrorType: "Runtime.ExitError"}},
+		{Shutdown: extension.Spindown},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-ctx.Done():
+		t.Fatal("the agent didn't return after SHUTDOWN")
+	}
+	if errs := em.PushErrors(); len(errs) > 0 {
+		t.Fatalf("failed to push the telemetry: %v", errs)
+	}
+
+	hosts := server.Hosts()
+	if len(hosts) != 1 {
+		t.Fatalf("hosts = %d, want 1", len(hosts))
+	}
+	host := hosts[0]
+	if host.Name != testEnvironmentID {
+		t.Errorf("host name = %s, want the boot ID %s", host.Name, testEnvironmentID)
+	}
+	if want := "arn:aws:lambda:us-east-1:000000000000:function:sample-function/" + testEnvironmentID; host.CustomIdentifier != want {
+		t.Errorf("custom identifier = %s, want %s", host.CustomIdentifier, want)
+	}
+
+	for _, m := range server.Metrics() {
+		if m.HostID != host.ID {
+			t.Errorf("metric %s is posted to %s, want %s", m.Name, m.HostID, host.ID)
+		}
+	}
+	for name, want := range map[string]float64{
+		"custom.lambda.platform.initStart.count":                1,
+		"custom.lambda.platform.report.count":                   2,
+		"custom.lambda.platform.runtimeDone.invocations.count":  2,
+		"custom.lambda.platform.runtimeDone.invocations.errors": 1,
+		"custom.lambda.extension.shutdown.spindown":             1,
+		"custom.lambda.extension.shutdown.timeout":              0,
+	} {
+		got, found := sumMetric(server, name)
+		if !found {
+			t.Errorf("%s is not posted", name)
+		} else if got != want {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+	if _, found := sumMetric(server, "custom.lambda.platform.report.maxMemoryUsed.max"); !found {
+		t.Error("the metrics of the reports are not posted")
+	}
+
+	if retired := server.RetiredHostIDs(); len(retired) != 1 || retired[0] != host.ID {
+		t.Errorf("retired hosts = %v, want the host %s retired at SHUTDOWN", retired, host.ID)
+	}
+}
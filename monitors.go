@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/host/mackerel"
+)
+
+// runMonitors creates or updates the monitors declared by EXT_MACKEREL_MONITOR_* for the roles in EXT_MACKEREL_ROLE_FULL_NAMES.
+func runMonitors(args []string) error {
+	flags := flag.NewFlagSet("monitors", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	conf, err := getMackerelConfig()
+	if err != nil {
+		return err
+	}
+
+	monitors, err := mackerel.ProvisionMonitors(conf.ApiKey, &conf.MonitorConfig, conf.RoleFullnames)
+	for _, monitor := range monitors {
+		fmt.Printf("%s: %s\n", monitor.Name, monitor.Action)
+	}
+	return err
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/dispatcher"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/host/mackerel"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
+	mackerelclient "github.com/mackerelio/mackerel-client-go"
+)
+
+// maxReplayLineSize is the maximum size of a line of the replayed file. A batch of the Telemetry API is at most 1MB.
+const maxReplayLineSize = 2 * 1024 * 1024
+
+// runReplay feeds the recorded telemetry events through the aggregation of the dispatcher,
+// and prints the resulting metrics or posts them to an existing host.
+func runReplay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	file := flags.String("file", "", "JSON lines of the telemetry events: an event, an array of events, or a captured batch per line")
+	window := flags.Duration("window", time.Minute, "interval of the dispatches the events are grouped into")
+	post := flags.Bool("post", false, "post the metrics to the host instead of printing them")
+	hostID := flags.String("host-id", "", "ID of the host the metrics are posted to with -post")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("-file is required")
+	}
+	if *window <= 0 {
+		return errors.New("-window must be positive")
+	}
+	if *post && *hostID == "" {
+		return errors.New("-host-id is required with -post")
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	events, err := readTelemetryEvents(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *file, err)
+	}
+
+	metrics := make([]*mackerelclient.MetricValue, 0)
+	for _, batch := range groupByDispatch(events, *window) {
+		metrics = append(metrics, dispatcher.BuildMetrics(batch.events, batch.dispatchedAt)...)
+	}
+	sort.SliceStable(metrics, func(i, j int) bool {
+		if metrics[i].Time != metrics[j].Time {
+			return metrics[i].Time < metrics[j].Time
+		}
+		return metrics[i].Name < metrics[j].Name
+	})
+
+	if !*post {
+		for _, m := range metrics {
+			fmt.Printf("%s\t%v\t%d\n", m.Name, m.Value, m.Time)
+		}
+		return nil
+	}
+
+	conf, err := getMackerelConfig()
+	if err != nil {
+		return err
+	}
+	host, err := mackerel.NewHost(conf.ApiKey, *hostID)
+	if err != nil {
+		return err
+	}
+	s := sink.NewBatchingSink(host, &conf.SinkConfig)
+	ctx := context.Background()
+	// each chunk is flushed on its own, so that a long replay isn't dropped by the limit of the buffer
+	for start := 0; start < len(metrics); start += conf.SinkConfig.BatchSize {
+		end := start + conf.SinkConfig.BatchSize
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+		err := s.Send(ctx, metrics[start:end])
+		if err == nil {
+			err = s.Flush(ctx)
+		}
+		if err != nil {
+			return fmt.Errorf("posted %d of %d metrics, %d dropped: %w", start-s.Dropped(), len(metrics), s.Dropped(), err)
+		}
+	}
+	fmt.Printf("posted %d metrics to %s, %d dropped\n", len(metrics)-s.Dropped(), *hostID, s.Dropped())
+	if s.Dropped() > 0 {
+		return fmt.Errorf("%d metrics were dropped", s.Dropped())
+	}
+	return nil
+}
+
+// readTelemetryEvents reads the events in the order of the file.
+// A line is an event, an array of events as posted by the Telemetry API, or a batch captured by the listener.
+func readTelemetryEvents(r io.Reader) ([]interface{}, error) {
+	events := make([]interface{}, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxReplayLineSize)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var v interface{}
+		if err := json.Unmarshal(line, &v); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		switch value := v.(type) {
+		case []interface{}:
+			events = append(events, value...)
+		case map[string]interface{}:
+			if batch, ok := value["events"].([]interface{}); ok {
+				events = append(events, batch...)
+			} else if _, ok := value["type"]; ok {
+				events = append(events, value)
+			} else {
+				return nil, fmt.Errorf("line %d: not a telemetry event", lineNo)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: not a telemetry event", lineNo)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		if _, ok := event.(map[string]interface{}); !ok {
+			return nil, errors.New("an array contains a value which is not a telemetry event")
+		}
+	}
+	return events, nil
+}
+
+type replayBatch struct {
+	events       []interface{}
+	dispatchedAt time.Time
+}
+
+// groupByDispatch splits the events into the windows of their times as the dispatches would do.
+// A batch is dispatched at the time of its last event.
+func groupByDispatch(events []interface{}, window time.Duration) []*replayBatch {
+	batches := make([]*replayBatch, 0)
+	var current *replayBatch
+	var currentWindow time.Time
+	for _, event := range events {
+		t, err := time.Parse(time.RFC3339Nano, fmt.Sprint(event.(map[string]interface{})["time"]))
+		if err != nil && current != nil {
+			// an event without the time joins the current batch
+			current.events = append(current.events, event)
+			continue
+		}
+		if current == nil || !t.Truncate(window).Equal(currentWindow) {
+			current = &replayBatch{}
+			currentWindow = t.Truncate(window)
+			batches = append(batches, current)
+		}
+		current.events = append(current.events, event)
+		if t.After(current.dispatchedAt) {
+			current.dispatchedAt = t
+		}
+	}
+	return batches
+}
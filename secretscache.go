@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/lambda"
+)
+
+// parametersSecretsTimeout covers a cache miss, on which the extension calls SSM or Secrets Manager by itself
+const parametersSecretsTimeout = 3 * time.Second
+
+// parametersSecretsExtension reads the parameters and the secrets through the cache of the AWS Parameters and Secrets Lambda Extension
+type parametersSecretsExtension struct {
+	httpClient *http.Client
+	baseURL    string
+	token      string
+}
+
+// newParametersSecretsExtension returns nil if the extension can't be used.
+// The extension is not used when the AWS endpoint is replaced, since it would call the real one.
+func newParametersSecretsExtension(awsConf *lambda.AWSConfig) *parametersSecretsExtension {
+	if awsConf.SessionToken == "" || awsConf.EndpointURL != "" {
+		return nil
+	}
+	return &parametersSecretsExtension{
+		httpClient: &http.Client{Timeout: parametersSecretsTimeout},
+		baseURL:    "http://localhost:" + awsConf.ParametersSecretsPort,
+		token:      awsConf.SessionToken,
+	}
+}
+
+type getParameterResponse struct {
+	Parameter struct {
+		Value string `json:"Value"`
+	} `json:"Parameter"`
+}
+
+type getSecretValueResponse struct {
+	SecretString string `json:"SecretString"`
+}
+
+func (e *parametersSecretsExtension) getParameter(name string) (string, error) {
+	query := url.Values{"name": {name}, "withDecryption": {"true"}}
+	res := &getParameterResponse{}
+	if err := e.get("/systemsmanager/parameters/get?"+query.Encode(), res); err != nil {
+		return "", err
+	}
+	return res.Parameter.Value, nil
+}
+
+func (e *parametersSecretsExtension) getSecretString(secretID string) (string, error) {
+	query := url.Values{"secretId": {secretID}}
+	res := &getSecretValueResponse{}
+	if err := e.get("/secretsmanager/get?"+query.Encode(), res); err != nil {
+		return "", err
+	}
+	return res.SecretString, nil
+}
+
+func (e *parametersSecretsExtension) get(path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, e.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Aws-Parameters-Secrets-Token", e.token)
+	res, err := e.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("the Parameters and Secrets extension responded %d[%s] %s", res.StatusCode, res.Status, string(body))
+	}
+	return json.Unmarshal(body, v)
+}
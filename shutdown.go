@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang-collections/go-datastructures/queue"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/dispatcher"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/host/mackerel"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/lambda/extension"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/lambda/telemetry"
+	mackerelclient "github.com/mackerelio/mackerel-client-go"
+)
+
+const (
+	// defaultShutdownBudget is used when the SHUTDOWN event has no deadline
+	defaultShutdownBudget = 2 * time.Second
+	// shutdownMargin is left before the deadline so that the process exits before it is killed
+	shutdownMargin = 100 * time.Millisecond
+	// retireAttempts is the number of attempts to retire the host
+	retireAttempts = 2
+	// recordBudget is reserved at the end of the budget to record the retire failure, so that slow attempts don't use it up
+	recordBudget = 300 * time.Millisecond
+)
+
+var shutdownReasons = []extension.ShutdownReason{extension.Spindown, extension.Timeout, extension.Failure}
+
+// shutdownCoordinator flushes the remaining telemetry and retires the host within the deadline of the SHUTDOWN event
+type shutdownCoordinator struct {
+	dispatcher     *dispatcher.Dispatcher
+	host           *mackerel.Host
+	logEventsQueue *queue.Queue
+	capture        *telemetry.Capture
+	roleFullnames  []string
+}
+
+// Shutdown spends the first half of the budget on the final flush and the upload of the telemetry capture, and the rest on the retirement.
+// If the host couldn't be retired, it is recorded for the reaper within recordBudget reserved at the end.
+func (c *shutdownCoordinator) Shutdown(res *extension.NextEventResponse) {
+	now := time.Now()
+	deadline := now.Add(defaultShutdownBudget)
+	if res.DeadlineMs > 0 {
+		deadline = time.UnixMilli(res.DeadlineMs)
+	}
+	deadline = deadline.Add(-shutdownMargin)
+	Logger.Info("Shutdown reason:", res.ShutdownReason, "budget:", deadline.Sub(now))
+
+	flushCtx, cancel := context.WithDeadline(context.Background(), now.Add(deadline.Sub(now)/2))
+	err := runWithin(flushCtx, func() error {
+		c.dispatcher.Dispatch(flushCtx, c.logEventsQueue, true)
+		c.dispatcher.PostMetrics(flushCtx, shutdownReasonMetrics(res.ShutdownReason, time.Now()))
+		return c.dispatcher.Flush(flushCtx)
+	})
+	if err != nil {
+		Logger.Warning("Failed to flush on shutdown:", err)
+	}
+	if c.capture != nil {
+		if err := runWithin(flushCtx, func() error { return c.capture.Upload(flushCtx) }); err != nil {
+			Logger.Warning("Failed to upload the telemetry capture:", err)
+		}
+	}
+	cancel()
+
+	retireCtx, cancel := context.WithDeadline(context.Background(), deadline.Add(-recordBudget))
+	defer cancel()
+	for attempt := 1; attempt <= retireAttempts; attempt++ {
+		err = runWithin(retireCtx, c.host.Retire)
+		if err == nil || retireCtx.Err() != nil {
+			break
+		}
+		Logger.Warning("Failed to retire the host, attempt", attempt, ":", err)
+	}
+	if err == nil {
+		return
+	}
+
+	Logger.Warning("Giving up retiring the host:", err)
+	recordCtx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := runWithin(recordCtx, func() error { return c.host.RecordRetireFailure(c.roleFullnames) }); err != nil {
+		Logger.Warning("Failed to record the retire failure:", err)
+	}
+}
+
+// runWithin runs fn and returns its error, or the error of ctx if it ends first.
+// fn keeps running in the background after ctx ends since the API client can't be canceled.
+func runWithin(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func shutdownReasonMetrics(reason extension.ShutdownReason, now time.Time) []*mackerelclient.MetricValue {
+	metrics := make([]*mackerelclient.MetricValue, 0, len(shutdownReasons))
+	for _, r := range shutdownReasons {
+		value := 0.0
+		if r == reason {
+			value = 1.0
+		}
+		metrics = append(metrics, &mackerelclient.MetricValue{
+			Name:  "custom.lambda.extension.shutdown." + string(r),
+			Time:  now.Unix(),
+			Value: value,
+		})
+	}
+	return metrics
+}
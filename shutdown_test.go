@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-collections/go-datastructures/queue"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/dispatcher"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/host/mackerel"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/host/mackerel/mackereltest"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/lambda/extension"
+)
+
+func TestShutdownRecordsRetireFailureAfterSlowRetire(t *testing.T) {
+	server := mackereltest.NewServer()
+	server.APIKey = "test-api-key"
+	defer server.Close()
+	if err := mackerel.UseAPIBase(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	defer mackerel.UseAPIBase("")
+	mackerel.UseHostIDFile(filepath.Join(t.TempDir(), "host.id"))
+
+	roleFullnames := []string{"lambda:sample-function"}
+	host, err := mackerel.CreateOrGetHost(&mackerel.CreateOrGetHostParam{
+		MackerelApiKey: server.APIKey,
+		RoleFullnames:  roleFullnames,
+		FunctionName:   "sample-function",
+		EnvironmentID:  testEnvironmentID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the retirement takes longer than the whole budget
+	server.Inject(mackereltest.Failure{
+		Method:     http.MethodPost,
+		PathPrefix: "/api/v0/hosts/" + host.ID + "/retire",
+		Status:     http.StatusServiceUnavailable,
+		Delay:      1500 * time.Millisecond,
+	})
+
+	coordinator := &shutdownCoordinator{
+		dispatcher:     dispatcher.NewDispatcher(host, nil, &dispatcher.CheckConfig{}),
+		host:           host,
+		logEventsQueue: queue.New(1),
+		roleFullnames:  roleFullnames,
+	}
+	coordinator.Shutdown(&extension.NextEventResponse{
+		EventType:      extension.Shutdown,
+		ShutdownReason: extension.Timeout,
+		DeadlineMs:     time.Now().Add(time.Second).UnixMilli(),
+	})
+
+	var failures struct {
+		HostIDs []string `json:"hostIds"`
+	}
+	metadata := server.RoleMetadata("lambda", "sample-function", "mackerel-lambda-extension-agent-retire-failures")
+	if metadata == nil {
+		t.Fatal("the retire failure isn't recorded")
+	}
+	if err := json.Unmarshal(metadata, &failures); err != nil {
+		t.Fatal(err)
+	}
+	if len(failures.HostIDs) != 1 || failures.HostIDs[0] != host.ID {
+		t.Errorf("retire failures = %v, want %s", failures.HostIDs, host.ID)
+	}
+}
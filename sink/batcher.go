@@ -0,0 +1,87 @@
+package sink
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Batcher buffers the items of a sink and posts them in batches with retries.
+// It's shared by the sinks of the metrics and the function logs.
+type Batcher[T any] struct {
+	name string
+	// noun names the items in logs, e.g. metrics
+	noun          string
+	conf          *BatchConfig
+	maxBuffered   int
+	post          func(ctx context.Context, items []T) error
+	mu            sync.Mutex
+	buffer        []T
+	lastFlushedAt time.Time
+	dropped       int
+}
+
+// NewBatcher returns a Batcher posting the items by post. The oldest items beyond maxBuffered are dropped.
+func NewBatcher[T any](name string, noun string, conf *BatchConfig, maxBuffered int, post func(ctx context.Context, items []T) error) *Batcher[T] {
+	return &Batcher[T]{
+		name:        name,
+		noun:        noun,
+		conf:        conf,
+		maxBuffered: maxBuffered,
+		post:        post,
+		buffer:      make([]T, 0, conf.BatchSize),
+	}
+}
+
+// Add queues the items, and posts them when the batch is ready
+func (b *Batcher[T]) Add(ctx context.Context, items []T) error {
+	b.mu.Lock()
+	b.buffer = append(b.buffer, items...)
+	if over := len(b.buffer) - b.maxBuffered; b.maxBuffered > 0 && over > 0 {
+		Logger.Warning("[", b.name, "] Dropping", over, "buffered", b.noun)
+		b.buffer = b.buffer[over:]
+		b.dropped += over
+	}
+	ready := len(b.buffer) >= b.conf.BatchSize || time.Since(b.lastFlushedAt) >= b.conf.FlushInterval
+	b.mu.Unlock()
+
+	if !ready {
+		return nil
+	}
+	return b.Flush(ctx)
+}
+
+// Flush posts all the queued items
+func (b *Batcher[T]) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastFlushedAt = time.Now()
+	for len(b.buffer) > 0 {
+		size := len(b.buffer)
+		if b.conf.BatchSize > 0 && size > b.conf.BatchSize {
+			size = b.conf.BatchSize
+		}
+		batch := b.buffer[:size]
+		err := Retry(ctx, b.conf, b.name, func() error {
+			return b.post(ctx, batch)
+		})
+		if err != nil && !IsPermanent(err) {
+			// keep the batch to post it on the next flush
+			return err
+		}
+		if err != nil {
+			Logger.Warning("[", b.name, "] Dropping", size, b.noun+":", err)
+			b.dropped += size
+		}
+		b.buffer = b.buffer[size:]
+	}
+	return nil
+}
+
+// Dropped returns the number of the items dropped so far by the limit of the buffer or by the permanent failures
+func (b *Batcher[T]) Dropped() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped
+}
@@ -0,0 +1,59 @@
+package sink
+
+import (
+	"context"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// BatchingSink buffers the metrics and posts them in batches with retries
+type BatchingSink struct {
+	poster  Poster
+	batcher *Batcher[*mackerel.MetricValue]
+}
+
+var _ Sink = &BatchingSink{}
+
+func NewBatchingSink(poster Poster, conf *Config) *BatchingSink {
+	return &BatchingSink{
+		poster:  poster,
+		batcher: NewBatcher(poster.Name(), "metrics", &conf.BatchConfig, conf.MaxBufferedMetrics, poster.Post),
+	}
+}
+
+func (s *BatchingSink) Name() string {
+	return s.poster.Name()
+}
+
+func (s *BatchingSink) Send(ctx context.Context, metrics []*mackerel.MetricValue) error {
+	return s.batcher.Add(ctx, metrics)
+}
+
+func (s *BatchingSink) Flush(ctx context.Context) error {
+	return s.batcher.Flush(ctx)
+}
+
+// Dropped returns the number of the metrics dropped so far
+func (s *BatchingSink) Dropped() int {
+	return s.batcher.Dropped()
+}
+
+// Retry calls post until it succeeds, fails permanently or the retries of conf run out
+func Retry(ctx context.Context, conf *BatchConfig, name string, post func() error) error {
+	interval := conf.RetryInterval
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = post()
+		if err == nil || IsPermanent(err) || attempt >= conf.MaxRetries {
+			return err
+		}
+		Logger.Info("[", name, "] Retrying to post:", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+}
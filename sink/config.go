@@ -0,0 +1,54 @@
+package sink
+
+import (
+	"fmt"
+	"time"
+)
+
+// BatchConfig configures the batching and the retry of a sink
+type BatchConfig struct {
+	// BatchSize is the maximum number of items posted at once
+	BatchSize int `env:"BATCH_SIZE" envDefault:"1000"`
+	// FlushInterval is the minimum interval of flushes. Items are sent on every dispatch if it's 0.
+	FlushInterval time.Duration `env:"FLUSH_INTERVAL" envDefault:"0s"`
+	// MaxRetries is the number of retries of a failed post
+	MaxRetries int `env:"MAX_RETRIES" envDefault:"2"`
+	// RetryInterval is the wait before the first retry, doubled on each retry
+	RetryInterval time.Duration `env:"RETRY_INTERVAL" envDefault:"500ms"`
+}
+
+// Validate checks the sizes and the intervals. prefix is the prefix of the environment variables, e.g. EXT_LOGS_SINK_.
+// FlushInterval may be 0 to send on every dispatch.
+func (c *BatchConfig) Validate(prefix string) error {
+	if c.BatchSize <= 0 {
+		return fmt.Errorf("invalid %sBATCH_SIZE: %d, must be positive", prefix, c.BatchSize)
+	}
+	if c.FlushInterval < 0 {
+		return fmt.Errorf("invalid %sFLUSH_INTERVAL: %s, must not be negative", prefix, c.FlushInterval)
+	}
+	if c.MaxRetries < 0 {
+		return fmt.Errorf("invalid %sMAX_RETRIES: %d, must not be negative", prefix, c.MaxRetries)
+	}
+	if c.RetryInterval <= 0 {
+		return fmt.Errorf("invalid %sRETRY_INTERVAL: %s, must be positive", prefix, c.RetryInterval)
+	}
+	return nil
+}
+
+// Config configures a sink of the metrics
+type Config struct {
+	BatchConfig
+	// MaxBufferedMetrics is the maximum number of metrics kept while the backend is failing. The oldest are dropped.
+	MaxBufferedMetrics int `env:"MAX_BUFFERED_METRICS" envDefault:"10000"`
+}
+
+// Validate checks the batching and the buffer size. prefix is the prefix of the environment variables, e.g. EXT_MACKEREL_SINK_.
+func (c *Config) Validate(prefix string) error {
+	if err := c.BatchConfig.Validate(prefix); err != nil {
+		return err
+	}
+	if c.MaxBufferedMetrics <= 0 {
+		return fmt.Errorf("invalid %sMAX_BUFFERED_METRICS: %d, must be positive", prefix, c.MaxBufferedMetrics)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package sink
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Headers are the HTTP headers added to the requests of a sink.
+// It's parsed from the environment variable in the format of <name>=<value>,...,<name>=<value>.
+type Headers map[string]string
+
+func (h *Headers) UnmarshalText(text []byte) error {
+	headers := make(Headers)
+	for _, pair := range strings.Split(string(text), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid header %q, must be <name>=<value>", pair)
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	*h = headers
+	return nil
+}
@@ -0,0 +1,25 @@
+package sink
+
+import (
+	"context"
+	"time"
+)
+
+// LogRecord is a line of the function logs
+type LogRecord struct {
+	Time time.Time
+	// RequestID is the invocation which wrote the line. It's empty for the lines written during the initialization.
+	RequestID string
+	// Level is given only if the function uses the JSON log format
+	Level   string
+	Message string
+}
+
+// LogSink is an output of the function logs
+type LogSink interface {
+	Name() string
+	// SendLogs queues the records, and sends them when the batch is ready
+	SendLogs(ctx context.Context, records []*LogRecord) error
+	// Flush sends all the queued records
+	Flush(ctx context.Context) error
+}
@@ -0,0 +1,42 @@
+package logs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
+)
+
+const (
+	FormatJSONLines     = "jsonlines"
+	FormatLoki          = "loki"
+	FormatElasticsearch = "elasticsearch"
+)
+
+type LogsConfig struct {
+	// Endpoint is the URL the function logs are shipped to. The function logs are subscribed only if it's set.
+	Endpoint string `env:"EXT_LOGS_ENDPOINT"`
+	// Format is the protocol of the endpoint: jsonlines, loki or elasticsearch
+	Format string `env:"EXT_LOGS_FORMAT" envDefault:"jsonlines"`
+	// ElasticsearchIndex is the index the records are written to with the elasticsearch format
+	ElasticsearchIndex string        `env:"EXT_LOGS_ELASTICSEARCH_INDEX" envDefault:"lambda-logs"`
+	Headers            sink.Headers  `env:"EXT_LOGS_HEADERS"`
+	Timeout            time.Duration `env:"EXT_LOGS_TIMEOUT" envDefault:"5s"`
+	// SinkConfig configures the batching. The sizes are counted in log records.
+	SinkConfig sink.BatchConfig `envPrefix:"EXT_LOGS_SINK_"`
+	// MaxBufferedRecords is the maximum number of log records kept while the endpoint is failing. The oldest are dropped.
+	MaxBufferedRecords int `env:"EXT_LOGS_SINK_MAX_BUFFERED_RECORDS" envDefault:"10000"`
+}
+
+// Validate checks the format of the endpoint and the buffer size
+func (c *LogsConfig) Validate() error {
+	if c.MaxBufferedRecords <= 0 {
+		return fmt.Errorf("invalid EXT_LOGS_SINK_MAX_BUFFERED_RECORDS: %d, must be positive", c.MaxBufferedRecords)
+	}
+	switch c.Format {
+	case FormatJSONLines, FormatLoki, FormatElasticsearch:
+		return nil
+	default:
+		return fmt.Errorf("invalid EXT_LOGS_FORMAT: %q, must be one of %s, %s or %s", c.Format, FormatJSONLines, FormatLoki, FormatElasticsearch)
+	}
+}
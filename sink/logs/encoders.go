@@ -0,0 +1,163 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
+)
+
+// encoder builds the request body of a batch in the protocol of the endpoint
+type encoder interface {
+	name() string
+	contentType() string
+	encode(records []*sink.LogRecord) ([]byte, error)
+	// checkResponse inspects the body of a successful response for errors of the records
+	checkResponse(body []byte) error
+}
+
+// document is the JSON object of a record enriched with the fields
+func document(record *sink.LogRecord, fields map[string]string, timeKey string) map[string]string {
+	doc := make(map[string]string, len(fields)+4)
+	for k, v := range fields {
+		doc[k] = v
+	}
+	doc[timeKey] = record.Time.UTC().Format(time.RFC3339Nano)
+	doc["message"] = record.Message
+	if record.RequestID != "" {
+		doc["request_id"] = record.RequestID
+	}
+	if record.Level != "" {
+		doc["level"] = record.Level
+	}
+	return doc
+}
+
+// jsonLinesEncoder writes a JSON object per line
+type jsonLinesEncoder struct {
+	fields map[string]string
+}
+
+func (e *jsonLinesEncoder) name() string        { return FormatJSONLines }
+func (e *jsonLinesEncoder) contentType() string { return "application/x-ndjson" }
+
+func (e *jsonLinesEncoder) encode(records []*sink.LogRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, record := range records {
+		if err := enc.Encode(document(record, e.fields, "time")); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (e *jsonLinesEncoder) checkResponse(body []byte) error { return nil }
+
+// lokiEncoder writes a request of the Loki push API.
+// The fields are the labels of the stream, and the lines are JSON objects of the other properties.
+type lokiEncoder struct {
+	labels map[string]string
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+type lokiPushRequest struct {
+	Streams []lokiStream `json:"streams"`
+}
+
+func (e *lokiEncoder) name() string        { return FormatLoki }
+func (e *lokiEncoder) contentType() string { return "application/json" }
+
+func (e *lokiEncoder) encode(records []*sink.LogRecord) ([]byte, error) {
+	values := make([][2]string, 0, len(records))
+	for _, record := range records {
+		line := map[string]string{"message": record.Message}
+		if record.RequestID != "" {
+			line["request_id"] = record.RequestID
+		}
+		if record.Level != "" {
+			line["level"] = record.Level
+		}
+		s, err := json.Marshal(line)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, [2]string{strconv.FormatInt(record.Time.UnixNano(), 10), string(s)})
+	}
+	return json.Marshal(&lokiPushRequest{
+		Streams: []lokiStream{{Stream: e.labels, Values: values}},
+	})
+}
+
+func (e *lokiEncoder) checkResponse(body []byte) error { return nil }
+
+// elasticsearchEncoder writes a request of the Elasticsearch bulk API
+type elasticsearchEncoder struct {
+	index  string
+	fields map[string]string
+}
+
+type bulkIndexAction struct {
+	Index struct {
+		Index string `json:"_index"`
+	} `json:"index"`
+}
+
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+func (e *elasticsearchEncoder) name() string        { return FormatElasticsearch }
+func (e *elasticsearchEncoder) contentType() string { return "application/x-ndjson" }
+
+func (e *elasticsearchEncoder) encode(records []*sink.LogRecord) ([]byte, error) {
+	action := &bulkIndexAction{}
+	action.Index.Index = e.index
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, record := range records {
+		if err := enc.Encode(action); err != nil {
+			return nil, err
+		}
+		if err := enc.Encode(document(record, e.fields, "@timestamp")); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// checkResponse fails permanently if some records are rejected, since retrying the batch would duplicate the others
+func (e *elasticsearchEncoder) checkResponse(body []byte) error {
+	res := &bulkResponse{}
+	if err := json.Unmarshal(body, res); err != nil || !res.Errors {
+		return nil
+	}
+	rejected := 0
+	reason := ""
+	for _, item := range res.Items {
+		for _, result := range item {
+			if result.Error != nil {
+				rejected++
+				if reason == "" {
+					reason = result.Error.Type + ": " + result.Error.Reason
+				}
+			}
+		}
+	}
+	return sink.Permanent(fmt.Errorf("%d of %d log records were rejected: %s", rejected, len(res.Items), reason))
+}
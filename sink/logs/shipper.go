@@ -0,0 +1,98 @@
+package logs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
+	"github.com/sirupsen/logrus"
+)
+
+var Logger *logrus.Entry
+
+// Shipper buffers the function logs and posts them in batches to a log endpoint
+type Shipper struct {
+	httpClient *http.Client
+	endpoint   string
+	headers    map[string]string
+	encoder    encoder
+	batcher    *sink.Batcher[*sink.LogRecord]
+}
+
+var _ sink.LogSink = &Shipper{}
+
+// NewShipper returns a Shipper which adds the fields to every record
+func NewShipper(conf *LogsConfig, fields map[string]string) *Shipper {
+	nonEmpty := make(map[string]string, len(fields))
+	for k, v := range fields {
+		if v != "" {
+			nonEmpty[k] = v
+		}
+	}
+
+	var enc encoder
+	switch conf.Format {
+	case FormatLoki:
+		enc = &lokiEncoder{labels: nonEmpty}
+	case FormatElasticsearch:
+		enc = &elasticsearchEncoder{index: conf.ElasticsearchIndex, fields: nonEmpty}
+	default:
+		enc = &jsonLinesEncoder{fields: nonEmpty}
+	}
+	s := &Shipper{
+		httpClient: &http.Client{Timeout: conf.Timeout},
+		endpoint:   conf.Endpoint,
+		headers:    conf.Headers,
+		encoder:    enc,
+	}
+	s.batcher = sink.NewBatcher(s.Name(), "log records", &conf.SinkConfig, conf.MaxBufferedRecords, s.post)
+	return s
+}
+
+func (s *Shipper) Name() string {
+	return "logs " + s.encoder.name()
+}
+
+func (s *Shipper) SendLogs(ctx context.Context, records []*sink.LogRecord) error {
+	return s.batcher.Add(ctx, records)
+}
+
+func (s *Shipper) Flush(ctx context.Context) error {
+	return s.batcher.Flush(ctx)
+}
+
+func (s *Shipper) post(ctx context.Context, records []*sink.LogRecord) error {
+	body, err := s.encoder.encode(records)
+	if err != nil {
+		return sink.Permanent(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return sink.Permanent(err)
+	}
+	req.Header.Set("Content-Type", s.encoder.contentType())
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	Logger.Info("shipping", len(records), "log records to", s.endpoint)
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resBody, _ := io.ReadAll(res.Body)
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return s.encoder.checkResponse(resBody)
+	}
+	err = fmt.Errorf("%s failed: %d[%s] %s", s.endpoint, res.StatusCode, res.Status, string(resBody))
+	if res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests {
+		return sink.Permanent(err)
+	}
+	return err
+}
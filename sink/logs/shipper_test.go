@@ -0,0 +1,169 @@
+package logs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	Logger = logrus.NewEntry(logrus.New())
+	Logger.Logger.SetOutput(io.Discard)
+	sink.Logger = Logger
+}
+
+// endpoint is a stand-in log endpoint recording the requests
+type endpoint struct {
+	mu           sync.Mutex
+	response     string
+	bodies       [][]byte
+	contentTypes []string
+}
+
+func newEndpoint(t *testing.T, response string) (*endpoint, *httptest.Server) {
+	e := &endpoint{response: response}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		e.mu.Lock()
+		e.bodies = append(e.bodies, body)
+		e.contentTypes = append(e.contentTypes, req.Header.Get("Content-Type"))
+		e.mu.Unlock()
+		io.WriteString(w, e.response)
+	}))
+	t.Cleanup(server.Close)
+	return e, server
+}
+
+func newTestShipper(server *httptest.Server, format string) *Shipper {
+	return NewShipper(&LogsConfig{
+		Endpoint:           server.URL,
+		Format:             format,
+		ElasticsearchIndex: "lambda-logs",
+		Timeout:            time.Second,
+		SinkConfig:         sink.BatchConfig{BatchSize: 10, MaxRetries: 0, RetryInterval: time.Millisecond},
+		MaxBufferedRecords: 100,
+	}, map[string]string{"function_name": "sample-function", "function_version": ""})
+}
+
+var testTime = time.Date(2024, 1, 2, 3, 4, 5, 6000000, time.UTC)
+
+func testRecords() []*sink.LogRecord {
+	return []*sink.LogRecord{
+		{Time: testTime, RequestID: "request-1", Message: "hello"},
+		{Time: testTime.Add(time.Second), RequestID: "request-1", Level: "ERROR", Message: "failed"},
+	}
+}
+
+// ship sends the records and flushes them, and returns the body of the request
+func ship(t *testing.T, s *Shipper, e *endpoint, wantContentType string) []byte {
+	t.Helper()
+	ctx := context.Background()
+	if err := s.SendLogs(ctx, testRecords()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.bodies) != 1 {
+		t.Fatalf("requests = %d, want 1", len(e.bodies))
+	}
+	if e.contentTypes[0] != wantContentType {
+		t.Errorf("Content-Type = %s, want %s", e.contentTypes[0], wantContentType)
+	}
+	return e.bodies[0]
+}
+
+// jsonLines decodes a JSON object per line
+func jsonLines(t *testing.T, body []byte) []map[string]interface{} {
+	t.Helper()
+	lines := make([]map[string]interface{}, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestShipperPostsJSONLines(t *testing.T) {
+	e, server := newEndpoint(t, "")
+	body := ship(t, newTestShipper(server, FormatJSONLines), e, "application/x-ndjson")
+
+	want := []map[string]interface{}{
+		{"time": "2024-01-02T03:04:05.006Z", "message": "hello", "request_id": "request-1", "function_name": "sample-function"},
+		{"time": "2024-01-02T03:04:06.006Z", "message": "failed", "request_id": "request-1", "level": "ERROR", "function_name": "sample-function"},
+	}
+	if got := jsonLines(t, body); !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %v, want %v", got, want)
+	}
+}
+
+func TestShipperPostsLokiPushRequest(t *testing.T) {
+	e, server := newEndpoint(t, "")
+	body := ship(t, newTestShipper(server, FormatLoki), e, "application/json")
+
+	req := &lokiPushRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.Streams) != 1 {
+		t.Fatalf("streams = %d, want 1", len(req.Streams))
+	}
+	stream := req.Streams[0]
+	if !reflect.DeepEqual(stream.Stream, map[string]string{"function_name": "sample-function"}) {
+		t.Errorf("labels = %v, want the non-empty fields", stream.Stream)
+	}
+	want := [][2]string{
+		{"1704164645006000000", `{"message":"hello","request_id":"request-1"}`},
+		{"1704164646006000000", `{"level":"ERROR","message":"failed","request_id":"request-1"}`},
+	}
+	if !reflect.DeepEqual(stream.Values, want) {
+		t.Errorf("values = %v, want %v", stream.Values, want)
+	}
+}
+
+func TestShipperPostsElasticsearchBulkRequest(t *testing.T) {
+	e, server := newEndpoint(t, `{"errors":false,"items":[]}`)
+	body := ship(t, newTestShipper(server, FormatElasticsearch), e, "application/x-ndjson")
+
+	action := map[string]interface{}{"index": map[string]interface{}{"_index": "lambda-logs"}}
+	want := []map[string]interface{}{
+		action,
+		{"@timestamp": "2024-01-02T03:04:05.006Z", "message": "hello", "request_id": "request-1", "function_name": "sample-function"},
+		action,
+		{"@timestamp": "2024-01-02T03:04:06.006Z", "message": "failed", "request_id": "request-1", "level": "ERROR", "function_name": "sample-function"},
+	}
+	if got := jsonLines(t, body); !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %v, want %v", got, want)
+	}
+}
+
+func TestShipperDropsRecordsRejectedByElasticsearch(t *testing.T) {
+	_, server := newEndpoint(t, `{"errors":true,"items":[{"index":{"status":201}},{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}]}`)
+	s := newTestShipper(server, FormatElasticsearch)
+
+	err := s.post(context.Background(), testRecords())
+	if !sink.IsPermanent(err) || !strings.Contains(err.Error(), "1 of 2 log records were rejected: mapper_parsing_exception") {
+		t.Errorf("err = %v, want a permanent error of the rejected record", err)
+	}
+}
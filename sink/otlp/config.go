@@ -0,0 +1,19 @@
+package otlp
+
+import (
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
+)
+
+type OTLPConfig struct {
+	// Endpoint is the URL of the OTLP/HTTP receiver. /v1/metrics is appended if it has no path.
+	Endpoint string `env:"EXT_OTLP_ENDPOINT"`
+	// TracesEnabled enables the export of the spans of the invocations
+	TracesEnabled bool `env:"EXT_OTLP_TRACES_ENABLED" envDefault:"false"`
+	// TracesEndpoint is the URL of the receiver of the traces if it differs from Endpoint. /v1/traces is appended if it has no path.
+	TracesEndpoint string        `env:"EXT_OTLP_TRACES_ENDPOINT"`
+	Headers        sink.Headers  `env:"EXT_OTLP_HEADERS"`
+	Timeout        time.Duration `env:"EXT_OTLP_TIMEOUT" envDefault:"5s"`
+	SinkConfig     sink.Config   `envPrefix:"EXT_OTLP_SINK_"`
+}
@@ -0,0 +1,292 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
+	"github.com/mackerelio/mackerel-client-go"
+	"github.com/sirupsen/logrus"
+)
+
+var Logger *logrus.Entry
+
+const (
+	metricsPath = "/v1/metrics"
+	scopeName   = "mackerel-lambda-extension-agent"
+
+	// aggregationTemporalityDelta is AGGREGATION_TEMPORALITY_DELTA of OTLP
+	aggregationTemporalityDelta = 1
+)
+
+// histogramCountMetricNames are the counts of the samples of the histogram families by the prefix of the families.
+// The families aggregated from platform.report and platform.runtimeDone have a sample per event.
+var histogramCountMetricNames = map[string]string{
+	"custom.lambda.platform.report.":      "custom.lambda.platform.report.count",
+	"custom.lambda.platform.runtimeDone.": "custom.lambda.platform.runtimeDone.invocations.count",
+}
+
+// Resource describes the runtime environment the metrics come from
+type Resource struct {
+	FunctionName    string
+	FunctionVersion string
+	EnvironmentID   string
+	Region          string
+}
+
+func (r *Resource) attributes() []keyValue {
+	return []keyValue{
+		stringKeyValue("service.name", r.FunctionName),
+		stringKeyValue("cloud.provider", "aws"),
+		stringKeyValue("cloud.platform", "aws_lambda"),
+		stringKeyValue("cloud.region", r.Region),
+		stringKeyValue("faas.name", r.FunctionName),
+		stringKeyValue("faas.version", r.FunctionVersion),
+		stringKeyValue("faas.instance", r.EnvironmentID),
+	}
+}
+
+// Exporter posts the aggregated metrics to an OTLP/HTTP receiver in the JSON encoding
+type Exporter struct {
+	httpClient *http.Client
+	endpoint   string
+	headers    map[string]string
+	resource   *Resource
+
+	mu             sync.Mutex
+	lastExportedAt time.Time
+}
+
+var _ sink.Poster = &Exporter{}
+
+func NewExporter(conf *OTLPConfig, resource *Resource) (*Exporter, error) {
+	endpoint, err := signalEndpoint(conf.Endpoint, metricsPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Exporter{
+		httpClient:     &http.Client{Timeout: conf.Timeout},
+		endpoint:       endpoint,
+		headers:        conf.Headers,
+		resource:       resource,
+		lastExportedAt: time.Now(),
+	}, nil
+}
+
+// signalEndpoint returns the URL to post the signal to. The path of the signal is set if the endpoint has no path
+// or the path of another signal.
+func signalEndpoint(endpoint string, path string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid OTLP endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("invalid OTLP endpoint: scheme must be http or https: %s", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" || u.Path == metricsPath || u.Path == tracesPath {
+		u.Path = path
+	}
+	return u.String(), nil
+}
+
+func (e *Exporter) Name() string {
+	return "otlp"
+}
+
+func (e *Exporter) Post(ctx context.Context, metrics []*mackerel.MetricValue) error {
+	e.mu.Lock()
+	startTime := e.lastExportedAt
+	e.lastExportedAt = time.Now()
+	e.mu.Unlock()
+
+	body, err := json.Marshal(&exportMetricsServiceRequest{
+		ResourceMetrics: []resourceMetrics{
+			{
+				Resource: resource{Attributes: e.resource.attributes()},
+				ScopeMetrics: []scopeMetrics{
+					{
+						Scope:   instrumentationScope{Name: scopeName},
+						Metrics: convertMetrics(metrics, startTime),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return sink.Permanent(err)
+	}
+
+	Logger.Info("exporting metrics to", e.endpoint)
+	return post(ctx, e.httpClient, e.endpoint, body, e.headers)
+}
+
+// post sends an OTLP/HTTP JSON request. Client errors except 429 are not retried as the OTLP specification says.
+func post(ctx context.Context, client *http.Client, endpoint string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return sink.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resBody, _ := io.ReadAll(res.Body)
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("%s failed: %d[%s] %s", endpoint, res.StatusCode, res.Status, string(resBody))
+	if res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests {
+		return sink.Permanent(err)
+	}
+	return err
+}
+
+// histogramKey identifies the avg/max/min values aggregated by a dispatch.
+// A batch may contain several dispatches, which are told apart by the time of the values.
+type histogramKey struct {
+	family string
+	time   int64
+}
+
+// convertMetrics converts the avg/max/min families into histograms and the other metrics into gauges.
+// A histogram has a data point per dispatch, and its count is the number of the samples aggregated by the dispatch.
+func convertMetrics(metrics []*mackerel.MetricValue, startTime time.Time) []metric {
+	counts := make(map[histogramKey]float64)
+	stats := make(map[histogramKey]map[string]float64)
+	keys := make([]histogramKey, 0)
+	for _, m := range metrics {
+		value, ok := m.Value.(float64)
+		if !ok {
+			continue
+		}
+		counts[histogramKey{m.Name, m.Time}] = value
+		family, ok := histogramFamily(m.Name)
+		if !ok {
+			continue
+		}
+		key := histogramKey{family, m.Time}
+		if stats[key] == nil {
+			stats[key] = make(map[string]float64, 3)
+			keys = append(keys, key)
+		}
+		stats[key][strings.TrimPrefix(m.Name, family+".")] = value
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].time < keys[j].time })
+
+	converted := make([]metric, 0, len(metrics))
+	histogramIndexes := make(map[string]int)
+	histogramKeys := make(map[histogramKey]bool)
+	lastPointTimes := make(map[string]time.Time)
+	for _, key := range keys {
+		avg, okAvg := stats[key]["avg"]
+		max, okMax := stats[key]["max"]
+		min, okMin := stats[key]["min"]
+		count := counts[histogramKey{histogramCountMetricName(key.family), key.time}]
+		if !okAvg || !okMax || !okMin || count == 0 {
+			continue
+		}
+		histogramKeys[key] = true
+
+		// the data points of a family don't overlap: each starts at the previous one
+		pointTime := time.Unix(key.time, 0)
+		pointStartTime, ok := lastPointTimes[key.family]
+		if !ok {
+			pointStartTime = startTime
+		}
+		if pointStartTime.After(pointTime) {
+			pointStartTime = pointTime
+		}
+		lastPointTimes[key.family] = pointTime
+
+		i, ok := histogramIndexes[key.family]
+		if !ok {
+			i = len(converted)
+			histogramIndexes[key.family] = i
+			converted = append(converted, metric{
+				Name: otlpMetricName(key.family),
+				Histogram: &histogram{
+					AggregationTemporality: aggregationTemporalityDelta,
+					DataPoints:             []histogramDataPoint{},
+				},
+			})
+		}
+		converted[i].Histogram.DataPoints = append(converted[i].Histogram.DataPoints, histogramDataPoint{
+			StartTimeUnixNano: unixNano(pointStartTime),
+			TimeUnixNano:      unixNano(pointTime),
+			Count:             strconv.FormatInt(int64(count), 10),
+			Sum:               avg * count,
+			Min:               min,
+			Max:               max,
+			BucketCounts:      []string{strconv.FormatInt(int64(count), 10)},
+			ExplicitBounds:    []float64{},
+		})
+	}
+
+	for _, m := range metrics {
+		if family, ok := histogramFamily(m.Name); ok && histogramKeys[histogramKey{family, m.Time}] {
+			continue
+		}
+		value, ok := m.Value.(float64)
+		if !ok {
+			continue
+		}
+		converted = append(converted, metric{
+			Name: otlpMetricName(m.Name),
+			Gauge: &gauge{
+				DataPoints: []numberDataPoint{
+					{TimeUnixNano: unixNano(time.Unix(m.Time, 0)), AsDouble: value},
+				},
+			},
+		})
+	}
+	return converted
+}
+
+// histogramFamily returns the family name of an avg/max/min metric which can be converted into a histogram
+func histogramFamily(name string) (string, bool) {
+	if histogramCountMetricName(name) == "" {
+		return "", false
+	}
+	for _, suffix := range []string{".avg", ".max", ".min"} {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix), true
+		}
+	}
+	return "", false
+}
+
+// histogramCountMetricName returns the name of the count of the samples of the family, or an empty string if it's not a histogram family
+func histogramCountMetricName(family string) string {
+	for prefix, name := range histogramCountMetricNames {
+		if strings.HasPrefix(family, prefix) {
+			return name
+		}
+	}
+	return ""
+}
+
+// otlpMetricName drops the prefix of Mackerel custom metrics
+func otlpMetricName(name string) string {
+	return strings.TrimPrefix(name, "custom.")
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
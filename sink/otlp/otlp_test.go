@@ -0,0 +1,191 @@
+package otlp
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
+	"github.com/mackerelio/mackerel-client-go"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	Logger = logrus.NewEntry(logrus.New())
+	Logger.Logger.SetOutput(io.Discard)
+}
+
+// receiver is a stand-in OTLP/HTTP receiver recording the requests
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	requests []*exportMetricsServiceRequest
+	headers  []http.Header
+}
+
+func newReceiver(t *testing.T) (*receiver, *httptest.Server) {
+	r := &receiver{status: http.StatusOK}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != metricsPath {
+			t.Errorf("path = %s, want %s", req.URL.Path, metricsPath)
+		}
+		if ct := req.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %s, want application/json", ct)
+		}
+		body := &exportMetricsServiceRequest{}
+		if err := json.NewDecoder(req.Body).Decode(body); err != nil {
+			t.Errorf("failed to decode the request: %v", err)
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.requests = append(r.requests, body)
+		r.headers = append(r.headers, req.Header.Clone())
+		w.WriteHeader(r.status)
+	}))
+	t.Cleanup(server.Close)
+	return r, server
+}
+
+func newTestExporter(t *testing.T, endpoint string) *Exporter {
+	exporter, err := NewExporter(&OTLPConfig{
+		Endpoint: endpoint,
+		Headers:  sink.Headers{"Authorization": "Bearer token"},
+		Timeout:  time.Second,
+	}, &Resource{FunctionName: "sample-function", Region: "us-east-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exporter
+}
+
+func dispatchedMetrics(at int64, reports float64, invocations float64, durations ...float64) []*mackerel.MetricValue {
+	avg, max, min := 0.0, durations[0], durations[0]
+	for _, d := range durations {
+		avg += d / float64(len(durations))
+		if d > max {
+			max = d
+		}
+		if d < min {
+			min = d
+		}
+	}
+	return []*mackerel.MetricValue{
+		{Name: "custom.lambda.platform.report.duration.avg", Time: at, Value: avg},
+		{Name: "custom.lambda.platform.report.duration.max", Time: at, Value: max},
+		{Name: "custom.lambda.platform.report.duration.min", Time: at, Value: min},
+		{Name: "custom.lambda.platform.runtimeDone.duration.avg", Time: at, Value: avg},
+		{Name: "custom.lambda.platform.runtimeDone.duration.max", Time: at, Value: max},
+		{Name: "custom.lambda.platform.runtimeDone.duration.min", Time: at, Value: min},
+		{Name: "custom.lambda.platform.report.count", Time: at, Value: reports},
+		{Name: "custom.lambda.platform.runtimeDone.invocations.count", Time: at, Value: invocations},
+	}
+}
+
+func findMetric(t *testing.T, req *exportMetricsServiceRequest, name string) *metric {
+	t.Helper()
+	for _, rm := range req.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for i := range sm.Metrics {
+				if sm.Metrics[i].Name == name {
+					return &sm.Metrics[i]
+				}
+			}
+		}
+	}
+	t.Fatalf("metric %s is not exported", name)
+	return nil
+}
+
+func TestExporterPostsHistogramPerDispatch(t *testing.T) {
+	r, server := newReceiver(t)
+	exporter := newTestExporter(t, server.URL)
+
+	// a batch of two dispatches, e.g. buffered by the flush interval or retried after a failure
+	metrics := append(dispatchedMetrics(1700000000, 2, 3, 1, 3), dispatchedMetrics(1700000060, 1, 1, 5)...)
+	if err := exporter.Post(context.Background(), metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.requests) != 1 {
+		t.Fatalf("requests = %d, want 1", len(r.requests))
+	}
+	if got := r.headers[0].Get("Authorization"); got != "Bearer token" {
+		t.Errorf("Authorization = %q, want the configured header", got)
+	}
+
+	report := findMetric(t, r.requests[0], "lambda.platform.report.duration")
+	if report.Histogram == nil {
+		t.Fatal("report.duration is not a histogram")
+	}
+	points := report.Histogram.DataPoints
+	if len(points) != 2 {
+		t.Fatalf("data points = %d, want one per dispatch", len(points))
+	}
+	if points[0].Count != "2" || points[0].Sum != 4 || points[0].Min != 1 || points[0].Max != 3 {
+		t.Errorf("first point = %+v, want the 2 reports of the first dispatch", points[0])
+	}
+	if points[1].Count != "1" || points[1].Sum != 5 {
+		t.Errorf("second point = %+v, want the report of the second dispatch", points[1])
+	}
+	if points[1].StartTimeUnixNano != points[0].TimeUnixNano {
+		t.Errorf("second point starts at %s, want the time of the first one %s", points[1].StartTimeUnixNano, points[0].TimeUnixNano)
+	}
+
+	// the count of the runtimeDone family is the invocations, not the reports
+	done := findMetric(t, r.requests[0], "lambda.platform.runtimeDone.duration")
+	if got := done.Histogram.DataPoints[0].Count; got != "3" {
+		t.Errorf("runtimeDone count = %s, want 3", got)
+	}
+
+	// the counts are exported as gauges too
+	count := findMetric(t, r.requests[0], "lambda.platform.report.count")
+	if count.Gauge == nil || len(count.Gauge.DataPoints) != 1 {
+		t.Errorf("report.count = %+v, want a gauge", count)
+	}
+}
+
+func TestExporterFallsBackToGaugesWithoutCount(t *testing.T) {
+	r, server := newReceiver(t)
+	exporter := newTestExporter(t, server.URL)
+
+	metrics := dispatchedMetrics(1700000000, 0, 1, 2)
+	if err := exporter.Post(context.Background(), metrics); err != nil {
+		t.Fatal(err)
+	}
+	if m := findMetric(t, r.requests[0], "lambda.platform.report.duration.avg"); m.Gauge == nil {
+		t.Errorf("report.duration.avg = %+v, want a gauge without reports", m)
+	}
+	if m := findMetric(t, r.requests[0], "lambda.platform.runtimeDone.duration"); m.Histogram == nil {
+		t.Errorf("runtimeDone.duration = %+v, want a histogram", m)
+	}
+}
+
+func TestExporterClassifiesErrors(t *testing.T) {
+	tests := []struct {
+		status    int
+		permanent bool
+	}{
+		{http.StatusBadRequest, true},
+		{http.StatusTooManyRequests, false},
+		{http.StatusServiceUnavailable, false},
+	}
+	for _, tt := range tests {
+		r, server := newReceiver(t)
+		r.status = tt.status
+		exporter := newTestExporter(t, server.URL)
+
+		err := exporter.Post(context.Background(), dispatchedMetrics(1700000000, 1, 1, 1))
+		if err == nil {
+			t.Errorf("status %d: no error", tt.status)
+			continue
+		}
+		if got := sink.IsPermanent(err); got != tt.permanent {
+			t.Errorf("status %d: permanent = %v, want %v", tt.status, got, tt.permanent)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package otlp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
+)
+
+const (
+	tracesPath = "/v1/traces"
+
+	// spanKindInternal is SPAN_KIND_INTERNAL of OTLP
+	spanKindInternal = 1
+	// statusCodeError is STATUS_CODE_ERROR of OTLP
+	statusCodeError = 2
+)
+
+// TraceExporter posts the spans of the invocations to an OTLP/HTTP receiver in the JSON encoding
+type TraceExporter struct {
+	httpClient *http.Client
+	endpoint   string
+	headers    map[string]string
+	resource   *Resource
+}
+
+var _ sink.SpanSink = &TraceExporter{}
+
+func NewTraceExporter(conf *OTLPConfig, resource *Resource) (*TraceExporter, error) {
+	endpoint := conf.TracesEndpoint
+	if endpoint == "" {
+		endpoint = conf.Endpoint
+	}
+	endpoint, err := signalEndpoint(endpoint, tracesPath)
+	if err != nil {
+		return nil, err
+	}
+	return &TraceExporter{
+		httpClient: &http.Client{Timeout: conf.Timeout},
+		endpoint:   endpoint,
+		headers:    conf.Headers,
+		resource:   resource,
+	}, nil
+}
+
+func (e *TraceExporter) Name() string {
+	return "otlp traces"
+}
+
+func (e *TraceExporter) SendSpans(ctx context.Context, spans []*sink.Span) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(&exportTraceServiceRequest{
+		ResourceSpans: []resourceSpans{
+			{
+				Resource: resource{Attributes: e.resource.attributes()},
+				ScopeSpans: []scopeSpans{
+					{
+						Scope: instrumentationScope{Name: scopeName},
+						Spans: convertSpans(spans),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	Logger.Info("exporting spans to", e.endpoint)
+	return post(ctx, e.httpClient, e.endpoint, body, e.headers)
+}
+
+func convertSpans(spans []*sink.Span) []span {
+	converted := make([]span, 0, len(spans))
+	for _, s := range spans {
+		keys := make([]string, 0, len(s.Attributes))
+		for k := range s.Attributes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		attributes := make([]keyValue, 0, len(keys))
+		for _, k := range keys {
+			attributes = append(attributes, stringKeyValue(k, s.Attributes[k]))
+		}
+
+		status := spanStatus{}
+		if s.Failed {
+			status.Code = statusCodeError
+		}
+		converted = append(converted, span{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentSpanID,
+			Name:              s.Name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        attributes,
+			Status:            status,
+		})
+	}
+	return converted
+}
@@ -0,0 +1,15 @@
+package prometheus
+
+import (
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
+)
+
+type PrometheusConfig struct {
+	// RemoteWriteURL is the URL of the remote write receiver, e.g. http://localhost:9090/api/v1/write
+	RemoteWriteURL string        `env:"EXT_PROMETHEUS_REMOTE_WRITE_URL"`
+	Headers        sink.Headers  `env:"EXT_PROMETHEUS_HEADERS"`
+	Timeout        time.Duration `env:"EXT_PROMETHEUS_TIMEOUT" envDefault:"5s"`
+	SinkConfig     sink.Config   `envPrefix:"EXT_PROMETHEUS_SINK_"`
+}
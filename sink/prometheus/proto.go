@@ -0,0 +1,69 @@
+package prometheus
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// The types below are prometheus.WriteRequest of the remote write protocol, encoded in protobuf by hand:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+type label struct {
+	name  string
+	value string
+}
+
+type sample struct {
+	value     float64
+	timestamp int64
+}
+
+type timeSeries struct {
+	labels  []label
+	samples []sample
+}
+
+func encodeWriteRequest(series []*timeSeries) []byte {
+	buf := make([]byte, 0, 1024)
+	for _, s := range series {
+		buf = appendBytesField(buf, 1, encodeTimeSeries(s))
+	}
+	return buf
+}
+
+func encodeTimeSeries(s *timeSeries) []byte {
+	buf := make([]byte, 0, 256)
+	for _, l := range s.labels {
+		lb := appendBytesField(nil, 1, []byte(l.name))
+		lb = appendBytesField(lb, 2, []byte(l.value))
+		buf = appendBytesField(buf, 1, lb)
+	}
+	for _, smp := range s.samples {
+		sb := appendTag(nil, 1, wireFixed64)
+		sb = binary.LittleEndian.AppendUint64(sb, math.Float64bits(smp.value))
+		sb = appendTag(sb, 2, wireVarint)
+		sb = binary.AppendUvarint(sb, uint64(smp.timestamp))
+		buf = appendBytesField(buf, 2, sb)
+	}
+	return buf
+}
+
+func appendTag(buf []byte, field int, wireType int) []byte {
+	return binary.AppendUvarint(buf, uint64(field<<3|wireType))
+}
+
+func appendBytesField(buf []byte, field int, value []byte) []byte {
+	buf = appendTag(buf, field, wireBytes)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
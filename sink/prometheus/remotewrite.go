@@ -0,0 +1,153 @@
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/golang/snappy"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
+	"github.com/mackerelio/mackerel-client-go"
+	"github.com/sirupsen/logrus"
+)
+
+var Logger *logrus.Entry
+
+// aggregationSuffixes are the suffixes of the aggregated metrics turned into the aggregation label
+var aggregationSuffixes = []string{"avg", "max", "min", "p99"}
+
+var invalidNameChars = regexp.MustCompile("[^a-zA-Z0-9_:]")
+
+// RemoteWriter posts the metrics with the Prometheus remote write protocol
+type RemoteWriter struct {
+	httpClient *http.Client
+	url        string
+	headers    map[string]string
+	labels     []label
+}
+
+var _ sink.Poster = &RemoteWriter{}
+
+// NewRemoteWriter returns a RemoteWriter which adds the labels to every series
+func NewRemoteWriter(conf *PrometheusConfig, labels map[string]string) *RemoteWriter {
+	ls := make([]label, 0, len(labels))
+	for name, value := range labels {
+		if value != "" {
+			ls = append(ls, label{name: name, value: value})
+		}
+	}
+	return &RemoteWriter{
+		httpClient: &http.Client{Timeout: conf.Timeout},
+		url:        conf.RemoteWriteURL,
+		headers:    conf.Headers,
+		labels:     ls,
+	}
+}
+
+func (w *RemoteWriter) Name() string {
+	return "prometheus"
+}
+
+func (w *RemoteWriter) Post(ctx context.Context, metrics []*mackerel.MetricValue) error {
+	body := snappy.Encode(nil, encodeWriteRequest(w.toTimeSeries(metrics)))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return sink.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+
+	Logger.Info("writing metrics to", w.url)
+	res, err := w.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resBody, _ := io.ReadAll(res.Body)
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("%s failed: %d[%s] %s", w.url, res.StatusCode, res.Status, string(resBody))
+	// The remote write specification says 4xx must not be retried except 429
+	if res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests {
+		return sink.Permanent(err)
+	}
+	return err
+}
+
+// toTimeSeries groups the metrics into series sorted by the timestamps
+func (w *RemoteWriter) toTimeSeries(metrics []*mackerel.MetricValue) []*timeSeries {
+	seriesByKey := make(map[string]*timeSeries)
+	keys := make([]string, 0)
+	for _, m := range metrics {
+		value, ok := m.Value.(float64)
+		if !ok {
+			continue
+		}
+		name, aggregation := metricName(m.Name)
+		key := name + "\xff" + aggregation
+		series, ok := seriesByKey[key]
+		if !ok {
+			labels := append([]label{{name: "__name__", value: name}}, w.labels...)
+			if aggregation != "" {
+				labels = append(labels, label{name: "aggregation", value: aggregation})
+			}
+			sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+			series = &timeSeries{labels: labels}
+			seriesByKey[key] = series
+			keys = append(keys, key)
+		}
+		series.samples = append(series.samples, sample{value: value, timestamp: m.Time * 1000})
+	}
+
+	sort.Strings(keys)
+	result := make([]*timeSeries, 0, len(keys))
+	for _, key := range keys {
+		series := seriesByKey[key]
+		sort.SliceStable(series.samples, func(i, j int) bool { return series.samples[i].timestamp < series.samples[j].timestamp })
+		result = append(result, series)
+	}
+	return result
+}
+
+// metricName maps a Mackerel metric name to the Prometheus conventions,
+// e.g. custom.lambda.platform.report.billedDuration.avg is lambda_platform_report_billed_duration with aggregation="avg".
+func metricName(name string) (string, string) {
+	name = strings.TrimPrefix(name, "custom.")
+	aggregation := ""
+	for _, suffix := range aggregationSuffixes {
+		if strings.HasSuffix(name, "."+suffix) {
+			aggregation = suffix
+			name = strings.TrimSuffix(name, "."+suffix)
+			break
+		}
+	}
+	return invalidNameChars.ReplaceAllString(snakeCase(name), "_"), aggregation
+}
+
+func snakeCase(s string) string {
+	var b strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,256 @@
+package prometheus
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/sink"
+	"github.com/mackerelio/mackerel-client-go"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	Logger = logrus.NewEntry(logrus.New())
+	Logger.Logger.SetOutput(io.Discard)
+}
+
+// receiver is a stand-in remote write receiver decoding the requests
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	requests [][]*timeSeries
+	headers  []http.Header
+}
+
+func newReceiver(t *testing.T) (*receiver, *httptest.Server) {
+	r := &receiver{status: http.StatusNoContent}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		compressed, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Errorf("invalid snappy body: %v", err)
+		}
+		series, err := decodeWriteRequest(body)
+		if err != nil {
+			t.Errorf("invalid protobuf body: %v", err)
+		}
+		r.mu.Lock()
+		r.requests = append(r.requests, series)
+		r.headers = append(r.headers, req.Header.Clone())
+		status := r.status
+		r.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return r, server
+}
+
+// decodeWriteRequest decodes the WriteRequest written by encodeWriteRequest
+func decodeWriteRequest(buf []byte) ([]*timeSeries, error) {
+	series := make([]*timeSeries, 0)
+	err := decodeMessage(buf, func(field int, value []byte, _ uint64) error {
+		if field != 1 {
+			return fmt.Errorf("unknown field %d of WriteRequest", field)
+		}
+		s := &timeSeries{}
+		err := decodeMessage(value, func(field int, value []byte, _ uint64) error {
+			switch field {
+			case 1:
+				l := label{}
+				err := decodeMessage(value, func(field int, value []byte, _ uint64) error {
+					if field == 1 {
+						l.name = string(value)
+					} else {
+						l.value = string(value)
+					}
+					return nil
+				})
+				s.labels = append(s.labels, l)
+				return err
+			case 2:
+				smp := sample{}
+				err := decodeMessage(value, func(field int, value []byte, n uint64) error {
+					if field == 1 {
+						smp.value = math.Float64frombits(n)
+					} else {
+						smp.timestamp = int64(n)
+					}
+					return nil
+				})
+				s.samples = append(s.samples, smp)
+				return err
+			}
+			return fmt.Errorf("unknown field %d of TimeSeries", field)
+		})
+		series = append(series, s)
+		return err
+	})
+	return series, err
+}
+
+// decodeMessage calls fn with each field of the message, with the bytes of a length-delimited field or the number of the others
+func decodeMessage(buf []byte, fn func(field int, value []byte, n uint64) error) error {
+	for len(buf) > 0 {
+		tag, size := binary.Uvarint(buf)
+		if size <= 0 {
+			return fmt.Errorf("invalid tag")
+		}
+		buf = buf[size:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case wireVarint:
+			n, size := binary.Uvarint(buf)
+			if size <= 0 {
+				return fmt.Errorf("invalid varint of field %d", field)
+			}
+			buf = buf[size:]
+			if err := fn(field, nil, n); err != nil {
+				return err
+			}
+		case wireFixed64:
+			if len(buf) < 8 {
+				return fmt.Errorf("short fixed64 of field %d", field)
+			}
+			if err := fn(field, nil, binary.LittleEndian.Uint64(buf)); err != nil {
+				return err
+			}
+			buf = buf[8:]
+		case wireBytes:
+			length, size := binary.Uvarint(buf)
+			if size <= 0 || uint64(len(buf)-size) < length {
+				return fmt.Errorf("invalid length of field %d", field)
+			}
+			buf = buf[size:]
+			if err := fn(field, buf[:length], 0); err != nil {
+				return err
+			}
+			buf = buf[length:]
+		default:
+			return fmt.Errorf("unknown wire type %d of field %d", tag&7, field)
+		}
+	}
+	return nil
+}
+
+func newTestWriter(server *httptest.Server) *RemoteWriter {
+	return NewRemoteWriter(&PrometheusConfig{
+		RemoteWriteURL: server.URL,
+		Headers:        sink.Headers{"Authorization": "Bearer xxx"},
+		Timeout:        time.Second,
+	}, map[string]string{"function_name": "sample-function", "region": "us-east-1", "function_version": ""})
+}
+
+func TestRemoteWriterPostsSeries(t *testing.T) {
+	r, server := newReceiver(t)
+	w := newTestWriter(server)
+
+	if err := w.Post(context.Background(), []*mackerel.MetricValue{
+		{Name: "custom.lambda.platform.report.billedDuration.avg", Time: 1700000060, Value: 3.0},
+		{Name: "custom.lambda.platform.report.billedDuration.avg", Time: 1700000000, Value: 2.0},
+		{Name: "custom.lambda.platform.report.billedDuration.max", Time: 1700000000, Value: 5.0},
+		{Name: "custom.lambda.platform.runtimeDone.invocations.count", Time: 1700000000, Value: 4.0},
+		{Name: "custom.lambda.ignored", Time: 1700000000, Value: "not a number"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.requests) != 1 {
+		t.Fatalf("requests = %d, want 1", len(r.requests))
+	}
+	header := r.headers[0]
+	for name, want := range map[string]string{
+		"Content-Type":                      "application/x-protobuf",
+		"Content-Encoding":                  "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+		"Authorization":                     "Bearer xxx",
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	billed := func(aggregation string) []label {
+		return []label{
+			{name: "__name__", value: "lambda_platform_report_billed_duration"},
+			{name: "aggregation", value: aggregation},
+			{name: "function_name", value: "sample-function"},
+			{name: "region", value: "us-east-1"},
+		}
+	}
+	want := []*timeSeries{
+		{
+			labels:  billed("avg"),
+			samples: []sample{{value: 2.0, timestamp: 1700000000000}, {value: 3.0, timestamp: 1700000060000}},
+		},
+		{
+			labels:  billed("max"),
+			samples: []sample{{value: 5.0, timestamp: 1700000000000}},
+		},
+		{
+			labels: []label{
+				{name: "__name__", value: "lambda_platform_runtime_done_invocations_count"},
+				{name: "function_name", value: "sample-function"},
+				{name: "region", value: "us-east-1"},
+			},
+			samples: []sample{{value: 4.0, timestamp: 1700000000000}},
+		},
+	}
+	if !reflect.DeepEqual(r.requests[0], want) {
+		for _, s := range r.requests[0] {
+			t.Logf("got %+v", *s)
+		}
+		t.Errorf("series differ from the expected ones")
+	}
+}
+
+func TestRemoteWriterErrors(t *testing.T) {
+	tests := []struct {
+		status    int
+		permanent bool
+	}{
+		{http.StatusBadRequest, true},
+		{http.StatusTooManyRequests, false},
+		{http.StatusServiceUnavailable, false},
+	}
+	for _, tt := range tests {
+		r, server := newReceiver(t)
+		r.status = tt.status
+		err := newTestWriter(server).Post(context.Background(), []*mackerel.MetricValue{
+			{Name: "custom.lambda.platform.report.duration.avg", Time: 1700000000, Value: 1.0},
+		})
+		if err == nil || sink.IsPermanent(err) != tt.permanent {
+			t.Errorf("%d: err = %v, want permanent %v", tt.status, err, tt.permanent)
+		}
+	}
+}
+
+func TestMetricName(t *testing.T) {
+	tests := []struct {
+		name        string
+		want        string
+		aggregation string
+	}{
+		{"custom.lambda.platform.report.billedDuration.avg", "lambda_platform_report_billed_duration", "avg"},
+		{"custom.lambda.platform.report.maxMemoryUsedMB.p99", "lambda_platform_report_max_memory_used_mb", "p99"},
+		{"custom.lambda.osstat.tmp.used-percent", "lambda_osstat_tmp_used_percent", ""},
+	}
+	for _, tt := range tests {
+		name, aggregation := metricName(tt.name)
+		if name != tt.want || aggregation != tt.aggregation {
+			t.Errorf("metricName(%q) = %q, %q, want %q, %q", tt.name, name, aggregation, tt.want, tt.aggregation)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package sink
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mackerelio/mackerel-client-go"
+	"github.com/sirupsen/logrus"
+)
+
+var Logger *logrus.Entry
+
+// Sink is an output of the metrics aggregated by the dispatcher
+type Sink interface {
+	// Name identifies the sink in logs
+	Name() string
+	// Send queues the metrics, and sends them when the batch is ready
+	Send(ctx context.Context, metrics []*mackerel.MetricValue) error
+	// Flush sends all the queued metrics
+	Flush(ctx context.Context) error
+}
+
+// Poster posts a batch of metrics to a backend. Poster is wrapped by NewBatchingSink to be a Sink.
+type Poster interface {
+	Name() string
+	Post(ctx context.Context, metrics []*mackerel.MetricValue) error
+}
+
+// permanentError is an error which is not resolved by retrying
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not to be retried
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err is marked by Permanent
+func IsPermanent(err error) bool {
+	var perr *permanentError
+	return errors.As(err, &perr)
+}
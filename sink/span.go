@@ -0,0 +1,26 @@
+package sink
+
+import (
+	"context"
+	"time"
+)
+
+// Span is a phase of an invocation or an initialization reported by the Telemetry API
+type Span struct {
+	// TraceID is 32 hex digits
+	TraceID string
+	// SpanID and ParentSpanID are 16 hex digits. ParentSpanID is empty for a root span.
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]string
+	Failed       bool
+}
+
+// SpanSink is an output of the spans built by the dispatcher
+type SpanSink interface {
+	Name() string
+	SendSpans(ctx context.Context, spans []*Span) error
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mackerelio-labs/mackerel-lambda-extension-agent/host/mackerel"
+)
+
+// redacted replaces the secrets in the printed settings
+const redacted = "********"
+
+// secretSettings are the settings whose values are redacted as a whole
+var secretSettings = map[string]bool{
+	"EXT_MACKEREL_API_KEY": true,
+	"AWS_SESSION_TOKEN":    true,
+}
+
+// runValidate loads the settings as the agent does, and checks the API key and the roles against Mackerel.
+// It prints the effective settings with the secrets redacted, and fails if any problem is found.
+func runValidate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	conf, err := getValidateConfig()
+	if err != nil {
+		return fmt.Errorf("invalid settings: %w", err)
+	}
+
+	fmt.Println("Settings:")
+	for _, setting := range effectiveSettings(conf.sections()...) {
+		fmt.Printf("  %s=%s\n", setting[0], redactSetting(setting[0], setting[1]))
+	}
+
+	problems := 0
+	if err := mackerel.VerifyAPIKey(conf.MackerelConfig.ApiKey); err != nil {
+		fmt.Println("NG:", err)
+		problems++
+	} else {
+		fmt.Println("OK: the API key has the read and write permission")
+	}
+
+	if len(conf.MackerelConfig.RoleFullnames) > 0 {
+		missing, err := mackerel.FindMissingRoles(conf.MackerelConfig.ApiKey, conf.MackerelConfig.RoleFullnames)
+		switch {
+		case err != nil:
+			fmt.Println("NG: failed to find the roles:", err)
+			problems++
+		case len(missing) > 0 && conf.MackerelConfig.AutoCreateRoles:
+			fmt.Println("OK: the roles will be created:", strings.Join(missing, ", "))
+		case len(missing) > 0:
+			fmt.Println("NG: the roles don't exist:", strings.Join(missing, ", "))
+			problems++
+		default:
+			fmt.Println("OK: the roles exist:", strings.Join(conf.MackerelConfig.RoleFullnames, ", "))
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%d problem(s) found", problems)
+	}
+	return nil
+}
+
+// getValidateConfig reads the settings as GetConfig does, except the ones given by the Lambda runtime,
+// so that the subcommand runs in CI without AWS_LAMBDA_RUNTIME_API or the boot ID.
+func getValidateConfig() (*Config, error) {
+	conf := &Config{}
+	for _, section := range conf.sections() {
+		if err := parseSettings(section); err != nil {
+			return nil, err
+		}
+	}
+	// getMackerelConfig resolves the API key from SSM or Secrets Manager
+	mackerelConf, err := getMackerelConfig()
+	if err != nil {
+		return nil, err
+	}
+	conf.MackerelConfig = *mackerelConf
+	if err := validateSections(conf); err != nil {
+		return nil, err
+	}
+	functionName := os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+	if conf.MackerelConfig.AutoCreateRoles && len(conf.MackerelConfig.RoleFullnames) == 0 && functionName != "" {
+		conf.MackerelConfig.RoleFullnames = []string{mackerel.DefaultRoleFullname(functionName)}
+	}
+	return conf, nil
+}
+
+// effectiveSettings returns the values of the env tags of the config structs, sorted by the names.
+// A variable read by more than one field, e.g. AWS_REGION, appears once.
+func effectiveSettings(sections ...interface{}) [][2]string {
+	collected := make([][2]string, 0)
+	for _, section := range sections {
+		collectSettings(reflect.ValueOf(section), "", &collected)
+	}
+	sort.SliceStable(collected, func(i, j int) bool {
+		return collected[i][0] < collected[j][0]
+	})
+	settings := make([][2]string, 0, len(collected))
+	for _, setting := range collected {
+		if len(settings) == 0 || settings[len(settings)-1][0] != setting[0] {
+			settings = append(settings, setting)
+		}
+	}
+	return settings
+}
+
+func collectSettings(v reflect.Value, prefix string, settings *[][2]string) {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("env"), ",")
+		if name == "" {
+			collectSettings(v.Field(i), prefix+field.Tag.Get("envPrefix"), settings)
+			continue
+		}
+		separator := field.Tag.Get("envSeparator")
+		if separator == "" {
+			separator = ","
+		}
+		*settings = append(*settings, [2]string{prefix + name, formatSetting(v.Field(i), separator)})
+	}
+}
+
+// formatSetting formats the value as it's given by the environment variable
+func formatSetting(v reflect.Value, separator string) string {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		items := make([]string, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			items = append(items, fmt.Sprint(v.Index(i).Interface()))
+		}
+		return strings.Join(items, separator)
+	case reflect.Map:
+		pairs := make([]string, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			pairs = append(pairs, fmt.Sprintf("%v=%v", iter.Key().Interface(), iter.Value().Interface()))
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, separator)
+	}
+	if d, ok := v.Interface().(time.Duration); ok {
+		return d.String()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// redactSetting hides the secrets: the API key, the values of the headers and the passwords in the URLs
+func redactSetting(name string, value string) string {
+	if value == "" {
+		return value
+	}
+	switch {
+	case secretSettings[name]:
+		return redacted
+	case strings.HasSuffix(name, "_HEADERS"):
+		pairs := strings.Split(value, ",")
+		for i, pair := range pairs {
+			if k, _, ok := strings.Cut(pair, "="); ok {
+				pairs[i] = k + "=" + redacted
+			}
+		}
+		return strings.Join(pairs, ",")
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return value
+}